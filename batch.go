@@ -0,0 +1,213 @@
+package trickle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+)
+
+// Batch catch-up: GET {channel}/batch/{idx} returns every completed
+// segment from idx onwards as multipart/mixed, one part per segment,
+// so subscribers that fell behind can catch up in a single round trip.
+// Parts carry the usual segment headers along with what a GET would
+// send as trailers. The segment being written is not included; read it
+// with a regular GET for the seq after the last part.
+
+// Sent in the part headers rather than as trailers
+var batchTrailers = append([]string{"Lp-Trickle-Last-Byte", "Lp-Trickle-Bytes", "Lp-Trickle-Digest", "Lp-Trickle-Aborted"}, relayedTrailers...)
+
+func (sm *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	idx, err := strconv.Atoi(r.PathValue("idx"))
+	if err != nil || idx < -2 {
+		http.Error(w, "Invalid idx", http.StatusBadRequest)
+		return
+	}
+	stream.handleBatch(w, r, idx)
+}
+
+func (s *Stream) handleBatch(w http.ResponseWriter, r *http.Request, idx int) {
+	defer s.presence.add()()
+	segments, idx, latestSeq, exists, closed := s.getBatch(idx)
+	w.Header().Set("Lp-Trickle-Seq", strconv.Itoa(idx))
+	w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
+	if !exists {
+		if closed {
+			w.Header().Set("Lp-Trickle-Closed", "terminated")
+		} else {
+			w.WriteHeader(470)
+		}
+		w.Write([]byte("Entry not found"))
+		return
+	}
+	if len(segments) == 0 {
+		// caught up; GET idx as usual
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var init []byte
+	if r.Header.Get("Lp-Trickle-Init") != "" || r.URL.Query().Get("init") != "" {
+		init = s.getInit()
+	}
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+	for i, segment := range segments {
+		info := segment.info()
+		h := textproto.MIMEHeader{}
+		h.Set("Lp-Trickle-Seq", strconv.Itoa(info.idx))
+		if s.mimeType != "" {
+			h.Set("Content-Type", s.mimeType)
+		}
+		h.Set("Lp-Trickle-Created", formatTrickleTime(info.firstByte))
+		h.Set("Lp-Trickle-Epoch", strconv.Itoa(info.epoch))
+		if info.discontinuity {
+			h.Set("Lp-Trickle-Discontinuity", "true")
+		}
+		h.Set("Lp-Trickle-Last-Byte", formatTrickleTime(info.lastByte))
+		h.Set("Lp-Trickle-Bytes", strconv.Itoa(info.size))
+		if info.digest != "" {
+			h.Set("Lp-Trickle-Digest", info.digest)
+		}
+		if info.aborted {
+			h.Set("Lp-Trickle-Aborted", "true")
+		}
+		for k, v := range segment.getTrailer() {
+			h[k] = v
+		}
+		if i == 0 && init != nil {
+			h.Set("Lp-Trickle-Init", "prepended")
+			h.Set("Lp-Trickle-Init-Bytes", strconv.Itoa(len(init)))
+		}
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			slog.Error("Error sending batch to client", "stream", s.name, "idx", info.idx, "err", err)
+			return
+		}
+		if i == 0 && init != nil {
+			part.Write(init)
+		}
+		subscriber := &SegmentSubscriber{segment: segment, ctx: r.Context()}
+		for {
+			data, eof := subscriber.readData()
+			if _, err := part.Write(data); err != nil {
+				slog.Error("Error sending batch to client", "stream", s.name, "idx", info.idx, "err", err)
+				return
+			}
+			if eof {
+				break
+			}
+		}
+	}
+	mw.Close()
+}
+
+// Completed segments from idx up to the first one still being written.
+// Also returns the resolved idx, the next write, whether idx is in the
+// window (or is the next write) and whether the stream is closed.
+func (s *Stream) getBatch(idx int) ([]*Segment, int, int, bool, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	idx = s.resolveIdx(idx)
+	if idx > s.nextWrite || idx < s.nextWrite-maxSegmentsPerStream {
+		return nil, idx, s.nextWrite, false, s.closed
+	}
+	first := s.segments[idx%maxSegmentsPerStream]
+	if idx < s.nextWrite && (first == nil || first.idx != idx) {
+		return nil, idx, s.nextWrite, false, s.closed
+	}
+	var segments []*Segment
+	for i := idx; i < s.nextWrite; i++ {
+		segment := s.segments[i%maxSegmentsPerStream]
+		if segment == nil || segment.idx != i {
+			continue
+		}
+		info := segment.info()
+		if !info.closed {
+			break
+		}
+		if info.size == 0 {
+			continue // cancelled before it started, a GET would 470
+		}
+		segments = append(segments, segment)
+	}
+	return segments, idx, s.nextWrite, true, s.closed
+}
+
+// Issues a batch GET from the subscriber's seq. Returns nil if there is
+// nothing to catch up on.
+func (c *TrickleSubscriber) fetchBatch() (*http.Response, *multipart.Reader, error) {
+	req, err := http.NewRequestWithContext(c.ctx, "GET", fmt.Sprintf("%s/batch/%d", c.url, c.idx), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.needsInit {
+		req.Header.Set("Lp-Trickle-Init", "prepend")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to complete batch GET: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNoContent:
+			return nil, nil, nil
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, nil, StreamNotFoundErr
+		case resp.StatusCode == 470:
+			return nil, nil, &SequenceNonexistent{Seq: GetSeq(resp), Latest: GetLatest(resp)}
+		case IsEOS(resp):
+			return nil, nil, EOS
+		}
+		return nil, nil, &HTTPError{Code: resp.StatusCode, Body: string(body)}
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		resp.Body.Close()
+		return nil, nil, errors.New("batch response is not multipart")
+	}
+	return resp, multipart.NewReader(resp.Body, params["boundary"]), nil
+}
+
+// Returns the next segment of the batch as if it came from a GET,
+// or nil once the batch is done
+func (c *TrickleSubscriber) nextBatchPart() *http.Response {
+	part, err := c.batch.NextPart()
+	if err != nil {
+		if err != io.EOF {
+			slog.Error("Failed to read batch, falling back to GETs", "url", c.url, "idx", c.idx, "err", err)
+		}
+		c.batchResp.Body.Close()
+		c.batch, c.batchResp = nil, nil
+		return nil
+	}
+	resp := &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      c.batchResp.Proto,
+		ProtoMajor: c.batchResp.ProtoMajor,
+		ProtoMinor: c.batchResp.ProtoMinor,
+		Header:     http.Header(part.Header),
+		Trailer:    http.Header{},
+		Body:       part,
+		Request:    c.batchResp.Request,
+	}
+	for _, k := range batchTrailers {
+		if v := part.Header.Values(k); len(v) > 0 {
+			resp.Trailer[k] = v
+		}
+	}
+	return resp
+}
@@ -0,0 +1,151 @@
+package trickle_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestBatch_Parts(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "batch")
+	for i := 0; i < 4; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+
+	resp, err := http.Get(ts.ChannelURL("batch") + "/batch/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if trickle.GetSeq(resp) != 1 || trickle.GetLatest(resp) != 4 {
+		t.Errorf("unexpected headers %v", resp.Header)
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 1; i < 4; i++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(part)
+		want := fmt.Sprintf("seg %d", i)
+		if part.Header.Get("Lp-Trickle-Seq") != fmt.Sprint(i) || string(data) != want ||
+			part.Header.Get("Lp-Trickle-Bytes") != fmt.Sprint(len(want)) || part.Header.Get("Lp-Trickle-Digest") == "" {
+			t.Errorf("unexpected part %v %q", part.Header, data)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected end of batch, got %v", err)
+	}
+}
+
+func TestBatch_Edges(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "edges")
+	for i := 0; i < 7; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+	status := func(path string) *http.Response {
+		resp, err := http.Get(ts.ChannelURL("edges") + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// caught up, or still being written, is a 204 for the seq to GET
+	if resp := status("/batch/7"); resp.StatusCode != http.StatusNoContent || trickle.GetSeq(resp) != 7 {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp := status("/batch/-1"); resp.StatusCode != http.StatusNoContent || trickle.GetSeq(resp) != 7 {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+	// outside the window
+	for _, path := range []string{"/batch/0", "/batch/9"} {
+		if resp := status(path); resp.StatusCode != 470 || trickle.GetLatest(resp) != 7 {
+			t.Errorf("%s: unexpected response %d %v", path, resp.StatusCode, resp.Header)
+		}
+	}
+	if resp := status("/batch/x"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+	resp, err := http.Get(ts.URL + "/missing/batch/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestBatch_Subscriber(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "behind")
+	for i := 0; i < 4; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+	var gets, batches atomic.Int32
+	ts.InjectFault(func(r *http.Request) bool {
+		return r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/behind/")
+	}, func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasPrefix(r.URL.Path, "/behind/batch/") {
+			batches.Add(1)
+		} else {
+			gets.Add(1)
+		}
+		return false
+	}, 0)
+
+	// the backlog comes from a single request
+	sub := ts.SubscriberWithConfig("behind", 0, trickle.TrickleSubscriberConfig{Batch: true, VerifyDigest: true})
+	for i := 0; i < 4; i++ {
+		if seq, data := trickletest.Read(t, sub); seq != i || data != fmt.Sprintf("seg %d", i) {
+			t.Errorf("expected segment %d, got %d %q", i, seq, data)
+		}
+	}
+	if batches.Load() != 1 || gets.Load() != 0 {
+		t.Errorf("unexpected requests: %d batches, %d gets", batches.Load(), gets.Load())
+	}
+
+	// then it carries on at the live edge
+	done := make(chan string)
+	go func() {
+		_, data := trickletest.Read(t, sub)
+		done <- data
+	}()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "behind").Subscribers >= 1 })
+	trickletest.Publish(t, pub, "live")
+	if data := <-done; data != "live" {
+		t.Errorf("unexpected segment %q", data)
+	}
+
+	// and catches up again after a seek
+	sub.SetSeq(2)
+	if seq, _ := trickletest.Read(t, sub); seq != 2 || batches.Load() != 2 {
+		t.Errorf("unexpected seq %d after %d batches", seq, batches.Load())
+	}
+
+	// falling out of the window is reported as usual
+	for i := 0; i < 5; i++ {
+		trickletest.Publish(t, pub, "more")
+	}
+	sub.SetSeq(0)
+	var nonexistent *trickle.SequenceNonexistent
+	if _, err := sub.Read(); !errors.As(err, &nonexistent) || nonexistent.Latest != 10 {
+		t.Errorf("expected 470, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package trickle_test
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestClock_Sweep(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate: true,
+		Changefeed: true,
+		Clock:      clock,
+	})
+	idle := ts.Publisher(t, "idle")
+	active := ts.Publisher(t, "active")
+	trickletest.Publish(t, idle, "once")
+	// skip over the changefeed, idle and active being added
+	changes := ts.Subscriber(trickle.CHANGEFEED, 3)
+
+	// both are younger than the default 5 minute idle timeout
+	clock.Advance(4 * time.Minute)
+	trickletest.Publish(t, active, "again")
+	clock.Advance(2 * time.Minute)
+	if ch := readChange(t, changes); len(ch.Removed) != 1 || ch.Removed[0] != "idle" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	ts.Info(t, "active")
+}
+
+func TestClock_PreconnectRefresh(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "refresh")
+	var gets atomic.Int32
+	ts.InjectFault(trickletest.Request("GET", "/refresh/0"), func(w http.ResponseWriter, r *http.Request) bool {
+		gets.Add(1)
+		return false
+	}, 0)
+
+	clock := trickletest.NewFakeClock(time.Now())
+	sub := ts.SubscriberWithConfig("refresh", 0, trickle.TrickleSubscriberConfig{Clock: clock})
+	done := make(chan string)
+	go func() {
+		_, data := trickletest.Read(t, sub)
+		done <- data
+	}()
+	trickletest.WaitFor(t, func() bool { return gets.Load() == 1 && clock.Pending() == 1 })
+
+	// the waiting GET is re-established once the refresh timeout passes
+	clock.Advance(20 * time.Second)
+	trickletest.WaitFor(t, func() bool { return gets.Load() == 2 })
+	trickletest.Publish(t, pub, "refreshed")
+	if data := <-done; data != "refreshed" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
+
+func TestClock_UnwatchedGracePeriod(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:       true,
+		Changefeed:       true,
+		SubscriberEvents: true,
+		Clock:            clock,
+	})
+	changes := ts.Subscriber(trickle.CHANGEFEED, 1)
+	ts.Publisher(t, "grace")
+	readChange(t, changes)
+
+	// a subscriber comes and goes
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", ts.ChannelURL("grace")+"/0", nil)
+	go http.DefaultClient.Do(req)
+	if ch := readChange(t, changes); len(ch.Watched) != 1 || ch.Watched[0] != "grace" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	cancel()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "grace").Subscribers == 0 })
+
+	// nothing is announced until the grace period is up
+	latest := ts.Info(t, trickle.CHANGEFEED).Latest
+	clock.Advance(4 * time.Second)
+	if info := ts.Info(t, trickle.CHANGEFEED); info.Latest != latest {
+		t.Fatalf("unexpected changefeed update %+v", info)
+	}
+	clock.Advance(time.Second)
+	if ch := readChange(t, changes); len(ch.Unwatched) != 1 || ch.Unwatched[0] != "grace" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+}
@@ -0,0 +1,373 @@
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Largest non-mdat box we are willing to buffer, eg moov or moof
+const maxCMAFBoxSize = 16 * 1024 * 1024
+
+// CMAFSegmenter splits a fragmented MP4 (CMAF) byte stream into
+// an init segment (ftyp + moov) and media segments (moof + mdat),
+// cutting media segments on video keyframes.
+//
+// This works with the output of eg
+// `ffmpeg -f mp4 -movflags frag_keyframe+empty_moov+default_base_moof`
+//
+// Boxes in between fragments such as styp, sidx or prft are kept
+// with the fragment that follows them. Streams without video are
+// cut on every fragment, subject to MinDuration.
+type CMAFSegmenter struct {
+	// Minimum segment duration based on decode timestamps. Segments are
+	// cut on the first keyframe after this elapses. (default 0: cut on
+	// every keyframe)
+	MinDuration time.Duration
+}
+
+type cmafTrack struct {
+	timescale    uint32
+	isVideo      bool
+	defaultFlags uint32 // from trex
+}
+
+type cmafSegmenterState struct {
+	tracks   map[uint32]*cmafTrack
+	splitID  uint32 // track used for cut decisions
+	init     []byte
+	pending  []byte // boxes waiting for the next moof
+	writer   *TrickleWriter
+	hasMedia bool
+	startDTS uint64
+	hasDTS   bool
+}
+
+type mp4BoxHeader struct {
+	boxType    string
+	size       int64 // including the header; -1 if it runs until EOF
+	headerSize int
+}
+
+// RunSegmentation reads fragmented MP4 from `in` until EOF. The init segment is
+// passed to initHandler before any media segments, and again if it changes.
+// Media segment contents are trickled out as they are read.
+func (cs *CMAFSegmenter) RunSegmentation(in io.Reader, initHandler func(init []byte), segmentHandler SegmentHandler) error {
+	st := &cmafSegmenterState{
+		tracks: map[uint32]*cmafTrack{},
+	}
+	defer func() {
+		if st.writer != nil {
+			st.writer.Close()
+		}
+	}()
+	reader := bufio.NewReaderSize(in, 64*1024)
+	for {
+		hdr, raw, err := readMP4BoxHeader(reader)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		if hdr.boxType == "mdat" {
+			if st.writer == nil {
+				// mdat without a moof; nothing to attach it to
+				if err := copyMP4Box(io.Discard, reader, hdr); err != nil {
+					return ignoreEOF(err)
+				}
+				continue
+			}
+			st.writer.Write(raw)
+			if err := copyMP4Box(st.writer, reader, hdr); err != nil {
+				return ignoreEOF(err)
+			}
+			continue
+		}
+
+		if hdr.size < 0 || hdr.size > maxCMAFBoxSize {
+			return fmt.Errorf("unsupported %s box size %d", hdr.boxType, hdr.size)
+		}
+		box := make([]byte, hdr.size)
+		copy(box, raw)
+		if _, err := io.ReadFull(reader, box[len(raw):]); err != nil {
+			return ignoreEOF(err)
+		}
+		payload := box[hdr.headerSize:]
+
+		switch hdr.boxType {
+		case "ftyp":
+			st.init = append(st.init[:0], box...)
+		case "moov":
+			st.init = append(st.init, box...)
+			st.parseMoov(payload)
+			initHandler(bytes.Clone(st.init))
+		case "moof":
+			st.handleMoof(box, payload, cs.MinDuration, segmentHandler)
+		default:
+			st.pending = append(st.pending, box...)
+		}
+	}
+}
+
+func (st *cmafSegmenterState) handleMoof(box, payload []byte, minDuration time.Duration, segmentHandler SegmentHandler) {
+	isKey, dts, hasDTS := st.parseMoof(payload)
+	if st.writer != nil && st.hasMedia && isKey && st.elapsed(dts, hasDTS) >= minDuration {
+		st.writer.Close()
+		st.writer = nil
+	}
+	if st.writer == nil {
+		st.writer = NewTrickleWriter()
+		segmentHandler(st.writer.MakeReader())
+		st.hasMedia = false
+	}
+	if !st.hasMedia {
+		st.hasMedia = true
+		st.startDTS, st.hasDTS = dts, hasDTS
+	}
+	st.writer.Write(st.pending)
+	st.pending = st.pending[:0]
+	st.writer.Write(box)
+}
+
+// Time elapsed since the start of the segment
+func (st *cmafSegmenterState) elapsed(dts uint64, hasDTS bool) time.Duration {
+	track := st.tracks[st.splitID]
+	if !hasDTS || !st.hasDTS || track == nil || track.timescale == 0 || dts < st.startDTS {
+		// no usable timing info so always allow a cut
+		return time.Duration(1<<63 - 1)
+	}
+	ticks := dts - st.startDTS
+	return time.Duration(float64(ticks) / float64(track.timescale) * float64(time.Second))
+}
+
+// Collects track info; the first video track is used for cut decisions
+func (st *cmafSegmenterState) parseMoov(payload []byte) {
+	st.tracks = map[uint32]*cmafTrack{}
+	st.splitID = 0
+	hasVideo := false
+	for _, trak := range mp4Children(payload, "trak") {
+		tkhd := mp4Child(trak, "tkhd")
+		mdia := mp4Child(trak, "mdia")
+		if len(tkhd) < 4 || mdia == nil {
+			continue
+		}
+		// track_ID comes after the creation / modification times
+		offset := 12
+		if tkhd[0] == 1 {
+			offset = 20
+		}
+		if len(tkhd) < offset+4 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(tkhd[offset:])
+		track := &cmafTrack{}
+		if mdhd := mp4Child(mdia, "mdhd"); len(mdhd) >= 4 {
+			offset := 12
+			if mdhd[0] == 1 {
+				offset = 20
+			}
+			if len(mdhd) >= offset+4 {
+				track.timescale = binary.BigEndian.Uint32(mdhd[offset:])
+			}
+		}
+		if hdlr := mp4Child(mdia, "hdlr"); len(hdlr) >= 12 {
+			track.isVideo = string(hdlr[8:12]) == "vide"
+		}
+		st.tracks[id] = track
+		if st.splitID == 0 || (track.isVideo && !hasVideo) {
+			st.splitID = id
+			hasVideo = hasVideo || track.isVideo
+		}
+	}
+	if mvex := mp4Child(payload, "mvex"); mvex != nil {
+		for _, trex := range mp4Children(mvex, "trex") {
+			if len(trex) < 24 {
+				continue
+			}
+			if track := st.tracks[binary.BigEndian.Uint32(trex[4:])]; track != nil {
+				track.defaultFlags = binary.BigEndian.Uint32(trex[20:])
+			}
+		}
+	}
+}
+
+// Returns whether the fragment starts with a sync sample on the split
+// track, along with the decode time of that track if present
+func (st *cmafSegmenterState) parseMoof(payload []byte) (bool, uint64, bool) {
+	for _, traf := range mp4Children(payload, "traf") {
+		tfhd := mp4Child(traf, "tfhd")
+		if len(tfhd) < 8 {
+			continue
+		}
+		id := binary.BigEndian.Uint32(tfhd[4:])
+		if len(st.tracks) > 0 && id != st.splitID {
+			continue
+		}
+		track := st.tracks[id]
+
+		var (
+			dts    uint64
+			hasDTS bool
+			flags  uint32
+		)
+		if track != nil {
+			flags = track.defaultFlags
+		}
+		if f, ok := tfhdDefaultFlags(tfhd); ok {
+			flags = f
+		}
+		if tfdt := mp4Child(traf, "tfdt"); len(tfdt) >= 8 {
+			if tfdt[0] == 1 && len(tfdt) >= 12 {
+				dts = binary.BigEndian.Uint64(tfdt[4:])
+			} else {
+				dts = uint64(binary.BigEndian.Uint32(tfdt[4:]))
+			}
+			hasDTS = true
+		}
+		if trun := mp4Child(traf, "trun"); trun != nil {
+			if f, ok := trunFirstSampleFlags(trun); ok {
+				flags = f
+			}
+		}
+		if track != nil && !track.isVideo {
+			return true, dts, hasDTS
+		}
+		// sample_is_non_sync_sample; without any flags assume a keyframe
+		return flags&0x00010000 == 0, dts, hasDTS
+	}
+	// split track isn't in this fragment
+	return len(st.tracks) == 0, 0, false
+}
+
+func tfhdDefaultFlags(tfhd []byte) (uint32, bool) {
+	boxFlags := binary.BigEndian.Uint32(tfhd) & 0xFFFFFF
+	if boxFlags&0x20 == 0 {
+		return 0, false
+	}
+	offset := 8
+	for _, f := range []struct {
+		flag uint32
+		size int
+	}{{0x1, 8}, {0x2, 4}, {0x8, 4}, {0x10, 4}} {
+		if boxFlags&f.flag != 0 {
+			offset += f.size
+		}
+	}
+	if len(tfhd) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(tfhd[offset:]), true
+}
+
+func trunFirstSampleFlags(trun []byte) (uint32, bool) {
+	if len(trun) < 8 {
+		return 0, false
+	}
+	boxFlags := binary.BigEndian.Uint32(trun) & 0xFFFFFF
+	sampleCount := binary.BigEndian.Uint32(trun[4:])
+	offset := 8
+	if boxFlags&0x1 != 0 {
+		offset += 4 // data offset
+	}
+	if boxFlags&0x4 != 0 {
+		if len(trun) < offset+4 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(trun[offset:]), true
+	}
+	if boxFlags&0x400 == 0 || sampleCount == 0 {
+		return 0, false
+	}
+	// flags of the first sample in the table
+	if boxFlags&0x100 != 0 {
+		offset += 4 // duration
+	}
+	if boxFlags&0x200 != 0 {
+		offset += 4 // size
+	}
+	if len(trun) < offset+4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(trun[offset:]), true
+}
+
+// Returns the parsed header along with the raw header bytes
+func readMP4BoxHeader(r *bufio.Reader) (mp4BoxHeader, []byte, error) {
+	raw := make([]byte, 8, 16)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return mp4BoxHeader{}, nil, err
+	}
+	hdr := mp4BoxHeader{
+		boxType:    string(raw[4:8]),
+		size:       int64(binary.BigEndian.Uint32(raw)),
+		headerSize: 8,
+	}
+	switch hdr.size {
+	case 0:
+		hdr.size = -1
+	case 1:
+		raw = raw[:16]
+		if _, err := io.ReadFull(r, raw[8:]); err != nil {
+			return hdr, nil, err
+		}
+		hdr.size = int64(binary.BigEndian.Uint64(raw[8:]))
+		hdr.headerSize = 16
+	}
+	if hdr.size >= 0 && hdr.size < int64(hdr.headerSize) {
+		return hdr, nil, fmt.Errorf("invalid %s box size %d", hdr.boxType, hdr.size)
+	}
+	return hdr, raw, nil
+}
+
+func copyMP4Box(w io.Writer, r io.Reader, hdr mp4BoxHeader) error {
+	if hdr.size < 0 {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	_, err := io.CopyN(w, r, hdr.size-int64(hdr.headerSize))
+	return err
+}
+
+func ignoreEOF(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// Returns the payloads of all direct children with the given type
+func mp4Children(data []byte, boxType string) [][]byte {
+	var children [][]byte
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		headerSize := 8
+		if size == 1 && len(data) >= 16 {
+			size = int(binary.BigEndian.Uint64(data[8:]))
+			headerSize = 16
+		} else if size == 0 {
+			size = len(data)
+		}
+		if size < headerSize || size > len(data) {
+			break
+		}
+		if string(data[4:8]) == boxType {
+			children = append(children, data[headerSize:size])
+		}
+		data = data[size:]
+	}
+	return children
+}
+
+// Returns the payload of the first child with the given type, or nil
+func mp4Child(data []byte, boxType string) []byte {
+	if children := mp4Children(data, boxType); len(children) > 0 {
+		return children[0]
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package trickle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const (
+	testVideoTrack = 1
+	testAudioTrack = 2
+	testTimescale  = 90000
+)
+
+func mp4Box(boxType string, children ...[]byte) []byte {
+	payload := bytes.Join(children, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+	box = append(box, boxType...)
+	return append(box, payload...)
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, fields ...uint32) []byte {
+	payload := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags)
+	for _, f := range fields {
+		payload = binary.BigEndian.AppendUint32(payload, f)
+	}
+	return mp4Box(boxType, payload)
+}
+
+func testTrak(id uint32, handler string) []byte {
+	return mp4Box("trak",
+		mp4FullBox("tkhd", 0, 3, 0, 0, id),
+		mp4Box("mdia",
+			mp4FullBox("mdhd", 0, 0, 0, 0, testTimescale, 0),
+			mp4Box("hdlr", []byte{0, 0, 0, 0, 0, 0, 0, 0}, []byte(handler)),
+		),
+	)
+}
+
+func testInit(withVideo bool) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), []byte{0, 0, 0, 0})
+	traks := [][]byte{mp4FullBox("mvhd", 0, 0, 0, 0, 1000, 0)}
+	trexs := [][]byte{}
+	if withVideo {
+		traks = append(traks, testTrak(testVideoTrack, "vide"))
+		// default to non-sync samples
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, testVideoTrack, 1, 0, 0, 0x00010000))
+	}
+	traks = append(traks, testTrak(testAudioTrack, "soun"))
+	trexs = append(trexs, mp4FullBox("trex", 0, 0, testAudioTrack, 1, 0, 0, 0))
+	traks = append(traks, mp4Box("mvex", trexs...))
+	return append(ftyp, mp4Box("moov", traks...)...)
+}
+
+// A fragment with one traf for the track, keyframe signaled via the trun
+func testFragment(track uint32, dts uint64, isKey bool) []byte {
+	tfdt := mp4Box("tfdt", []byte{1, 0, 0, 0}, binary.BigEndian.AppendUint64(nil, dts))
+	trun := mp4FullBox("trun", 0, 0x1, 1, 0)
+	if isKey {
+		trun = mp4FullBox("trun", 0, 0x1|0x4, 1, 0, 0x02000000)
+	}
+	moof := mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, 1),
+		mp4Box("traf", mp4FullBox("tfhd", 0, 0x20000, track), tfdt, trun),
+	)
+	return append(moof, mp4Box("mdat", bytes.Repeat([]byte{0xAB}, 1000))...)
+}
+
+// Fragments of one second each with a keyframe every `gop` fragments
+func syntheticCMAF(fragments, gop int, withVideo bool) []byte {
+	buf := bytes.NewBuffer(testInit(withVideo))
+	track := uint32(testAudioTrack)
+	if withVideo {
+		track = testVideoTrack
+	}
+	for i := 0; i < fragments; i++ {
+		buf.Write(testFragment(track, uint64(i*testTimescale), i%gop == 0))
+	}
+	return buf.Bytes()
+}
+
+func runCMAFSegmenter(t *testing.T, cs *CMAFSegmenter, in []byte) ([][]byte, [][]byte) {
+	t.Helper()
+	var (
+		inits   [][]byte
+		readers []CloneableReader
+	)
+	err := cs.RunSegmentation(bytes.NewReader(in), func(init []byte) {
+		inits = append(inits, init)
+	}, func(r CloneableReader) {
+		readers = append(readers, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments [][]byte
+	for _, r := range readers {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, data)
+	}
+	return inits, segments
+}
+
+// Checks the segments hold all the media, ie everything after the init segment
+func checkCMAFSegments(t *testing.T, segments [][]byte, expected int, media []byte) {
+	t.Helper()
+	if len(segments) != expected {
+		t.Fatalf("expected %d segments, got %d", expected, len(segments))
+	}
+	total := 0
+	for i, seg := range segments {
+		if string(seg[4:8]) != "moof" && string(seg[4:8]) != "styp" {
+			t.Errorf("segment %d does not start with a fragment: %q", i, seg[4:8])
+		}
+		total += len(seg)
+	}
+	if total != len(media) {
+		t.Errorf("expected %d bytes of media across segments, got %d", len(media), total)
+	}
+}
+
+func TestCMAFSegmenter_Keyframes(t *testing.T) {
+	in := syntheticCMAF(9, 3, true)
+	inits, segments := runCMAFSegmenter(t, &CMAFSegmenter{}, in)
+	if len(inits) != 1 || !bytes.Equal(inits[0], testInit(true)) {
+		t.Fatalf("unexpected init segments %d", len(inits))
+	}
+	checkCMAFSegments(t, segments, 3, in[len(inits[0]):])
+	for i, seg := range segments {
+		if len(seg) != len(testFragment(testVideoTrack, 0, true))+2*len(testFragment(testVideoTrack, 0, false)) {
+			t.Errorf("segment %d has unexpected length %d", i, len(seg))
+		}
+	}
+}
+
+func TestCMAFSegmenter_MinDuration(t *testing.T) {
+	in := syntheticCMAF(12, 2, true)
+	_, segments := runCMAFSegmenter(t, &CMAFSegmenter{MinDuration: 4 * time.Second}, in)
+	checkCMAFSegments(t, segments, 3, in[len(testInit(true)):])
+
+	// audio only cuts on every fragment
+	in = syntheticCMAF(6, 100, false)
+	_, segments = runCMAFSegmenter(t, &CMAFSegmenter{}, in)
+	checkCMAFSegments(t, segments, 6, in[len(testInit(false)):])
+	_, segments = runCMAFSegmenter(t, &CMAFSegmenter{MinDuration: 2 * time.Second}, in)
+	checkCMAFSegments(t, segments, 3, in[len(testInit(false)):])
+}
+
+func TestCMAFSegmenter_InterleavedBoxes(t *testing.T) {
+	// styp before each fragment goes with the fragment that follows
+	styp := mp4Box("styp", []byte("msdh"), []byte{0, 0, 0, 0})
+	buf := bytes.NewBuffer(testInit(true))
+	for i := 0; i < 4; i++ {
+		buf.Write(styp)
+		buf.Write(testFragment(testVideoTrack, uint64(i*testTimescale), i%2 == 0))
+	}
+	_, segments := runCMAFSegmenter(t, &CMAFSegmenter{}, buf.Bytes())
+	checkCMAFSegments(t, segments, 2, buf.Bytes()[len(testInit(true)):])
+	for i, seg := range segments {
+		if !bytes.HasPrefix(seg, styp) {
+			t.Errorf("segment %d does not start with styp", i)
+		}
+	}
+}
+
+func TestServer_InitSegment(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, false)
+	if init, err := NewTrickleSubscriber(ts.URL + "/missing").ReadInit(); err != StreamNotFoundErr {
+		t.Fatalf("expected stream not found, got %v %v", init, err)
+	}
+
+	url := ts.URL + "/cmaf"
+	pub, err := NewTricklePublisherWithConfig(url, TricklePublisherConfig{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTrickleSubscriber(url)
+	if init, err := sub.ReadInit(); err != nil || init != nil {
+		t.Fatalf("expected no init segment, got %v %v", init, err)
+	}
+
+	init := testInit(true)
+	if err := pub.WriteInit(init); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sub.ReadInit(); err != nil || !bytes.Equal(got, init) {
+		t.Fatalf("unexpected init segment %v", err)
+	}
+
+	// prepended only for the first segment
+	primed := NewTrickleSubscriberWithConfig(url, TrickleSubscriberConfig{PrependInit: true})
+	primed.SetSeq(0)
+	fragment := testFragment(testVideoTrack, 0, true)
+	for i := 0; i < 2; i++ {
+		if err := pub.Write(bytes.NewReader(fragment)); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := primed.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		expected := fragment
+		if i == 0 {
+			expected = append(bytes.Clone(init), fragment...)
+			if resp.Header.Get("Lp-Trickle-Init") == "" {
+				t.Error("missing init header")
+			}
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("segment %d: unexpected contents, got %d bytes expected %d", i, len(data), len(expected))
+		}
+		if resp.Header.Get("Content-Type") != "video/mp4" {
+			t.Errorf("unexpected content type %s", resp.Header.Get("Content-Type"))
+		}
+	}
+
+	resp, err := http.Post(url+"/init", "video/mp4", bytes.NewReader(make([]byte, maxInitSize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected oversized init to be rejected, got %d", resp.StatusCode)
+	}
+}
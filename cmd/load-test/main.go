@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"trickle"
+)
+
+// Load test: N publishers, M subscribers per channel, against a server
+// or an in-process one. Each segment ends with the SHA-256 of its
+// contents so subscribers can check integrity without shared state.
+
+type counters struct {
+	published      atomic.Int64
+	publishedBytes atomic.Int64
+	publishErrors  atomic.Int64
+	read           atomic.Int64
+	readBytes      atomic.Int64
+	readErrors     atomic.Int64
+	checksumErrors atomic.Int64
+	nonexistent    atomic.Int64 // 470s
+	eos            atomic.Int64
+
+	firstByte    trickle.LatencyStats
+	glassToGlass trickle.LatencyStats
+	upload       trickle.LatencyStats
+}
+
+type config struct {
+	url         string
+	prefix      string
+	channels    int
+	subscribers int
+	segmentSize int
+	rate        float64
+	duration    time.Duration
+	chunks      int
+	http2       bool
+	verbose     bool
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.url, "url", "", "Base URL of the trickle server; runs one in-process if empty")
+	flag.StringVar(&cfg.prefix, "prefix", "load", "Channel name prefix")
+	flag.IntVar(&cfg.channels, "channels", 10, "Number of channels, each with one publisher")
+	flag.IntVar(&cfg.subscribers, "subscribers", 2, "Number of subscribers per channel")
+	flag.IntVar(&cfg.segmentSize, "segment-size", 256*1024, "Segment size in bytes")
+	flag.Float64Var(&cfg.rate, "rate", 1, "Segments per second per publisher")
+	flag.DurationVar(&cfg.duration, "duration", 30*time.Second, "How long to publish for")
+	flag.IntVar(&cfg.chunks, "chunks", 10, "Number of chunks to trickle each segment out in")
+	flag.BoolVar(&cfg.http2, "http2", false, "Multiplex each client over a single HTTP/2 connection")
+	flag.BoolVar(&cfg.verbose, "v", false, "Verbose logging, including the in-process server")
+	flag.Parse()
+	if cfg.channels < 1 || cfg.subscribers < 0 || cfg.segmentSize <= sha256.Size || cfg.rate <= 0 || cfg.chunks < 1 {
+		log.Fatal("Invalid arguments")
+	}
+	if !cfg.verbose {
+		// the server logs every request
+		slog.SetLogLoggerLevel(slog.LevelWarn)
+	}
+
+	if cfg.url == "" {
+		url, stop := startServer()
+		defer stop()
+		cfg.url = url
+	}
+	fmt.Printf("Load testing %s: %d channels, %d subscribers each, %d byte segments at %g/s for %v\n",
+		cfg.url, cfg.channels, cfg.subscribers, cfg.segmentSize, cfg.rate, cfg.duration)
+
+	c := &counters{}
+	var (
+		maxGoroutines atomic.Int64
+		maxHeap       atomic.Uint64
+		done          = make(chan struct{})
+	)
+	go sampleRuntime(done, &maxGoroutines, &maxHeap)
+
+	start := time.Now()
+	var pubs, subs sync.WaitGroup
+	for i := 0; i < cfg.channels; i++ {
+		url := fmt.Sprintf("%s/%s_%d", cfg.url, cfg.prefix, i)
+		pub, err := trickle.NewTricklePublisherWithConfig(url, trickle.TricklePublisherConfig{
+			ContentType: "application/octet-stream",
+			HTTP2:       cfg.http2,
+			Digest:      true,
+		})
+		if err != nil {
+			log.Fatalf("Error creating publisher for %s: %v", url, err)
+		}
+		if err := pub.Create(); err != nil {
+			log.Fatalf("Error creating channel %s: %v", url, err)
+		}
+		for j := 0; j < cfg.subscribers; j++ {
+			subs.Add(1)
+			go func() {
+				defer subs.Done()
+				runSubscriber(url, cfg, c)
+			}()
+		}
+		pubs.Add(1)
+		go func(channel int) {
+			defer pubs.Done()
+			runPublisher(pub, uint64(channel), cfg, c)
+		}(i)
+	}
+	pubs.Wait()
+	publishTime := time.Since(start)
+
+	// publishers close their channels so subscribers should wrap up
+	subsDone := make(chan struct{})
+	go func() {
+		subs.Wait()
+		close(subsDone)
+	}()
+	select {
+	case <-subsDone:
+	case <-time.After(30 * time.Second):
+		slog.Warn("Timed out waiting for subscribers")
+	}
+	close(done)
+	report(c, cfg, publishTime, maxGoroutines.Load(), maxHeap.Load())
+	if c.checksumErrors.Load() > 0 || c.publishErrors.Load() > 0 || c.readErrors.Load() > 0 {
+		os.Exit(1)
+	}
+}
+
+func startServer() (string, func()) {
+	mux := http.NewServeMux()
+	srv := trickle.ConfigureServer(trickle.TrickleServerConfig{
+		Mux:        mux,
+		Autocreate: true,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	server.Protocols = &http.Protocols{}
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(l)
+	stop := srv.Start()
+	return "http://" + l.Addr().String(), func() {
+		stop()
+		server.Close()
+	}
+}
+
+// Random contents followed by their SHA-256
+func makeSegment(channel, seq uint64, size int) []byte {
+	rng := rand.New(rand.NewPCG(channel, seq))
+	data := make([]byte, size-sha256.Size)
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	sum := sha256.Sum256(data)
+	return append(data, sum[:]...)
+}
+
+// Trickles the segment out in chunks over the interval
+type pacedReader struct {
+	data     []byte
+	chunk    int
+	interval time.Duration
+	sent     int
+	finished time.Time // when the last byte was read
+}
+
+func (pr *pacedReader) Read(p []byte) (int, error) {
+	if len(pr.data) == 0 {
+		if pr.finished.IsZero() {
+			pr.finished = time.Now()
+		}
+		return 0, io.EOF
+	}
+	if pr.sent > 0 && pr.sent%pr.chunk == 0 {
+		time.Sleep(pr.interval)
+	}
+	n := min(len(p), len(pr.data), pr.chunk-pr.sent%pr.chunk)
+	copy(p, pr.data[:n])
+	pr.data = pr.data[n:]
+	pr.sent += n
+	return n, nil
+}
+
+func runPublisher(pub *trickle.TricklePublisher, channel uint64, cfg config, c *counters) {
+	defer pub.Close()
+	period := time.Duration(float64(time.Second) / cfg.rate)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	deadline := time.After(cfg.duration)
+	for seq := uint64(0); ; seq++ {
+		data := makeSegment(channel, seq, cfg.segmentSize)
+		// spread the chunks over most of the period
+		reader := &pacedReader{
+			data:     data,
+			chunk:    (len(data) + cfg.chunks - 1) / cfg.chunks,
+			interval: period * 8 / 10 / time.Duration(cfg.chunks),
+		}
+		if err := pub.Write(reader); err != nil {
+			slog.Error("Error publishing", "channel", channel, "seq", seq, "err", err)
+			c.publishErrors.Add(1)
+		} else {
+			c.published.Add(1)
+			c.publishedBytes.Add(int64(len(data)))
+			c.upload.Add(time.Since(reader.finished))
+		}
+		select {
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func runSubscriber(url string, cfg config, c *counters) {
+	sub := trickle.NewTrickleSubscriberWithConfig(url, trickle.TrickleSubscriberConfig{
+		HTTP2:        cfg.http2,
+		VerifyDigest: true,
+		OnLatency: func(l trickle.SegmentLatency) {
+			c.firstByte.Add(l.FirstByte)
+			c.glassToGlass.Add(l.GlassToGlass)
+		},
+	})
+	sub.SetSeq(0)
+	for {
+		resp, err := sub.Read()
+		if err != nil {
+			var sne *trickle.SequenceNonexistent
+			switch {
+			case errors.Is(err, trickle.EOS), errors.Is(err, trickle.StreamNotFoundErr):
+				c.eos.Add(1)
+				return
+			case errors.As(err, &sne):
+				c.nonexistent.Add(1)
+				sub.SetSeq(sne.Latest)
+				continue
+			}
+			slog.Error("Error subscribing", "url", url, "err", err)
+			c.readErrors.Add(1)
+			return
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var mismatch *trickle.ChecksumMismatchError
+		if errors.As(err, &mismatch) {
+			slog.Error("Digest mismatch", "url", url, "seq", mismatch.Seq, "expected", mismatch.Expected, "actual", mismatch.Actual)
+			c.checksumErrors.Add(1)
+			continue
+		}
+		if err != nil {
+			slog.Error("Error reading segment", "url", url, "seq", trickle.GetSeq(resp), "err", err)
+			c.readErrors.Add(1)
+			continue
+		}
+		c.read.Add(1)
+		c.readBytes.Add(int64(len(data)))
+		if len(data) < sha256.Size {
+			c.checksumErrors.Add(1)
+			continue
+		}
+		body, digest := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+		if sum := sha256.Sum256(body); !bytes.Equal(sum[:], digest) {
+			slog.Error("Checksum mismatch", "url", url, "seq", trickle.GetSeq(resp), "bytes", len(data))
+			c.checksumErrors.Add(1)
+		}
+	}
+}
+
+func sampleRuntime(done chan struct{}, maxGoroutines *atomic.Int64, maxHeap *atomic.Uint64) {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	var m runtime.MemStats
+	for {
+		maxGoroutines.Store(max(maxGoroutines.Load(), int64(runtime.NumGoroutine())))
+		runtime.ReadMemStats(&m)
+		maxHeap.Store(max(maxHeap.Load(), m.HeapAlloc))
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func printLatency(name string, s trickle.LatencySummary) {
+	fmt.Printf("  %-15s n=%-7d mean=%-12v p50=%-12v p90=%-12v p99=%v\n", name, s.Count,
+		s.Mean.Round(time.Microsecond), s.P50.Round(time.Microsecond), s.P90.Round(time.Microsecond), s.P99.Round(time.Microsecond))
+}
+
+func report(c *counters, cfg config, elapsed time.Duration, maxGoroutines int64, maxHeap uint64) {
+	mbps := func(bytes int64) float64 {
+		return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+	}
+	expectedReads := c.published.Load() * int64(cfg.subscribers)
+	fmt.Printf("\nLoad test results (%v)\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("  published       %d segments, %.1f Mbps, %d errors\n", c.published.Load(), mbps(c.publishedBytes.Load()), c.publishErrors.Load())
+	fmt.Printf("  read            %d of %d segments, %.1f Mbps, %d errors\n", c.read.Load(), expectedReads, mbps(c.readBytes.Load()), c.readErrors.Load())
+	fmt.Printf("  checksum        %d mismatches\n", c.checksumErrors.Load())
+	fmt.Printf("  470             %d\n", c.nonexistent.Load())
+	fmt.Printf("  end of stream   %d\n", c.eos.Load())
+	fmt.Println("Latency")
+	printLatency("first byte", c.firstByte.Summary())
+	printLatency("glass to glass", c.glassToGlass.Summary())
+	printLatency("upload", c.upload.Summary())
+	fmt.Println("Runtime")
+	fmt.Printf("  goroutines      %d max\n", maxGoroutines)
+	fmt.Printf("  heap            %.1f MB max\n", float64(maxHeap)/1e6)
+}
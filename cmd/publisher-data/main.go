@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"trickle"
+)
+
+// Publishes arbitrary data from stdin, eg logs or NDJSON,
+// cutting segments on time, size or delimiter boundaries
+
+func main() {
+	baseURL := flag.String("url", "http://localhost:2939", "Base URL for the stream")
+	streamName := flag.String("stream", "", "Output stream name (required)")
+	contentType := flag.String("content-type", "text/plain", "Content type of the stream")
+	maxDuration := flag.Duration("max-duration", 0, "Maximum segment duration, eg 1s")
+	maxBytes := flag.Int("max-bytes", 0, "Maximum segment size in bytes")
+	delimiter := flag.String("delimiter", "", `Only cut segments after this delimiter, eg "\n"`)
+	header := flag.String("header", "", "File with stream headers for late joiners, eg Ogg Opus header pages")
+	resume := flag.Bool("resume", false, "Continue from the stream's latest seq, eg after a restart")
+	flag.Parse()
+	if *streamName == "" {
+		log.Fatalf("Error: Output stream name is required. Use -stream flag.")
+	}
+
+	delim, err := parseEscapes(*delimiter)
+	if err != nil {
+		log.Fatalf("Error: invalid delimiter %q: %v", *delimiter, err)
+	}
+
+	pub, err := trickle.NewTricklePublisherWithConfig(*baseURL+"/"+*streamName, trickle.TricklePublisherConfig{
+		ContentType: *contentType,
+		Resume:      *resume,
+	})
+	if err != nil {
+		log.Fatalf("Error creating publisher: %v", err)
+	}
+	defer pub.Close()
+
+	if *header != "" {
+		data, err := os.ReadFile(*header)
+		if err != nil {
+			log.Fatalf("Error reading header: %v", err)
+		}
+		if err := pub.WriteInit(data); err != nil {
+			log.Fatalf("Error writing header: %v", err)
+		}
+	}
+
+	segmenter := &trickle.DataSegmenter{
+		MaxDuration: *maxDuration,
+		MaxBytes:    *maxBytes,
+		Delimiter:   delim,
+	}
+	slog.Info("Starting stream", "stream", *streamName)
+	if err := segmenter.Run(os.Stdin, pub); err != nil {
+		if errors.Is(err, trickle.StreamNotFoundErr) {
+			slog.Error("Trickle stream not found", "stream", *streamName)
+		} else {
+			slog.Error("Error publishing", "stream", *streamName, "err", err)
+		}
+		os.Exit(1)
+	}
+	slog.Info("Stopped stream", "stream", *streamName)
+}
+
+// Expands the \n, \r, \t, \0, \\ and \xHH escapes in a flag value.
+// Everything outside an escape, quotes included, is taken literally.
+func parseEscapes(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, errors.New("trailing backslash")
+		}
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case '0':
+			out = append(out, 0)
+		case '\\':
+			out = append(out, '\\')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, errors.New("short \\x escape")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("bad \\x escape: %w", err)
+			}
+			out = append(out, byte(b))
+			i += 2
+		default:
+			return nil, fmt.Errorf("unknown escape \\%c", s[i])
+		}
+	}
+	return out, nil
+}
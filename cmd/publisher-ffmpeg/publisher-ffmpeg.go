@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"flag"
-	"fmt"
 	"io"
 	"log"
 	"log/slog"
@@ -19,11 +18,13 @@ import (
 var (
 	baseURL    *string
 	streamName *string
+	cmaf       *bool
+	resume     *bool
 )
 
 type SegmentPoster struct {
 	tricklePublisher *trickle.TricklePublisher
-	ffmpegWriter     *os.File
+	pipeWriter       *os.File
 }
 
 func (sp *SegmentPoster) NewSegment(reader trickle.CloneableReader) {
@@ -33,7 +34,7 @@ func (sp *SegmentPoster) NewSegment(reader trickle.CloneableReader) {
 			slog.Error("Error writing trickle", "err", err)
 			if err == trickle.StreamNotFoundErr {
 				slog.Error("Trickle stream not found")
-				sp.ffmpegWriter.Close()
+				sp.pipeWriter.Close()
 			}
 			if err != nil {
 				io.Copy(io.Discard, reader)
@@ -42,8 +43,21 @@ func (sp *SegmentPoster) NewSegment(reader trickle.CloneableReader) {
 	}()
 }
 
+func (sp *SegmentPoster) NewInit(init []byte) {
+	if err := sp.tricklePublisher.WriteInit(init); err != nil {
+		slog.Error("Error writing init segment", "err", err)
+	}
+}
+
 func segmentPoster(streamName string) *SegmentPoster {
-	c, err := trickle.NewTricklePublisher(*baseURL + "/" + streamName)
+	contentType := "video/MP2T"
+	if *cmaf {
+		contentType = "video/mp4"
+	}
+	c, err := trickle.NewTricklePublisherWithConfig(*baseURL+"/"+streamName, trickle.TricklePublisherConfig{
+		ContentType: contentType,
+		Resume:      *resume,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -70,11 +84,17 @@ func runPublish(streamName string) {
 	go func() {
 		defer wg.Done()
 		sp := segmentPoster(streamName)
-		sp.ffmpegWriter = w
+		sp.pipeWriter = w
 		defer sp.tricklePublisher.Close()
-		(&trickle.MediaSegmenter{
-			ExtraFiles: []*os.File{r},
-		}).RunSegmentation(fmt.Sprintf("pipe:%d", r.Fd()), sp.NewSegment)
+		var err error
+		if *cmaf {
+			err = (&trickle.CMAFSegmenter{}).RunSegmentation(r, sp.NewInit, sp.NewSegment)
+		} else {
+			err = (&trickle.TSSegmenter{}).RunSegmentation(r, sp.NewSegment)
+		}
+		if err != nil {
+			slog.Error("Error segmenting", "stream", streamName, "err", err)
+		}
 		slog.Info("Completing publish", "stream", streamName)
 	}()
 
@@ -118,6 +138,8 @@ func main() {
 	// Check some command-line arguments
 	baseURL = flag.String("url", "http://localhost:2939", "Base URL for the stream")
 	streamName = flag.String("stream", "", "Output stream name (required)")
+	cmaf = flag.Bool("cmaf", false, "Input is fragmented MP4 rather than MPEG-TS")
+	resume = flag.Bool("resume", false, "Continue from the stream's latest seq, eg after a restart")
 	flag.Parse()
 	if *streamName == "" {
 		log.Fatalf("Error: Output stream name is required. Use -stream flag.")
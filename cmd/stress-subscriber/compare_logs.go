@@ -1,3 +1,10 @@
+//go:build ignore
+
+// Compares publisher and subscriber logs for publishers that do not stamp
+// segments with send times, eg python/stress-publisher.py. Go subscribers
+// measure latency directly, see TrickleSubscriberConfig.OnLatency.
+// Run with `go run compare_logs.go <subscriber log> <publisher log>`
+
 package main
 
 import (
@@ -50,7 +50,20 @@ func main() {
 func runSubscriber(idx int, baseURL, stream string) {
 	// Each subscriber reads from its own stream: e.g. stream_0, stream_1, …
 	url := fmt.Sprintf("%s/%s_%d", baseURL, stream, idx)
-	sub := trickle.NewTrickleSubscriber(url)
+	sub := trickle.NewTrickleSubscriberWithConfig(url, trickle.TrickleSubscriberConfig{
+		OnLatency: func(l trickle.SegmentLatency) {
+			slog.Info(fmt.Sprintf("%02d-%04d", idx, l.Seq), "first_byte", l.FirstByte, "glass_to_glass", l.GlassToGlass)
+		},
+	})
+	defer func() {
+		stats := sub.LatencyStats()
+		if stats.FirstByte.Count > 0 {
+			slog.Info("Latency", "url", url, "segments", stats.FirstByte.Count,
+				"first_byte_mean", stats.FirstByte.Mean, "first_byte_p99", stats.FirstByte.P99,
+				"glass_to_glass_mean", stats.GlassToGlass.Mean, "glass_to_glass_p50", stats.GlassToGlass.P50,
+				"glass_to_glass_p90", stats.GlassToGlass.P90, "glass_to_glass_p99", stats.GlassToGlass.P99)
+		}
+	}()
 
 	for {
 		resp, err := sub.Read()
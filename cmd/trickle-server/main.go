@@ -5,7 +5,9 @@ import (
 	"flag"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 	"trickle"
@@ -14,8 +16,19 @@ import (
 func main() {
 	p := flag.String("path", "/", "URL to publish streams to")
 	addr := flag.String("addr", ":2939", "Address to bind to")
+	h2c := flag.Bool("h2c", true, "Also accept cleartext HTTP/2 connections")
+	socket := flag.String("socket", "", "Also serve the framed socket protocol, eg unix:/tmp/trickle.sock or tcp::2940")
+	keepalive := flag.String("keepalive", "continue", "How to keep preconnected POSTs alive: continue, early-hints or none")
+	// close preconnects before the read timeout below drops them
+	maxIdle := flag.Duration("max-preconnect-idle", 30*time.Second, "Close preconnected POSTs with no data after this long; 0 for no limit")
 	flag.Parse()
 
+	switch trickle.KeepaliveMode(*keepalive) {
+	case trickle.KeepaliveContinue, trickle.KeepaliveEarlyHints, trickle.KeepaliveNone:
+	default:
+		log.Fatalf("Unknown keepalive mode %q", *keepalive)
+	}
+
 	srv := &http.Server{
 		// say max segment size is 20 secs
 		// we can allow 2 * 20 secs given preconnects
@@ -23,13 +36,33 @@ func main() {
 		ReadTimeout:  40 * time.Second,
 		WriteTimeout: 45 * time.Second,
 	}
+	if *h2c {
+		// lets clients multiplex preconnects over a single connection
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
 
 	trickleSrv := trickle.ConfigureServer(trickle.TrickleServerConfig{
-		BasePath:   EnsureSlash(*p),
-		Changefeed: true,
-		Autocreate: true,
+		BasePath:         EnsureSlash(*p),
+		Changefeed:       true,
+		Autocreate:       true,
+		WebSocket:        true,
+		MuxSubscribe:     true,
+		HLS:              true,
+		DASH:             true,
+		SubscriberEvents: true,
+
+		// this server owns the mux, so nothing else is taken over
+		HierarchicalNames: true,
+
+		Keepalive:         trickle.KeepaliveMode(*keepalive),
+		MaxPreconnectIdle: *maxIdle,
 	})
 	changefeedSubscribe(trickleSrv)
+	if *socket != "" {
+		serveSocket(trickleSrv, *socket)
+	}
 	log.Println("Server started at " + *addr)
 	stop := trickleSrv.Start()
 	err := srv.ListenAndServe()
@@ -60,6 +93,25 @@ func changefeedSubscribe(srv *trickle.Server) {
 	}()
 }
 
+func serveSocket(srv *trickle.Server, addr string) {
+	network, address, ok := strings.Cut(addr, ":")
+	if !ok {
+		log.Fatal("Socket address should be network:address, eg unix:/tmp/trickle.sock")
+	}
+	if network == "unix" {
+		// clean up after any previous run
+		os.Remove(address)
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal("Could not listen on socket ", err)
+	}
+	log.Println("Socket server started at " + addr)
+	go func() {
+		log.Fatal(srv.ServeSocket(l))
+	}()
+}
+
 func EnsureSlash(s string) string {
 	if !strings.HasPrefix(s, "/") {
 		s = "/" + s
@@ -0,0 +1,243 @@
+package trickle
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DASH gateway: exposes a CMAF channel as a live MPD.
+//
+// The SegmentTemplate $Number$ is the trickle seq. Completed segments in the
+// window are listed in a SegmentTimeline with times derived from when they
+// were written, relative to the first write on the channel. The in-progress
+// (or next) segment is listed with an estimated duration and made available
+// early so low latency players can pull it with chunked transfer.
+
+const dashTimescale = 1000 // milliseconds
+
+type dashMPD struct {
+	XMLName                    xml.Name   `xml:"MPD"`
+	Xmlns                      string     `xml:"xmlns,attr"`
+	Profiles                   string     `xml:"profiles,attr"`
+	Type                       string     `xml:"type,attr"`
+	AvailabilityStartTime      string     `xml:"availabilityStartTime,attr"`
+	PublishTime                string     `xml:"publishTime,attr"`
+	MinimumUpdatePeriod        string     `xml:"minimumUpdatePeriod,attr,omitempty"`
+	MinBufferTime              string     `xml:"minBufferTime,attr"`
+	TimeShiftBufferDepth       string     `xml:"timeShiftBufferDepth,attr"`
+	SuggestedPresentationDelay string     `xml:"suggestedPresentationDelay,attr,omitempty"`
+	MediaPresentationDuration  string     `xml:"mediaPresentationDuration,attr,omitempty"`
+	Period                     dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	ID            string            `xml:"id,attr"`
+	Start         string            `xml:"start,attr"`
+	AdaptationSet dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	ContentType      string             `xml:"contentType,attr"`
+	MimeType         string             `xml:"mimeType,attr"`
+	SegmentAlignment bool               `xml:"segmentAlignment,attr"`
+	Representation   dashRepresentation `xml:"Representation"`
+}
+
+type dashRepresentation struct {
+	ID              string              `xml:"id,attr"`
+	Bandwidth       int                 `xml:"bandwidth,attr"`
+	SegmentTemplate dashSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type dashSegmentTemplate struct {
+	Timescale                int               `xml:"timescale,attr"`
+	Initialization           string            `xml:"initialization,attr"`
+	Media                    string            `xml:"media,attr"`
+	StartNumber              int               `xml:"startNumber,attr"`
+	AvailabilityTimeOffset   string            `xml:"availabilityTimeOffset,attr,omitempty"`
+	AvailabilityTimeComplete string            `xml:"availabilityTimeComplete,attr,omitempty"`
+	Segments                 []dashTimelineSeg `xml:"SegmentTimeline>S"`
+}
+
+type dashTimelineSeg struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+}
+
+func (sm *Server) handleDASH(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	if !stream.isCMAF() {
+		http.Error(w, "DASH is only supported for CMAF channels", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	switch file := r.PathValue("file"); file {
+	case "manifest.mpd":
+		mpd, ok := stream.dashManifest()
+		if !ok {
+			http.Error(w, "No segments yet", http.StatusNotFound)
+			return
+		}
+		out, err := xml.MarshalIndent(mpd, "", "  ")
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dash+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte(xml.Header))
+		w.Write(out)
+	case "init.mp4":
+		init := stream.getInit()
+		if init == nil {
+			http.Error(w, "Init segment not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(init)))
+		w.Write(init)
+	default:
+		name, found := strings.CutSuffix(file, ".m4s")
+		idx, err := strconv.Atoi(name)
+		if !found || err != nil || idx < 0 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		stream.handleGet(w, r, idx)
+	}
+}
+
+func dashDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%.3fS", d.Seconds())
+}
+
+// Returns false if nothing has been written to the channel yet
+func (s *Stream) dashManifest() (*dashMPD, bool) {
+	infos, nextWrite, closed := s.segmentInfos()
+	s.mutex.RLock()
+	anchor := s.firstWrite
+	s.mutex.RUnlock()
+	if anchor.IsZero() {
+		return nil, false
+	}
+	target := s.targetDuration()
+	ms := func(t time.Time) int64 { return t.Sub(anchor).Milliseconds() }
+
+	var (
+		timeline   []dashTimelineSeg
+		start      = -1
+		lastEnd    int64
+		bandwidth  = 0
+		window     time.Duration
+		inProgress bool
+
+		// whether the last entry is a placeholder for a dropped segment
+		placeholder bool
+	)
+	add := func(idx int, t, d int64, estimated bool) {
+		if start < 0 {
+			start = idx
+		}
+		if n := len(timeline); n > 0 {
+			if prev := &timeline[n-1]; placeholder && t > prev.T {
+				// now we know when the placeholder ended
+				prev.D = t - prev.T
+				lastEnd = t
+			}
+			// entries may leave gaps but must not overlap or go backwards
+			t = max(t, lastEnd)
+		}
+		timeline = append(timeline, dashTimelineSeg{T: t, D: d})
+		lastEnd = t + d
+		placeholder = estimated
+	}
+	for _, info := range infos {
+		if info.idx >= nextWrite {
+			break
+		}
+		if !info.closed {
+			// in progress; estimate the duration
+			add(info.idx, ms(info.firstByte), target.Milliseconds(), false)
+			inProgress = true
+			break
+		}
+		if info.size <= 0 || info.aborted {
+			// dropped or incomplete segment, keep numbering contiguous
+			if start >= 0 && info.size > 0 {
+				add(info.idx, ms(info.firstByte), info.ended.Sub(info.firstByte).Milliseconds(), false)
+			} else if start >= 0 {
+				// nothing written, so sized once the next segment starts
+				add(info.idx, lastEnd, target.Milliseconds(), true)
+			}
+			continue
+		}
+		duration := info.ended.Sub(info.firstByte)
+		add(info.idx, ms(info.firstByte), duration.Milliseconds(), false)
+		window += duration
+		if duration > 0 {
+			bandwidth = max(bandwidth, int(float64(info.size*8)/duration.Seconds()))
+		}
+	}
+	// advertise the upcoming segment if nothing is in progress
+	if !closed && !inProgress {
+		add(nextWrite, lastEnd, target.Milliseconds(), false)
+	}
+
+	mimeType := s.mimeType
+	if !strings.HasSuffix(mimeType, "/mp4") {
+		mimeType = "video/mp4"
+	}
+	contentType, _, _ := strings.Cut(mimeType, "/")
+
+	mpd := &dashMPD{
+		Xmlns:                      "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                   "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                       "dynamic",
+		AvailabilityStartTime:      anchor.UTC().Format(time.RFC3339Nano),
+		PublishTime:                s.clock.Now().UTC().Format(time.RFC3339Nano),
+		MinimumUpdatePeriod:        dashDuration(target),
+		MinBufferTime:              dashDuration(target),
+		TimeShiftBufferDepth:       dashDuration(max(window, target)),
+		SuggestedPresentationDelay: dashDuration(2 * target),
+		Period: dashPeriod{
+			ID:    "0",
+			Start: "PT0S",
+			AdaptationSet: dashAdaptationSet{
+				ContentType:      contentType,
+				MimeType:         mimeType,
+				SegmentAlignment: true,
+				Representation: dashRepresentation{
+					ID:        "0",
+					Bandwidth: max(bandwidth, 1),
+					SegmentTemplate: dashSegmentTemplate{
+						Timescale:      dashTimescale,
+						Initialization: "init.mp4",
+						Media:          "$Number$.m4s",
+						StartNumber:    max(start, 0),
+						Segments:       timeline,
+					},
+				},
+			},
+		},
+	}
+	if closed {
+		mpd.Type = "static"
+		mpd.MinimumUpdatePeriod = ""
+		mpd.MediaPresentationDuration = dashDuration(time.Duration(lastEnd) * time.Millisecond)
+	} else {
+		// segments can be fetched as soon as they start
+		tmpl := &mpd.Period.AdaptationSet.Representation.SegmentTemplate
+		tmpl.AvailabilityTimeOffset = fmt.Sprintf("%.3f", target.Seconds())
+		tmpl.AvailabilityTimeComplete = "false"
+	}
+	return mpd, true
+}
@@ -0,0 +1,151 @@
+package trickle
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Real timers with a Now that only moves when told to
+type stepClock struct {
+	Clock
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *stepClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDASH_Manifest(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, DASH: true}, false)
+	pub, err := NewTricklePublisherWithConfig(ts.URL+"/cmaf", TricklePublisherConfig{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := httpGet(t, ts.URL+"/cmaf/dash/manifest.mpd"); status != http.StatusNotFound {
+		t.Errorf("expected not found before any segments, got %d", status)
+	}
+
+	init := testInit(true)
+	if err := pub.WriteInit(init); err != nil {
+		t.Fatal(err)
+	}
+	fragment := testFragment(testVideoTrack, 0, true)
+	for i := 0; i < 2; i++ {
+		pr, pw := io.Pipe()
+		go func() {
+			// the first chunk may take a moment longer to reach the
+			// server than the rest, so leave headroom over 50ms
+			pw.Write(fragment[:100])
+			time.Sleep(60 * time.Millisecond)
+			pw.Write(fragment[100:])
+			pw.Close()
+		}()
+		if err := pub.Write(pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, body := httpGet(t, ts.URL+"/cmaf/dash/manifest.mpd")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	var mpd dashMPD
+	if err := xml.Unmarshal([]byte(body), &mpd); err != nil {
+		t.Fatal(err)
+	}
+	if mpd.Type != "dynamic" {
+		t.Errorf("unexpected type %s", mpd.Type)
+	}
+	tmpl := mpd.Period.AdaptationSet.Representation.SegmentTemplate
+	if tmpl.StartNumber != 0 || tmpl.Media != "$Number$.m4s" || tmpl.Initialization != "init.mp4" {
+		t.Errorf("unexpected segment template %+v", tmpl)
+	}
+	// two completed segments and the upcoming one
+	if len(tmpl.Segments) != 3 {
+		t.Fatalf("expected 3 timeline entries, got %d:\n%s", len(tmpl.Segments), body)
+	}
+	for i, s := range tmpl.Segments[:2] {
+		if s.D < 50 || s.D > 1000 {
+			t.Errorf("segment %d has unexpected duration %d", i, s.D)
+		}
+	}
+	if tmpl.Segments[1].T < tmpl.Segments[0].T+tmpl.Segments[0].D {
+		t.Errorf("timeline entries overlap: %+v", tmpl.Segments)
+	}
+
+	if _, body := httpGet(t, ts.URL+"/cmaf/dash/init.mp4"); body != string(init) {
+		t.Error("unexpected init segment")
+	}
+	if _, body := httpGet(t, ts.URL+"/cmaf/dash/1.m4s"); body != string(fragment) {
+		t.Error("unexpected media segment")
+	}
+
+	// TS channels are not supported
+	tsPub, err := NewTricklePublisher(ts.URL + "/ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tsPub.Write(bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := httpGet(t, ts.URL+"/ts/dash/manifest.mpd"); status != http.StatusNotFound {
+		t.Errorf("expected not found for TS, got %d", status)
+	}
+}
+
+func TestDASH_DroppedSegments(t *testing.T) {
+	clock := &stepClock{Clock: SystemClock, now: time.Now()}
+	srv := ConfigureServer(TrickleServerConfig{Mux: http.NewServeMux(), Clock: clock})
+	NewLocalPublisher(srv, "gaps", "video/mp4").CreateChannel()
+	stream, _ := srv.getStream("gaps")
+	write := func(idx int, d time.Duration) {
+		segment, _ := stream.getForWrite(idx)
+		if d > 0 {
+			stream.startWrite(segment)
+			segment.writeData([]byte("data"))
+			clock.Advance(d)
+		}
+		segment.close()
+	}
+
+	// 1 is dropped and 2 starts well within the target duration of 1s
+	write(0, time.Second)
+	write(1, 0)
+	clock.Advance(300 * time.Millisecond)
+	write(2, time.Second)
+
+	mpd, ok := stream.dashManifest()
+	if !ok {
+		t.Fatal("expected a manifest")
+	}
+	segments := mpd.Period.AdaptationSet.Representation.SegmentTemplate.Segments
+	if len(segments) != 4 {
+		t.Fatalf("expected 4 timeline entries, got %+v", segments)
+	}
+	for i := 1; i < len(segments); i++ {
+		if segments[i].T < segments[i-1].T+segments[i-1].D {
+			t.Errorf("timeline entries overlap: %+v", segments)
+		}
+	}
+	// the placeholder fills the time until the next segment started
+	if segments[1].T != 1000 || segments[1].D != 300 || segments[2].T != 1300 {
+		t.Errorf("unexpected timeline %+v", segments)
+	}
+}
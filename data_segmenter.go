@@ -0,0 +1,221 @@
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// SegmentWriter publishes a single segment per call.
+// Implemented by the publishers, eg TricklePublisher and TrickleLocalPublisher.
+type SegmentWriter interface {
+	Write(data io.Reader) error
+}
+
+// DataSegmenter cuts an arbitrary byte stream (logs, NDJSON, raw audio)
+// into segments and publishes each one as it is being read.
+//
+// Without a Delimiter or Split function, the input is cut anywhere.
+// Otherwise input is broken into tokens which are kept whole within
+// a segment. If neither MaxDuration nor MaxBytes is set, each token
+// becomes its own segment.
+type DataSegmenter struct {
+	// Close the current segment this long after its first byte (default 0: no limit)
+	MaxDuration time.Duration
+
+	// Close the current segment once it reaches this size (default 0: no limit)
+	MaxBytes int
+
+	// Only cut segments after this delimiter, eg "\n" for line-based data.
+	// The delimiter is kept at the end of each token.
+	Delimiter []byte
+
+	// Custom split function; takes precedence over Delimiter.
+	// Tokens are published exactly as returned.
+	Split bufio.SplitFunc
+
+	// Source of time for MaxDuration,
+	// eg a fake clock in tests (default SystemClock)
+	Clock Clock
+}
+
+var errNoSegmentBoundaries = errors.New("no segment boundaries configured")
+
+// A segment that is currently being published
+type dataSegment struct {
+	writer *io.PipeWriter
+	size   int
+	done   chan error
+	failed bool
+}
+
+func startDataSegment(pub SegmentWriter) *dataSegment {
+	pr, pw := io.Pipe()
+	seg := &dataSegment{
+		writer: pw,
+		done:   make(chan error, 1),
+	}
+	go func() {
+		err := pub.Write(pr)
+		// unblock our writes if the publisher bailed early
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			pr.CloseWithError(io.ErrClosedPipe)
+		}
+		seg.done <- err
+	}()
+	return seg
+}
+
+func (seg *dataSegment) write(data []byte) {
+	seg.size += len(data)
+	if seg.failed {
+		return
+	}
+	if _, err := seg.writer.Write(data); err != nil {
+		// drop the rest of this segment; the error comes back in finish()
+		seg.failed = true
+	}
+}
+
+func (seg *dataSegment) finish() error {
+	seg.writer.Close()
+	return <-seg.done
+}
+
+func delimiterSplit(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			n := i + len(delim)
+			return n, data[:n], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// Sends tokens (or raw chunks if there is no split function) to the channel
+func readDataUnits(in io.Reader, split bufio.SplitFunc, units chan<- []byte) error {
+	if split == nil {
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := in.Read(buf)
+			if n > 0 {
+				units <- buf[:n]
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 32*1024), 16*1024*1024)
+	scanner.Split(split)
+	for scanner.Scan() {
+		// the scanner reuses its buffer so copy the token out
+		units <- bytes.Clone(scanner.Bytes())
+	}
+	return scanner.Err()
+}
+
+// Run reads from `in` until EOF, publishing segments through `pub`.
+// Returns early if the channel goes away.
+func (ds *DataSegmenter) Run(in io.Reader, pub SegmentWriter) error {
+	split := ds.Split
+	if split == nil && len(ds.Delimiter) > 0 {
+		split = delimiterSplit(ds.Delimiter)
+	}
+	hasLimits := ds.MaxBytes > 0 || ds.MaxDuration > 0
+	if split == nil && !hasLimits {
+		return errNoSegmentBoundaries
+	}
+
+	clock := clockOrDefault(ds.Clock)
+	units := make(chan []byte, 16)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readDataUnits(in, split, units)
+		close(units)
+	}()
+	defer func() {
+		// don't leave the reader stuck if we return early
+		go func() {
+			for range units {
+			}
+		}()
+	}()
+
+	var (
+		seg    *dataSegment
+		timer  Timer
+		timerC <-chan struct{}
+	)
+	finish := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer, timerC = nil, nil
+		}
+		if seg == nil {
+			return nil
+		}
+		err := seg.finish()
+		size := seg.size
+		seg = nil
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, StreamNotFoundErr) || errors.Is(err, EOS) {
+			return err
+		}
+		slog.Error("Error publishing segment", "bytes", size, "err", err)
+		return nil
+	}
+	for {
+		select {
+		case unit, ok := <-units:
+			if !ok {
+				if err := finish(); err != nil {
+					return err
+				}
+				return <-readErr
+			}
+			for len(unit) > 0 {
+				if seg == nil {
+					seg = startDataSegment(pub)
+					if ds.MaxDuration > 0 {
+						// a fresh channel per segment, so a timer that
+						// fires while being stopped can't cut the next one
+						expired := make(chan struct{}, 1)
+						timer = clock.AfterFunc(ds.MaxDuration, func() { expired <- struct{}{} })
+						timerC = expired
+					}
+				}
+				chunk := unit
+				if split == nil && ds.MaxBytes > 0 && seg.size+len(chunk) > ds.MaxBytes {
+					// raw data can be cut exactly at the limit
+					chunk = unit[:ds.MaxBytes-seg.size]
+				}
+				seg.write(chunk)
+				unit = unit[len(chunk):]
+				if !hasLimits || (ds.MaxBytes > 0 && seg.size >= ds.MaxBytes) {
+					if err := finish(); err != nil {
+						return err
+					}
+				}
+			}
+		case <-timerC:
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+	}
+}
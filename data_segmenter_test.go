@@ -0,0 +1,173 @@
+package trickle
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects published segments in memory
+type segmentCollector struct {
+	mu       sync.Mutex
+	segments [][]byte
+	err      error
+}
+
+func (c *segmentCollector) Write(data io.Reader) error {
+	buf, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.segments = append(c.segments, buf)
+	return c.err
+}
+
+func (c *segmentCollector) strings() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []string
+	for _, s := range c.segments {
+		out = append(out, string(s))
+	}
+	return out
+}
+
+func checkDataSegments(t *testing.T, got []string, expected ...string) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d segments %q, got %d %q", len(expected), expected, len(got), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("segment %d: expected %q, got %q", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestDataSegmenter_Delimiter(t *testing.T) {
+	c := &segmentCollector{}
+	ds := &DataSegmenter{Delimiter: []byte("\n")}
+	if err := ds.Run(strings.NewReader("one\ntwo\nthree"), c); err != nil {
+		t.Fatal(err)
+	}
+	checkDataSegments(t, c.strings(), "one\n", "two\n", "three")
+}
+
+func TestDataSegmenter_MaxBytes(t *testing.T) {
+	// raw data is cut exactly at the limit
+	c := &segmentCollector{}
+	ds := &DataSegmenter{MaxBytes: 4}
+	if err := ds.Run(strings.NewReader("abcdefghij"), c); err != nil {
+		t.Fatal(err)
+	}
+	checkDataSegments(t, c.strings(), "abcd", "efgh", "ij")
+
+	// delimited data keeps tokens whole, so segments may run over
+	c = &segmentCollector{}
+	ds = &DataSegmenter{MaxBytes: 6, Delimiter: []byte("\n")}
+	if err := ds.Run(strings.NewReader("a\nb\nc\nlonger line\nd\n"), c); err != nil {
+		t.Fatal(err)
+	}
+	checkDataSegments(t, c.strings(), "a\nb\nc\n", "longer line\n", "d\n")
+}
+
+// Hands MaxDuration timers to the test instead of running them
+type manualClock struct {
+	Clock
+	timers chan func()
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.timers <- f
+	return manualTimer{}
+}
+
+type manualTimer struct{}
+
+func (manualTimer) Stop() bool { return true }
+
+// Passes along each read of a segment as well as the whole segment
+type segmentWatcher struct {
+	reads    chan string
+	segments chan string
+}
+
+func (w *segmentWatcher) Write(data io.Reader) error {
+	var segment []byte
+	buf := make([]byte, 1024)
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			w.reads <- string(buf[:n])
+			segment = append(segment, buf[:n]...)
+		}
+		if err == io.EOF {
+			w.segments <- string(segment)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func TestDataSegmenter_MaxDuration(t *testing.T) {
+	clock := &manualClock{Clock: SystemClock, timers: make(chan func())}
+	w := &segmentWatcher{reads: make(chan string, 16), segments: make(chan string, 16)}
+	ds := &DataSegmenter{MaxDuration: time.Hour, Delimiter: []byte("\n"), Clock: clock}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- ds.Run(pr, w) }()
+	expectRead := func(expected string) {
+		t.Helper()
+		if got := <-w.reads; got != expected {
+			t.Fatalf("expected read %q, got %q", expected, got)
+		}
+	}
+
+	go pw.Write([]byte("a\nb\n"))
+	expire := <-clock.timers
+	expectRead("a\n")
+	expectRead("b\n")
+	// nothing but the timer ends the segment
+	expire()
+	if got := <-w.segments; got != "a\nb\n" {
+		t.Errorf("expected first segment %q, got %q", "a\nb\n", got)
+	}
+
+	go func() {
+		pw.Write([]byte("c\n"))
+		pw.Close()
+	}()
+	<-clock.timers
+	expectRead("c\n")
+	if got := <-w.segments; got != "c\n" {
+		t.Errorf("expected second segment %q, got %q", "c\n", got)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataSegmenter_Errors(t *testing.T) {
+	ds := &DataSegmenter{}
+	if err := ds.Run(strings.NewReader("data"), &segmentCollector{}); !errors.Is(err, errNoSegmentBoundaries) {
+		t.Errorf("expected missing boundaries error, got %v", err)
+	}
+
+	// stop once the channel goes away
+	c := &segmentCollector{err: StreamNotFoundErr}
+	ds = &DataSegmenter{MaxBytes: 2}
+	if err := ds.Run(bytes.NewReader([]byte("abcdef")), c); !errors.Is(err, StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+	if len(c.strings()) != 1 {
+		t.Errorf("expected publishing to stop after the first segment, got %d", len(c.strings()))
+	}
+}
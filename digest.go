@@ -0,0 +1,71 @@
+package trickle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+// Segment integrity: the server keeps a running SHA-256 of each segment
+// and sends it to subscribers as an Lp-Trickle-Digest trailer once the
+// segment is complete. Publishers may send the same trailer with the
+// digest of what they wrote, which the server checks on completion.
+//
+// Digests cover the segment data only, not any prepended init segment.
+
+const digestAlgorithm = "sha-256"
+
+// ChecksumMismatchError is returned when a segment does not match its digest
+type ChecksumMismatchError struct {
+	Seq      int
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("checksum mismatch for segment %d: expected %s got %s", e.Seq, e.Expected, e.Actual)
+}
+
+func newDigest() hash.Hash {
+	return sha256.New()
+}
+
+// Formatted as algorithm=hex, eg sha-256=e3b0c442...
+func formatDigest(h hash.Hash) string {
+	return digestAlgorithm + "=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Wraps a subscriber response body to check it against the digest
+// trailer once it is read to EOF. Skips any prepended init segment.
+type digestReader struct {
+	body io.ReadCloser
+	resp *http.Response
+	hash hash.Hash
+	skip int
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.body.Read(p)
+	data := p[:n]
+	if dr.skip > 0 {
+		skipped := min(dr.skip, len(data))
+		data = data[skipped:]
+		dr.skip -= skipped
+	}
+	dr.hash.Write(data)
+	if err == io.EOF {
+		// trailers are only available after EOF
+		expected := dr.resp.Trailer.Get("Lp-Trickle-Digest")
+		if actual := formatDigest(dr.hash); expected != "" && expected != actual {
+			return n, &ChecksumMismatchError{Seq: GetSeq(dr.resp), Expected: expected, Actual: actual}
+		}
+	}
+	return n, err
+}
+
+func (dr *digestReader) Close() error {
+	return dr.body.Close()
+}
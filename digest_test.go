@@ -0,0 +1,121 @@
+package trickle
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestDigest_Verified(t *testing.T) {
+	for _, h2c := range []bool{false, true} {
+		ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, h2c)
+		pub, err := NewTricklePublisherWithConfig(ts.URL+"/digest", TricklePublisherConfig{Digest: true, HTTP2: h2c})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Create(); err != nil {
+			t.Fatal(err)
+		}
+		init := []byte("init segment")
+		if err := pub.WriteInit(init); err != nil {
+			t.Fatal(err)
+		}
+		if err := pub.Write(bytes.NewReader([]byte("segment data"))); err != nil {
+			t.Fatalf("h2c=%v: %v", h2c, err)
+		}
+
+		// the prepended init segment is not part of the digest
+		sub := NewTrickleSubscriberWithConfig(ts.URL+"/digest", TrickleSubscriberConfig{
+			HTTP2:        h2c,
+			PrependInit:  true,
+			VerifyDigest: true,
+		})
+		sub.SetSeq(0)
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("h2c=%v: %v", h2c, err)
+		}
+		if string(data) != "init segmentsegment data" {
+			t.Errorf("unexpected data %q", data)
+		}
+		digest := resp.Trailer.Get("Lp-Trickle-Digest")
+		if digest != "sha-256=b7231ed9a2f7c90acc4826a4a3ec0bb7a740622308f3cec972ded4224a7fccf3" {
+			t.Errorf("unexpected digest trailer %q", digest)
+		}
+
+		info, err := sub.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Segments) != 1 || info.Segments[0].Digest != digest {
+			t.Errorf("unexpected info %+v, expected digest %s", info.Segments, digest)
+		}
+	}
+}
+
+func TestDigest_PublisherMismatch(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// hide the length so the body is chunked and can carry trailers
+	body := io.MultiReader(bytes.NewReader([]byte("corrupted")))
+	req, err := http.NewRequest("POST", ts.URL+"/digest/0", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := formatDigest(newDigest())
+	req.Trailer = http.Header{"Lp-Trickle-Digest": {expected}}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity || resp.Header.Get("Lp-Trickle-Digest") == "" {
+		t.Fatalf("expected digest mismatch, got %d", resp.StatusCode)
+	}
+
+	// verifying subscribers reject the segment
+	sub := NewTrickleSubscriberWithConfig(ts.URL+"/digest", TrickleSubscriberConfig{VerifyDigest: true})
+	sub.SetSeq(0)
+	segment, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(segment.Body)
+	segment.Body.Close()
+	var mismatch *ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected checksum mismatch, got %v", err)
+	}
+	if mismatch.Seq != 0 || mismatch.Expected != expected || string(data) != "corrupted" {
+		t.Errorf("unexpected mismatch %+v data %q", mismatch, data)
+	}
+
+	// others see it as aborted rather than complete
+	plain := NewTrickleSubscriber(ts.URL + "/digest")
+	plain.SetSeq(0)
+	segment, err = plain.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(segment.Body); !errors.Is(err, ErrSegmentAborted) || string(data) != "corrupted" {
+		t.Errorf("expected aborted segment, got %q %v", data, err)
+	}
+	segment.Body.Close()
+	if info, err := plain.Info(); err != nil || !info.Segments[0].Aborted {
+		t.Errorf("unexpected info %+v %v", info, err)
+	}
+}
@@ -0,0 +1,101 @@
+package trickle_test
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"trickle"
+	"trickle/trickletest"
+)
+
+// Reads the next segment and returns its epoch and discontinuity flag
+func readEpoch(t *testing.T, sub *trickle.TrickleSubscriber) (int, int, bool) {
+	t.Helper()
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return trickle.GetSeq(resp), trickle.GetEpoch(resp), trickle.IsDiscontinuity(resp)
+}
+
+func TestEpoch(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "epochs")
+	sub := ts.Subscriber("epochs", 0)
+	trickletest.Publish(t, pub, "a0", "a1")
+	for i := 0; i < 2; i++ {
+		if seq, epoch, disc := readEpoch(t, sub); seq != i || epoch != 0 || disc {
+			t.Errorf("unexpected segment %d epoch %d discontinuity %v", seq, epoch, disc)
+		}
+	}
+
+	epoch, err := pub.NewEpoch()
+	if err != nil || epoch != 1 {
+		t.Fatalf("unexpected epoch %d %v", epoch, err)
+	}
+	trickletest.Publish(t, pub, "b0", "b1")
+	// only the first segment of the epoch is flagged
+	for i, want := range []bool{true, false} {
+		if seq, epoch, disc := readEpoch(t, sub); seq != i+2 || epoch != 1 || disc != want {
+			t.Errorf("unexpected segment %d epoch %d discontinuity %v", seq, epoch, disc)
+		}
+	}
+
+	info := ts.Info(t, "epochs")
+	if info.Epoch != 1 || len(info.Segments) != 4 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	for i, seg := range info.Segments {
+		if seg.Epoch != i/2 || seg.Discontinuity != (i == 2) {
+			t.Errorf("unexpected segment info %+v", seg)
+		}
+	}
+
+	// subscribers that skip the first segment of an epoch are still told
+	late := ts.Subscriber("epochs", 1)
+	readEpoch(t, late)
+	late.SetSeq(3)
+	if seq, epoch, disc := readEpoch(t, late); seq != 3 || epoch != 1 || !disc {
+		t.Errorf("unexpected segment %d epoch %d discontinuity %v", seq, epoch, disc)
+	}
+}
+
+func TestEpoch_Restart(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, HLS: true})
+	first := ts.Publisher(t, "restart")
+	trickletest.Publish(t, first, "old 0", "old 1")
+
+	// restart with new encoder settings
+	restarted := ts.PublisherWithConfig(t, "restart", trickle.TricklePublisherConfig{Resume: true, NewEpoch: true})
+	trickletest.Publish(t, restarted, "new 2")
+	sub := ts.Subscriber("restart", -2)
+	if seq, epoch, disc := readEpoch(t, sub); seq != 2 || epoch != 1 || !disc {
+		t.Errorf("unexpected segment %d epoch %d discontinuity %v", seq, epoch, disc)
+	}
+
+	// local subscribers get the same metadata
+	local := trickle.NewLocalSubscriber(ts.Trickle, "restart")
+	local.SetSeq(2)
+	data, err := local.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Metadata["Lp-Trickle-Epoch"] != "1" || data.Metadata["Lp-Trickle-Discontinuity"] != "true" {
+		t.Errorf("unexpected metadata %v", data.Metadata)
+	}
+
+	// and HLS players see a discontinuity
+	resp, err := http.Get(ts.ChannelURL("restart") + "/hls/index.m3u8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	playlist, _ := io.ReadAll(resp.Body)
+	want := "\n1.ts\n#EXT-X-DISCONTINUITY\n"
+	if !strings.Contains(string(playlist), want) {
+		t.Errorf("playlist is missing %q:\n%s", want, playlist)
+	}
+}
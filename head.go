@@ -0,0 +1,81 @@
+package trickle
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// HEAD probes: report the live edge and the state of a segment without
+// waiting for data or pre-creating segments, eg for health checks and
+// schedulers. The status mirrors what a GET would return.
+// HEAD {channel}/{idx} is served from the GET route.
+
+// Describes the current segment, same as HEAD {channel}/-2
+func (sm *Server) handleHeadChannel(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	stream.handleHead(w, -2)
+}
+
+func (s *Stream) handleHead(w http.ResponseWriter, idx int) {
+	segment, idx, latestSeq, pending, closed := s.peek(idx)
+	w.Header().Set("Lp-Trickle-Seq", strconv.Itoa(idx))
+	w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
+	w.Header().Set("Lp-Trickle-Subscribers", strconv.Itoa(s.presence.count()))
+	w.Header().Set("Content-Type", s.mimeType)
+	if segment == nil {
+		if closed {
+			w.Header().Set("Lp-Trickle-Closed", "terminated")
+		} else if pending {
+			// a GET would wait for the publisher
+			w.Header().Set("Lp-Trickle-Bytes", "0")
+		} else {
+			w.WriteHeader(470)
+		}
+		return
+	}
+
+	info := segment.info()
+	w.Header().Set("Lp-Trickle-Bytes", strconv.Itoa(info.size))
+	if !info.firstByte.IsZero() {
+		w.Header().Set("Lp-Trickle-Created", formatTrickleTime(info.firstByte))
+		w.Header().Set("Lp-Trickle-Epoch", strconv.Itoa(info.epoch))
+		if info.discontinuity {
+			w.Header().Set("Lp-Trickle-Discontinuity", "true")
+		}
+	}
+	if info.closed {
+		if info.size > 0 {
+			w.Header().Set("Lp-Trickle-Last-Byte", formatTrickleTime(info.lastByte))
+		}
+		if info.aborted {
+			w.Header().Set("Lp-Trickle-Aborted", "true")
+		} else {
+			w.Header().Set("Lp-Trickle-Complete", "true")
+		}
+		if info.digest != "" {
+			w.Header().Set("Lp-Trickle-Digest", info.digest)
+		}
+	}
+	if closed && info.size <= 0 {
+		w.Header().Set("Lp-Trickle-Closed", "terminated")
+	}
+}
+
+// Like getForRead but never pre-creates segments. Returns the segment
+// if it exists, the resolved idx, the next write, whether a GET would
+// wait for the segment to be written, and whether the stream is closed.
+func (s *Stream) peek(idx int) (*Segment, int, int, bool, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	idx = s.resolveIdx(idx)
+	pending := (idx == s.nextWrite || (s.nextWrite == 0 && idx == 1)) && !s.closed
+	segment := s.segments[idx%maxSegmentsPerStream]
+	if segment == nil || segment.idx != idx {
+		segment = nil
+	}
+	return segment, idx, s.nextWrite, pending, s.closed
+}
@@ -0,0 +1,104 @@
+package trickle_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestHead_Segments(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "probe")
+	sub := ts.Subscriber("probe", 0)
+
+	// the next write is pending, and probing it does not wait
+	probe, err := sub.Probe(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Seq != 0 || probe.Latest != 0 || !probe.Pending || probe.Bytes != 0 {
+		t.Errorf("unexpected probe %+v", probe)
+	}
+
+	const segments = 7
+	for i := 0; i < segments; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+	probe, err = sub.Probe(segments - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Seq != segments-1 || probe.Latest != segments || !probe.Complete || probe.Pending ||
+		probe.Bytes != len("seg 6") || probe.ContentType == "" {
+		t.Errorf("unexpected probe %+v", probe)
+	}
+
+	// -2 is the most recent segment, same as probing the channel
+	if probe, err := sub.Probe(-2); err != nil || probe.Seq != segments-1 || !probe.Complete {
+		t.Errorf("unexpected probe %+v %v", probe, err)
+	}
+	resp, err := http.Head(ts.ChannelURL("probe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || trickle.GetSeq(resp) != segments-1 || trickle.GetLatest(resp) != segments {
+		t.Errorf("unexpected channel probe %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// outside the window is a 470, same as a GET
+	for _, seq := range []int{0, segments + 3} {
+		_, err := sub.Probe(seq)
+		var nonexistent *trickle.SequenceNonexistent
+		if !errors.As(err, &nonexistent) || nonexistent.Seq != seq || nonexistent.Latest != segments {
+			t.Errorf("expected 470 for %d, got %v", seq, err)
+		}
+	}
+	if _, err := ts.Subscriber("missing", 0).Probe(0); !errors.Is(err, trickle.StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+}
+
+func TestHead_NoPrecreate(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "passive")
+	trickletest.Publish(t, pub, "zero")
+
+	// probes do not create segments or count as subscribers
+	sub := ts.Subscriber("passive", 0)
+	for i := 0; i < 3; i++ {
+		probe, err := sub.Probe(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if probe.Seq != 1 || !probe.Pending || probe.Subscribers != 0 {
+			t.Errorf("unexpected probe %+v", probe)
+		}
+	}
+	if info := ts.Info(t, "passive"); len(info.Segments) != 1 || info.Subscribers != 0 || info.Latest != 1 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestHead_ClosedChannel(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{})
+	local := trickle.NewLocalPublisher(ts.Trickle, "ending", "")
+	local.CreateChannel()
+	pub, err := trickle.NewTricklePublisher(ts.ChannelURL("ending"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := ts.Subscriber("ending", 0)
+	trickletest.Publish(t, pub, "zero")
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// closed channels are removed, so probes see them as gone
+	if _, err := sub.Probe(-1); !errors.Is(err, trickle.StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+}
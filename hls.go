@@ -0,0 +1,465 @@
+package trickle
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HLS gateway: exposes a TS or CMAF channel as a live HLS playlist.
+//
+// Completed segments in the window become playlist entries. For low
+// latency, segments are also cut into partial segments as they are
+// written, which are listed for the segment in progress and recent ones,
+// with a preload hint for the next part. Players can use blocking playlist
+// reloads to hear about the next segment or part as soon as it is ready.
+// Durations and program date times come from write times, so this assumes
+// segments are published in real time.
+
+const (
+	hlsDefaultTarget = 2 // seconds, if no segments have completed yet
+	hlsMaxBlock      = 3 // target durations to block a playlist reload for
+	hlsPartWindow    = 3 // target durations from the live edge to list parts for
+)
+
+func (sm *Server) handleHLS(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	// let browser players on other origins in
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	file := r.PathValue("file")
+	if file == "index.m3u8" {
+		stream.handlePlaylist(w, r)
+		return
+	}
+	if file == stream.hlsInitFile() {
+		init := stream.getInit()
+		if init == nil {
+			http.Error(w, "Init segment not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", stream.mimeType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(init)))
+		w.Write(init)
+		return
+	}
+	name, found := strings.CutSuffix(file, stream.hlsExtension())
+	name, partName, isPart := strings.Cut(name, ".")
+	idx, err := strconv.Atoi(name)
+	if !found || err != nil || idx < 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !isPart {
+		stream.handleGet(w, r, idx)
+		return
+	}
+	part, err := strconv.Atoi(partName)
+	if err != nil || part < 0 || !stream.hasHLSParts() {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	stream.handlePart(w, r, idx, part)
+}
+
+// Serves a part of a segment. Parts that are not cut yet are waited for
+// a while, since players request the preload hint ahead of time.
+func (s *Stream) handlePart(w http.ResponseWriter, r *http.Request, idx, part int) {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer s.clock.AfterFunc(hlsMaxBlock*s.config.HLSPartTarget, cancel).Stop()
+	for {
+		changed := s.changes()
+		segment, _, _, pending, _ := s.peek(idx)
+		if segment != nil {
+			data, ok := segment.readPart(ctx, part)
+			if !ok {
+				http.Error(w, "Part not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", s.mimeType)
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return
+		}
+		if !pending {
+			http.Error(w, "Part not found", http.StatusNotFound)
+			return
+		}
+		// wait for the segment to start without pre-creating it
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			http.Error(w, "Part not found", http.StatusNotFound)
+			return
+		}
+	}
+}
+
+// Based on the content type alone since other formats may have headers too
+func (s *Stream) isCMAF() bool {
+	return strings.HasSuffix(s.mimeType, "/mp4")
+}
+
+func (s *Stream) hlsExtension() string {
+	if s.isCMAF() {
+		return ".m4s"
+	}
+	return ".ts"
+}
+
+// Init segment for CMAF, or the cached PAT / PMT for TS
+func (s *Stream) hlsInitFile() string {
+	if s.isCMAF() {
+		return "init.mp4"
+	}
+	return "init.ts"
+}
+
+func (s *Stream) handlePlaylist(w http.ResponseWriter, r *http.Request) {
+	// Blocking playlist reload: wait until the requested segment is done,
+	// or with _HLS_part until that part of it is
+	msn, partParam := r.URL.Query().Get("_HLS_msn"), r.URL.Query().Get("_HLS_part")
+	if msn == "" && partParam != "" {
+		http.Error(w, "_HLS_part without _HLS_msn", http.StatusBadRequest)
+		return
+	}
+	if msn != "" {
+		idx, err := strconv.Atoi(msn)
+		if err != nil || idx < 0 {
+			http.Error(w, "Invalid _HLS_msn", http.StatusBadRequest)
+			return
+		}
+		part := -1
+		if partParam != "" {
+			if part, err = strconv.Atoi(partParam); err != nil || part < 0 {
+				http.Error(w, "Invalid _HLS_part", http.StatusBadRequest)
+				return
+			}
+		}
+		_, nextWrite, _ := s.segmentInfos()
+		if idx > nextWrite+1 {
+			// too far ahead per the spec
+			http.Error(w, "_HLS_msn too far ahead", http.StatusBadRequest)
+			return
+		}
+		s.waitForSegment(r.Context(), idx, part, hlsMaxBlock*s.targetDuration())
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(s.hlsPlaylist()))
+}
+
+// Longest completed segment in the window, rounded up
+func (s *Stream) targetDuration() time.Duration {
+	infos, _, _ := s.segmentInfos()
+	target := 0.0
+	for _, info := range infos {
+		if info.closed && info.size > 0 && !info.aborted {
+			target = math.Max(target, info.ended.Sub(info.firstByte).Seconds())
+		}
+	}
+	if target == 0 {
+		return hlsDefaultTarget * time.Second
+	}
+	return time.Duration(math.Ceil(target)) * time.Second
+}
+
+// Blocks until segment idx is closed, or has the given part if that is
+// not negative, or the stream is closed, or timeout. Only peeks at the
+// ring, so polling players never pre-create segments.
+func (s *Stream) waitForSegment(ctx context.Context, idx, part int, timeout time.Duration) {
+	deadline := s.clock.After(timeout)
+	for {
+		changed := s.changes()
+		segment, _, nextWrite, _, closed := s.peek(idx)
+		if closed {
+			return
+		}
+		var (
+			segmentClosed chan bool
+			partsChanged  chan struct{}
+		)
+		if segment != nil {
+			var isClosed bool
+			if isClosed, segmentClosed = segment.isClosed(); isClosed {
+				return
+			}
+			var numParts int
+			if numParts, partsChanged = segment.partsState(); part >= 0 && part < numParts {
+				return
+			}
+		} else if idx < nextWrite {
+			return // fell out of the window
+		}
+		// otherwise not started yet, so wait for the writes to get there
+		select {
+		case <-segmentClosed:
+		case <-partsChanged:
+		case <-changed:
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (s *Stream) hlsPlaylist() string {
+	infos, nextWrite, closed := s.segmentInfos()
+	target := s.targetDuration().Seconds()
+	ext := s.hlsExtension()
+	hasParts := s.hasHLSParts() && !closed
+	now := s.clock.Now()
+
+	var (
+		body     strings.Builder
+		first    = -1
+		next     = nextWrite // first segment not listed
+		nextPart = 0         // first part of it not listed
+
+		// discontinuities before the first listed segment
+		discontinuitySeq = 0
+	)
+	begin := func(info segmentInfo) {
+		if info.discontinuity {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if first < 0 {
+			first = info.idx
+			// epochs start at 0 and each new one begins with a discontinuity
+			discontinuitySeq = info.epoch
+			if info.discontinuity {
+				discontinuitySeq--
+			}
+			fmt.Fprintf(&body, "#EXT-X-PROGRAM-DATE-TIME:%s\n", info.firstByte.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	writeParts := func(info segmentInfo) {
+		for i, part := range info.parts {
+			fmt.Fprintf(&body, "#EXT-X-PART:DURATION=%.3f,URI=\"%d.%d%s\"", part.duration.Seconds(), info.idx, i, ext)
+			if i == 0 {
+				// segments start on a keyframe
+				body.WriteString(",INDEPENDENT=YES")
+			}
+			body.WriteString("\n")
+		}
+	}
+	for _, info := range infos {
+		if info.idx >= nextWrite {
+			break // not started yet
+		}
+		if !info.closed {
+			// in progress, so only its parts so far
+			next, nextPart = info.idx, len(info.parts)
+			if hasParts && len(info.parts) > 0 {
+				begin(info)
+				writeParts(info)
+			}
+			break
+		}
+		if info.size <= 0 || info.aborted {
+			// dropped or incomplete segment; skip if nothing has been listed yet
+			if first >= 0 {
+				if info.discontinuity {
+					body.WriteString("#EXT-X-DISCONTINUITY\n")
+				}
+				fmt.Fprintf(&body, "#EXT-X-GAP\n#EXTINF:%.3f,\n%d%s\n", target, info.idx, ext)
+			}
+			continue
+		}
+		duration := info.ended.Sub(info.firstByte).Seconds()
+		begin(info)
+		if hasParts && now.Sub(info.ended).Seconds() <= hlsPartWindow*target {
+			writeParts(info)
+		}
+		fmt.Fprintf(&body, "#EXTINF:%.3f,\n%d%s\n", duration, info.idx, ext)
+	}
+	if first < 0 {
+		first = next
+	}
+	if hasParts {
+		// where the next part will be, so players can request it early
+		fmt.Fprintf(&body, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%d.%d%s\"\n", next, nextPart, ext)
+	}
+
+	var pl strings.Builder
+	pl.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&pl, "#EXT-X-TARGETDURATION:%d\n", int(target))
+	if hasParts {
+		partTarget := s.config.HLSPartTarget.Seconds()
+		fmt.Fprintf(&pl, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget)
+		fmt.Fprintf(&pl, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget)
+	} else {
+		pl.WriteString("#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES\n")
+	}
+	fmt.Fprintf(&pl, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	if discontinuitySeq > 0 {
+		fmt.Fprintf(&pl, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discontinuitySeq)
+	}
+	if s.getInit() != nil {
+		fmt.Fprintf(&pl, "#EXT-X-MAP:URI=\"%s\"\n", s.hlsInitFile())
+	}
+	pl.WriteString(body.String())
+	if closed {
+		pl.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return pl.String()
+}
+
+// LL-HLS partial segment: the data of a segment up to end
+type segmentPart struct {
+	end      int
+	duration time.Duration
+}
+
+// Cuts a segment into parts as it is written. Parts end on TS packet
+// boundaries, or for CMAF before a moof box, and are cut once the part
+// target is up. The cut happens on the write after that, from the data
+// before it, so parts stay within the target as long as the publisher
+// writes in real time and CMAF fragments are shorter than the target.
+type hlsParts struct {
+	target time.Duration
+	cmaf   bool
+	cut    []segmentPart
+	start  time.Time // when the part being filled started
+
+	// for CMAF, the next box to look at and the latest moof seen
+	boxPos  int
+	moofPos int
+
+	// closed and replaced whenever a part is cut
+	changed chan struct{}
+}
+
+func newHLSParts(target time.Duration, cmaf bool) *hlsParts {
+	return &hlsParts{target: target, cmaf: cmaf, changed: make(chan struct{})}
+}
+
+// Called with the segment data so far before more is appended at now
+func (p *hlsParts) beforeWrite(data []byte, lastByte, now time.Time) {
+	if len(data) == 0 {
+		p.start = now
+		return
+	}
+	if now.Sub(p.start) < p.target {
+		return
+	}
+	if end := p.boundary(data); end > p.end() {
+		p.add(end, lastByte)
+	}
+}
+
+// Cuts whatever is left once the segment is done
+func (p *hlsParts) finish(size int, ended time.Time, aborted bool) {
+	if !aborted && size > p.end() {
+		p.add(size, ended)
+	}
+}
+
+func (p *hlsParts) add(end int, ended time.Time) {
+	p.cut = append(p.cut, segmentPart{end: end, duration: min(ended.Sub(p.start), p.target)})
+	p.start = ended
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// Drops the parts of a segment that is being written again
+func (p *hlsParts) reset() {
+	p.cut = nil
+	p.start = time.Time{}
+	p.boxPos, p.moofPos = 0, 0
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *hlsParts) clone() []segmentPart {
+	if p == nil {
+		return nil
+	}
+	return slices.Clone(p.cut)
+}
+
+// Offset just past the last part
+func (p *hlsParts) end() int {
+	if len(p.cut) == 0 {
+		return 0
+	}
+	return p.cut[len(p.cut)-1].end
+}
+
+// Latest offset in data where a part can end
+func (p *hlsParts) boundary(data []byte) int {
+	if !p.cmaf {
+		return len(data) / tsPacketSize * tsPacketSize
+	}
+	for p.boxPos+8 <= len(data) {
+		if string(data[p.boxPos+4:p.boxPos+8]) == "moof" {
+			p.moofPos = p.boxPos
+		}
+		size := int(binary.BigEndian.Uint32(data[p.boxPos:]))
+		if size < 8 {
+			break // 64 bit or open ended sizes; not in fragments we can split
+		}
+		p.boxPos += size
+	}
+	return p.moofPos
+}
+
+// Returns the data of part n, waiting for it to be cut. Returns false if
+// the segment ends without it or ctx is done first. Pair with wake.
+func (s *Segment) readPart(ctx context.Context, n int) ([]byte, bool) {
+	for {
+		s.mutex.Lock()
+		if s.parts == nil {
+			s.mutex.Unlock()
+			return nil, false
+		}
+		if n < len(s.parts.cut) {
+			start := 0
+			if n > 0 {
+				start = s.parts.cut[n-1].end
+			}
+			data := bytes.Clone(s.buffer.Bytes()[start:s.parts.cut[n].end])
+			s.mutex.Unlock()
+			return data, true
+		}
+		closed, closeCh, changed := s.closed, s.closeCh, s.parts.changed
+		s.mutex.Unlock()
+		if closed {
+			return nil, false
+		}
+		select {
+		case <-changed:
+		case <-closeCh:
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+// Number of parts cut so far, and a channel closed once there are more
+func (s *Segment) partsState() (int, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.parts == nil {
+		return 0, nil
+	}
+	return len(s.parts.cut), s.parts.changed
+}
+
+// Whether segments of the channel are cut into LL-HLS parts
+func (s *Stream) hasHLSParts() bool {
+	return s.config.HLS && (s.isCMAF() || strings.EqualFold(s.mimeType, "video/MP2T"))
+}
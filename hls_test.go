@@ -0,0 +1,304 @@
+package trickle
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func httpGet(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestHLS_Playlist(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, HLS: true}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := pub.Write(bytes.NewReader([]byte("segment" + string(rune('0'+i))))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status, playlist := httpGet(t, ts.URL+"/live/hls/index.m3u8")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	for _, line := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:0\n", "\n0.ts\n", "\n1.ts\n",
+		"#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=3.000\n",
+		"#EXT-X-PART-INF:PART-TARGET=1.000\n",
+		`URI="1.0.ts",INDEPENDENT=YES` + "\n#EXTINF:",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="2.0.ts"` + "\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist is missing %q:\n%s", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "\n2.ts") {
+		t.Errorf("unexpected segment 2 in playlist:\n%s", playlist)
+	}
+	if strings.Contains(playlist, "EXT-X-MAP") {
+		t.Error("unexpected init segment for TS")
+	}
+
+	status, body := httpGet(t, ts.URL+"/live/hls/1.ts")
+	if status != http.StatusOK || body != "segment1" {
+		t.Errorf("unexpected segment %d %q", status, body)
+	}
+	status, body = httpGet(t, ts.URL+"/live/hls/1.0.ts")
+	if status != http.StatusOK || body != "segment1" {
+		t.Errorf("unexpected part %d %q", status, body)
+	}
+
+	// blocking reload waits for the next segment to complete
+	done := make(chan string, 1)
+	go func() {
+		_, playlist := httpGet(t, ts.URL+"/live/hls/index.m3u8?_HLS_msn=2")
+		done <- playlist
+	}()
+	select {
+	case <-done:
+		t.Fatal("blocking reload returned early")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := pub.Write(bytes.NewReader([]byte("segment2"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case playlist := <-done:
+		if !strings.Contains(playlist, "\n2.ts\n") {
+			t.Errorf("playlist is missing the new segment:\n%s", playlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking reload did not return")
+	}
+
+	if status, _ := httpGet(t, ts.URL+"/live/hls/index.m3u8?_HLS_msn=10"); status != http.StatusBadRequest {
+		t.Errorf("expected bad request for far ahead msn, got %d", status)
+	}
+	if status, _ := httpGet(t, ts.URL+"/missing/hls/index.m3u8"); status != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", status)
+	}
+}
+
+func TestHLS_CMAF(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, HLS: true}, false)
+	pub, err := NewTricklePublisherWithConfig(ts.URL+"/cmaf", TricklePublisherConfig{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := testInit(true)
+	if err := pub.WriteInit(init); err != nil {
+		t.Fatal(err)
+	}
+	fragment := testFragment(testVideoTrack, 0, true)
+	if err := pub.Write(bytes.NewReader(fragment)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, playlist := httpGet(t, ts.URL+"/cmaf/hls/index.m3u8")
+	for _, line := range []string{`#EXT-X-MAP:URI="init.mp4"`, "\n0.m4s\n"} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist is missing %q:\n%s", line, playlist)
+		}
+	}
+	if _, body := httpGet(t, ts.URL+"/cmaf/hls/init.mp4"); body != string(init) {
+		t.Error("unexpected init segment")
+	}
+	if _, body := httpGet(t, ts.URL+"/cmaf/hls/0.m4s"); body != string(fragment) {
+		t.Error("unexpected media segment")
+	}
+}
+
+func TestHLS_Discontinuity(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, HLS: true}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/disc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// new epochs at 1 and 3; 1 falls out of the window
+	for i := 0; i < 7; i++ {
+		if i == 1 || i == 3 {
+			if _, err := pub.NewEpoch(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := pub.Write(bytes.NewReader([]byte("segment"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, playlist := httpGet(t, ts.URL+"/disc/hls/index.m3u8")
+	for _, line := range []string{"#EXT-X-MEDIA-SEQUENCE:3\n", "#EXT-X-DISCONTINUITY-SEQUENCE:1\n", "#EXT-X-DISCONTINUITY\n#EXT-X-PROGRAM-DATE-TIME"} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist is missing %q:\n%s", line, playlist)
+		}
+	}
+	if n := strings.Count(playlist, "#EXT-X-DISCONTINUITY\n"); n != 1 {
+		t.Errorf("expected one discontinuity, got %d:\n%s", n, playlist)
+	}
+}
+
+func TestHLS_BlockingReloadPeeks(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux, HLS: true})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	t.Cleanup(srv.Start())
+	pub := NewLocalPublisher(srv, "peek", "video/MP2T")
+	pub.CreateChannel()
+
+	done := make(chan string, 1)
+	go func() {
+		_, playlist := httpGet(t, ts.URL+"/peek/hls/index.m3u8?_HLS_msn=0")
+		done <- playlist
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// waiting on the reload leaves the ring alone
+	stream, _ := srv.getStream("peek")
+	stream.mutex.RLock()
+	for _, segment := range stream.segments {
+		if segment != nil {
+			t.Errorf("unexpected segment %d created by the reload", segment.idx)
+		}
+	}
+	stream.mutex.RUnlock()
+
+	if err := pub.Write(bytes.NewReader([]byte("segment0"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case playlist := <-done:
+		if !strings.Contains(playlist, "\n0.ts\n") {
+			t.Errorf("playlist is missing the new segment:\n%s", playlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking reload did not return")
+	}
+}
+
+func TestHLS_Parts(t *testing.T) {
+	clock := &stepClock{Clock: SystemClock, now: time.Now()}
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux, HLS: true, Clock: clock})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	NewLocalPublisher(srv, "ll", "video/MP2T").CreateChannel()
+	stream, _ := srv.getStream("ll")
+	segment, _ := stream.getForWrite(0)
+	stream.startWrite(segment)
+
+	packet := bytes.Repeat([]byte{0x47}, tsPacketSize)
+	write := func(packets int) {
+		segment.writeData(bytes.Repeat(packet, packets))
+		clock.Advance(400 * time.Millisecond)
+	}
+	// the write at 1.2s is past the part target, so the first part is
+	// cut from the data before it
+	for i := 0; i < 4; i++ {
+		write(2)
+	}
+	_, playlist := httpGet(t, ts.URL+"/ll/hls/index.m3u8")
+	for _, line := range []string{
+		"#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PROGRAM-DATE-TIME:",
+		`#EXT-X-PART:DURATION=0.800,URI="0.0.ts",INDEPENDENT=YES` + "\n",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="0.1.ts"` + "\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist is missing %q:\n%s", line, playlist)
+		}
+	}
+	if strings.Contains(playlist, "#EXTINF") {
+		t.Errorf("unexpected segment in playlist:\n%s", playlist)
+	}
+	if status, body := httpGet(t, ts.URL+"/ll/hls/0.0.ts"); status != http.StatusOK || body != strings.Repeat(string(packet), 6) {
+		t.Errorf("unexpected part %d of %d bytes", status, len(body))
+	}
+
+	// both the hinted part and a blocking reload for it wait for the cut
+	part := make(chan string, 1)
+	reload := make(chan string, 1)
+	go func() {
+		_, body := httpGet(t, ts.URL+"/ll/hls/0.1.ts")
+		part <- body
+	}()
+	go func() {
+		_, playlist := httpGet(t, ts.URL+"/ll/hls/index.m3u8?_HLS_msn=0&_HLS_part=1")
+		reload <- playlist
+	}()
+	select {
+	case <-part:
+		t.Fatal("part request returned early")
+	case <-reload:
+		t.Fatal("blocking reload returned early")
+	case <-time.After(100 * time.Millisecond):
+	}
+	write(1)
+	write(1)
+	select {
+	case body := <-part:
+		if body != strings.Repeat(string(packet), 3) {
+			t.Errorf("unexpected part of %d bytes", len(body))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("part request did not return")
+	}
+	select {
+	case playlist := <-reload:
+		if !strings.Contains(playlist, `URI="0.1.ts"`+"\n") {
+			t.Errorf("playlist is missing the new part:\n%s", playlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("blocking reload did not return")
+	}
+
+	// the rest becomes the last part once the segment is done
+	segment.close()
+	_, playlist = httpGet(t, ts.URL+"/ll/hls/index.m3u8")
+	for _, line := range []string{
+		`#EXT-X-PART:DURATION=0.800,URI="0.2.ts"` + "\n#EXTINF:2.400,\n0.ts\n",
+		`#EXT-X-PRELOAD-HINT:TYPE=PART,URI="1.0.ts"` + "\n",
+	} {
+		if !strings.Contains(playlist, line) {
+			t.Errorf("playlist is missing %q:\n%s", line, playlist)
+		}
+	}
+
+	if status, _ := httpGet(t, ts.URL+"/ll/hls/0.3.ts"); status != http.StatusNotFound {
+		t.Errorf("expected not found past the last part, got %d", status)
+	}
+	if status, _ := httpGet(t, ts.URL+"/ll/hls/index.m3u8?_HLS_part=1"); status != http.StatusBadRequest {
+		t.Errorf("expected bad request for a part without msn, got %d", status)
+	}
+}
+
+func TestHLS_CMAFPartBoundary(t *testing.T) {
+	fragment := testFragment(testVideoTrack, 0, true)
+	data := append(slices.Clone(fragment), fragment...)
+	parts := newHLSParts(time.Second, true)
+	// the second fragment may not be complete yet, so cut before its moof
+	if end := parts.boundary(data); end != len(fragment) {
+		t.Errorf("expected a boundary at %d, got %d", len(fragment), end)
+	}
+	if end := parts.boundary(append(data, fragment[:10]...)); end != len(data) {
+		t.Errorf("expected a boundary at %d, got %d", len(data), end)
+	}
+}
@@ -0,0 +1,134 @@
+package trickle_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestKeepalive_Modes(t *testing.T) {
+	tests := []struct {
+		mode trickle.KeepaliveMode
+		want []int
+	}{
+		{"", []int{http.StatusContinue}},
+		{trickle.KeepaliveContinue, []int{http.StatusContinue}},
+		{trickle.KeepaliveEarlyHints, []int{http.StatusEarlyHints}},
+		{trickle.KeepaliveNone, nil},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			clock := trickletest.NewFakeClock(time.Now())
+			ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+				Autocreate:         true,
+				Keepalive:          tt.mode,
+				FirstByteKeepalive: 5 * time.Second,
+				Clock:              clock,
+			})
+
+			var (
+				mu  sync.Mutex
+				got []int
+			)
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					mu.Lock()
+					defer mu.Unlock()
+					got = append(got, code)
+					return nil
+				},
+			}
+			pr, pw := io.Pipe()
+			req, _ := http.NewRequest("POST", ts.ChannelURL("keepalive")+"/0", pr)
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+			done := make(chan *http.Response)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+				}
+				done <- resp
+			}()
+
+			// the sweeper and the wait for the first byte
+			trickletest.WaitFor(t, func() bool { return clock.Pending() == 2 })
+			clock.Advance(5 * time.Second)
+			trickletest.WaitFor(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				// or another wait for the first byte if nothing is sent
+				return len(got) > 0 || clock.Pending() == 2
+			})
+			io.WriteString(pw, "data")
+			pw.Close()
+			if resp := <-done; resp == nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+				t.Errorf("expected provisional responses %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestKeepalive_MaxPreconnectIdle(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:        true,
+		MaxPreconnectIdle: 30 * time.Second,
+		Clock:             clock,
+	})
+
+	// serve the first preconnect through the fault so we know when it ends
+	expired := make(chan struct{})
+	ts.InjectFault(trickletest.Request("POST", "/idle/0"), func(w http.ResponseWriter, r *http.Request) bool {
+		ts.Config.Handler.ServeHTTP(w, r)
+		close(expired)
+		return true
+	}, 1)
+	pub := ts.Publisher(t, "idle")
+	trickletest.WaitFor(t, func() bool {
+		select {
+		case <-expired:
+			return true
+		default:
+			clock.Advance(10 * time.Second)
+			return false
+		}
+	})
+	// the publisher has seen the response once it has a subscriber count
+	trickletest.WaitFor(t, func() bool { return pub.Subscribers() == 0 })
+
+	// and reconnects transparently on the next write
+	trickletest.Publish(t, pub, "after idle")
+	if seq, data := trickletest.Read(t, ts.Subscriber("idle", 0)); seq != 0 || data != "after idle" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+}
+
+func TestKeepalive_PreconnectExpiresDuringWrite(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+
+	// expire the first preconnect only once the write has started
+	ts.InjectFault(trickletest.Request("POST", "/race/0"), func(w http.ResponseWriter, r *http.Request) bool {
+		r.Body.Read(make([]byte, 1))
+		w.Header().Set("Lp-Trickle-Reconnect", "idle")
+		w.WriteHeader(http.StatusRequestTimeout)
+		return true
+	}, 1)
+	pub := ts.Publisher(t, "race")
+
+	// the publisher sends the segment again on a new preconnect
+	trickletest.Publish(t, pub, "racing write")
+	if seq, data := trickletest.Read(t, ts.Subscriber("race", 0)); seq != 0 || data != "racing write" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+}
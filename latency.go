@@ -0,0 +1,146 @@
+package trickle
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Number of recent samples kept for latency summaries
+const latencyWindow = 1024
+
+// LatencyStats keeps a rolling window of latency samples
+type LatencyStats struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+// LatencySummary describes the samples currently in the window
+type LatencySummary struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+}
+
+// SegmentLatency is measured by subscribers once a segment is fully read.
+// Relies on publisher and subscriber clocks being in sync.
+type SegmentLatency struct {
+	Seq int
+
+	// From the publisher sending the first byte to the subscriber receiving it
+	FirstByte time.Duration
+
+	// From the publisher sending the last byte to the subscriber receiving it
+	GlassToGlass time.Duration
+}
+
+// SubscriberLatency summarizes the latencies of recent segments
+type SubscriberLatency struct {
+	FirstByte    LatencySummary
+	GlassToGlass LatencySummary
+}
+
+func (s *LatencyStats) Add(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.samples) < latencyWindow {
+		s.samples = append(s.samples, d)
+		return
+	}
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencyWindow
+}
+
+func (s *LatencyStats) Summary() LatencySummary {
+	s.mu.Lock()
+	sorted := slices.Clone(s.samples)
+	s.mu.Unlock()
+	if len(sorted) == 0 {
+		return LatencySummary{}
+	}
+	slices.Sort(sorted)
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	return LatencySummary{
+		Count: len(sorted),
+		Mean:  total / time.Duration(len(sorted)),
+		P50:   percentile(50),
+		P90:   percentile(90),
+		P99:   percentile(99),
+	}
+}
+
+// Records when the first and last bytes are read from the wrapped reader.
+// Used by publishers to stamp segments with send times.
+type sendTimer struct {
+	reader io.Reader
+	clock  Clock
+	first  time.Time
+	last   time.Time
+}
+
+func (st *sendTimer) Read(p []byte) (int, error) {
+	n, err := st.reader.Read(p)
+	if n > 0 {
+		st.last = st.clock.Now()
+		if st.first.IsZero() {
+			st.first = st.last
+		}
+	}
+	return n, err
+}
+
+// Wraps a subscriber response body to measure latency once it is read to EOF
+type latencyReader struct {
+	body      io.ReadCloser
+	resp      *http.Response
+	clock     Clock
+	firstByte time.Time
+	done      bool
+	onDone    func(*http.Response, time.Time, time.Time)
+}
+
+func (lr *latencyReader) Read(p []byte) (int, error) {
+	n, err := lr.body.Read(p)
+	if n > 0 && lr.firstByte.IsZero() {
+		lr.firstByte = lr.clock.Now()
+	}
+	if err == io.EOF && !lr.done {
+		// trailers are only available after EOF
+		lr.done = true
+		lr.onDone(lr.resp, lr.firstByte, lr.clock.Now())
+	}
+	return n, err
+}
+
+func (lr *latencyReader) Close() error {
+	return lr.body.Close()
+}
+
+// Computes segment latency from the publisher's send time trailers.
+// Returns false if the publisher did not send them.
+func segmentLatency(resp *http.Response, firstByte, lastByte time.Time) (SegmentLatency, bool) {
+	sent, err := time.Parse(time.RFC3339Nano, resp.Trailer.Get("Lp-Trickle-Sent"))
+	if err != nil || firstByte.IsZero() {
+		return SegmentLatency{}, false
+	}
+	sentEnd, err := time.Parse(time.RFC3339Nano, resp.Trailer.Get("Lp-Trickle-Sent-End"))
+	if err != nil {
+		return SegmentLatency{}, false
+	}
+	return SegmentLatency{
+		Seq:          GetSeq(resp),
+		FirstByte:    firstByte.Sub(sent),
+		GlassToGlass: lastByte.Sub(sentEnd),
+	}, true
+}
@@ -0,0 +1,108 @@
+package trickle
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatencyStats_Summary(t *testing.T) {
+	stats := &LatencyStats{}
+	if summary := stats.Summary(); summary.Count != 0 {
+		t.Errorf("expected empty summary, got %+v", summary)
+	}
+	for i := 1; i <= 100; i++ {
+		stats.Add(time.Duration(i) * time.Millisecond)
+	}
+	summary := stats.Summary()
+	if summary.Count != 100 || summary.P50 != 50*time.Millisecond || summary.P90 != 90*time.Millisecond || summary.P99 != 99*time.Millisecond {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if summary.Mean != 50500*time.Microsecond {
+		t.Errorf("unexpected mean %v", summary.Mean)
+	}
+
+	// only the most recent samples are kept
+	for i := 0; i < latencyWindow; i++ {
+		stats.Add(time.Second)
+	}
+	if summary := stats.Summary(); summary.Count != latencyWindow || summary.P50 != time.Second || summary.Mean != time.Second {
+		t.Errorf("unexpected summary after wrapping %+v", summary)
+	}
+}
+
+func TestLatency_EndToEnd(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []SegmentLatency
+	)
+	sub := NewTrickleSubscriberWithConfig(ts.URL+"/latency", TrickleSubscriberConfig{
+		OnLatency: func(l SegmentLatency) {
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, l)
+		},
+	})
+	sub.SetSeq(0)
+
+	const segments = 3
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < segments; i++ {
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte("hello"))
+				time.Sleep(50 * time.Millisecond)
+				pw.Write([]byte("world"))
+				pw.Close()
+			}()
+			if err := pub.Write(pr); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < segments; i++ {
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || !bytes.Equal(data, []byte("helloworld")) {
+			t.Fatalf("unexpected segment %q %v", data, err)
+		}
+	}
+
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	if len(latencies) != segments {
+		t.Fatalf("expected %d latency samples, got %d", segments, len(latencies))
+	}
+	for i, l := range latencies {
+		// everything is local so latency should be well under the segment duration
+		if l.Seq != i || l.FirstByte < 0 || l.FirstByte > 50*time.Millisecond || l.GlassToGlass < 0 || l.GlassToGlass > 50*time.Millisecond {
+			t.Errorf("unexpected latency %+v", l)
+		}
+	}
+	stats := sub.LatencyStats()
+	if stats.FirstByte.Count != segments || stats.GlassToGlass.Count != segments {
+		t.Errorf("unexpected subscriber stats %+v", stats)
+	}
+	if pub.LatencyStats().Count != segments {
+		t.Errorf("unexpected publisher stats %+v", pub.LatencyStats())
+	}
+}
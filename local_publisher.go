@@ -1,6 +1,7 @@
 package trickle
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"log/slog"
@@ -56,6 +57,9 @@ func (c *TrickleLocalPublisher) Write(data io.Reader) error {
 	for {
 		n, err := data.Read(buf)
 		if n > 0 {
+			if totalRead == 0 {
+				stream.startWrite(segment)
+			}
 			segment.writeData(buf[:n])
 			totalRead += n
 		}
@@ -64,12 +68,27 @@ func (c *TrickleLocalPublisher) Write(data io.Reader) error {
 				break
 			}
 			slog.Info("Error reading published data", "channel", c.channelName, "seq", seq, "bytes written", totalRead, "err", err)
+			segment.abort()
+			return err
 		}
 	}
 	segment.close()
 	return nil
 }
 
+// NewEpoch starts a new epoch with the next segment written, flagging
+// it as a discontinuity for subscribers. Returns the new epoch.
+func (c *TrickleLocalPublisher) NewEpoch() int {
+	stream := c.server.getOrCreateStream(c.channelName, c.mimeType, true)
+	return stream.startEpoch()
+}
+
+// WriteInit sets the channel's init segment, eg CMAF ftyp + moov
+func (c *TrickleLocalPublisher) WriteInit(data []byte) {
+	stream := c.server.getOrCreateStream(c.channelName, c.mimeType, true)
+	stream.setInit(bytes.Clone(data))
+}
+
 func (c *TrickleLocalPublisher) Close() error {
 	return c.server.closeStream(c.channelName)
 }
@@ -21,6 +21,10 @@ type TrickleLocalSubscriber struct {
 
 	mu  *sync.Mutex
 	seq int
+
+	// whether to prepend the init segment to the next segment read
+	prependInit bool
+	needsInit   bool
 }
 
 func NewLocalSubscriber(sm *Server, channelName string) *TrickleLocalSubscriber {
@@ -47,8 +51,43 @@ func (c *TrickleLocalSubscriber) Read() (*TrickleData, error) {
 		return nil, &SequenceNonexistent{Latest: latestSeq, Seq: c.seq}
 	}
 	c.seq++
+
+	// wait for the segment to start so timestamps are available
+	segment.readData(0)
+	info := segment.info()
+	var init []byte
+	if c.needsInit {
+		init = stream.getInit()
+		c.needsInit = false
+	}
+	metadata := map[string]string{
+		"Lp-Trickle-Latest": strconv.Itoa(latestSeq),
+		"Lp-Trickle-Seq":    strconv.Itoa(segment.idx),
+		"Lp-Trickle-Epoch":  strconv.Itoa(info.epoch),
+		"Content-Type":      stream.mimeType,
+	} // TODO take more metadata from http headers
+	if info.discontinuity {
+		metadata["Lp-Trickle-Discontinuity"] = "true"
+	}
+	if !info.firstByte.IsZero() {
+		metadata["Lp-Trickle-Created"] = formatTrickleTime(info.firstByte)
+	}
+	if info.closed {
+		metadata["Lp-Trickle-Last-Byte"] = formatTrickleTime(info.lastByte)
+		metadata["Lp-Trickle-Bytes"] = strconv.Itoa(info.size)
+	}
+	if init != nil {
+		metadata["Lp-Trickle-Init"] = "prepended"
+		metadata["Lp-Trickle-Init-Bytes"] = strconv.Itoa(len(init))
+	}
+
 	r, w := io.Pipe()
 	go func() {
+		if init != nil {
+			if _, err := w.Write(init); err != nil {
+				return
+			}
+		}
 		subscriber := &SegmentSubscriber{
 			segment: segment,
 		}
@@ -65,23 +104,42 @@ func (c *TrickleLocalSubscriber) Read() (*TrickleData, error) {
 			}
 			if eof {
 				// trigger eof on the reader
-				w.Close()
+				if segment.info().aborted {
+					w.CloseWithError(ErrSegmentAborted)
+				} else {
+					w.Close()
+				}
 				return
 			}
 		}
 	}()
 	return &TrickleData{
-		Reader: r,
-		Metadata: map[string]string{
-			"Lp-Trickle-Latest": strconv.Itoa(latestSeq),
-			"Lp-Trickle-Seq":    strconv.Itoa(segment.idx),
-			"Content-Type":      stream.mimeType,
-		}, // TODO take more metadata from http headers
+		Reader:   r,
+		Metadata: metadata,
 	}, nil
 }
 
+// ReadInit returns the channel's init segment, or nil if there is none
+func (c *TrickleLocalSubscriber) ReadInit() ([]byte, error) {
+	stream, exists := c.server.getStream(c.channelName)
+	if !exists {
+		return nil, errors.New("stream not found")
+	}
+	return stream.getInit(), nil
+}
+
 func (c *TrickleLocalSubscriber) SetSeq(seq int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.seq = seq
+	c.needsInit = c.prependInit
+}
+
+// SetPrependInit prepends the channel's init segment, if any, to the
+// next segment read and again after SetSeq. Useful for joining at -2.
+func (c *TrickleLocalSubscriber) SetPrependInit(prepend bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prependInit = prepend
+	c.needsInit = prepend
 }
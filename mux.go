@@ -0,0 +1,658 @@
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Multiplexed subscriptions: POST {basePath}_subscribe with a MuxRequest
+// follows several channels over one streaming response, eg for dashboards
+// watching many small channels. Requires MuxSubscribe.
+//
+// Channels named in the request that the prefix config does not authorize
+// get the whole request rejected with a 403, while prefixes only ever
+// match the channels the request may see.
+//
+// The response uses the framing of the socket protocol. Each segment
+// starts with a response frame whose JSON header names the channel and
+// assigns it a numeric id, followed by data frames and an end frame
+// that lead with the four byte big-endian id. Segments of different
+// channels may be interleaved. Response frames also report gaps (470)
+// and closed channels. Ping frames are sent while idle.
+
+const SUBSCRIBE = "_subscribe"
+
+const muxContentType = "application/x-trickle-mux"
+
+const framePing byte = 'P'
+
+// Default for how often idle subscriptions are pinged
+const muxPingInterval = 10 * time.Second
+
+// How long to wait before looking at a cancelled segment again
+const muxRetryInterval = 500 * time.Millisecond
+
+// How much a MuxChannel buffers until it is read. Past either limit the
+// channel's backlog is dropped and Read returns ErrMuxOverflow.
+var (
+	maxMuxBacklogBytes    int64 = 16 << 20
+	maxMuxBacklogSegments       = 64
+)
+
+// ErrMuxOverflow is returned by MuxChannel.Read when the channel was not
+// read quickly enough and segments were dropped. Later reads carry on
+// with the segments that arrive after.
+var ErrMuxOverflow = errors.New("mux channel backlog dropped")
+
+// MuxRequest selects the channels of a multiplexed subscription
+type MuxRequest struct {
+	// Channels to follow by name
+	Channels []string `json:"channels,omitempty"`
+
+	// Follow every channel whose name starts with one of these. Internal
+	// channels such as the changefeed only match prefixes starting with _
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	// Seq to start each channel from. Defaults to -1, the next segment,
+	// for channels that exist when subscribing and to 0 for channels
+	// created afterwards.
+	Seqs map[string]int `json:"seqs,omitempty"`
+}
+
+func (r *MuxRequest) matches(name string) bool {
+	if slices.Contains(r.Channels, name) {
+		return true
+	}
+	for _, p := range r.Prefixes {
+		if strings.HasPrefix(name, p) && (!strings.HasPrefix(name, "_") || strings.HasPrefix(p, "_")) {
+			return true
+		}
+	}
+	return false
+}
+
+type muxHeader struct {
+	ID            uint32 `json:"id"`
+	Channel       string `json:"channel"`
+	Status        int    `json:"status"`
+	Seq           int    `json:"seq"`
+	Latest        int    `json:"latest"`
+	Closed        bool   `json:"closed,omitempty"`
+	ContentType   string `json:"content_type,omitempty"`
+	Created       string `json:"created,omitempty"`
+	Epoch         int    `json:"epoch,omitempty"`
+	Discontinuity bool   `json:"discontinuity,omitempty"`
+}
+
+type muxSubscription struct {
+	sm  *Server
+	req MuxRequest
+	r   *http.Request
+	ctx context.Context
+	wg  sync.WaitGroup
+
+	mu        sync.Mutex        // guards everything below
+	following map[string]uint32 // channel name to id
+	nextID    uint32
+	done      bool
+
+	// Serializes writes to the response. Kept apart from mu so a
+	// stalled client does not hold up following new channels.
+	writeMu sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (sm *Server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	var req MuxRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (len(req.Channels) == 0 && len(req.Prefixes) == 0) {
+		http.Error(w, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+	for _, name := range req.Channels {
+		if !sm.authorized(r, name) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", muxContentType)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	m := &muxSubscription{
+		sm:        sm,
+		req:       req,
+		r:         r,
+		ctx:       r.Context(),
+		w:         w,
+		flusher:   flusher,
+		following: map[string]uint32{},
+	}
+	// register first so channels created meanwhile are not missed
+	sm.mutex.Lock()
+	if sm.muxes == nil {
+		sm.muxes = map[*muxSubscription]bool{}
+	}
+	sm.muxes[m] = true
+	streams := make([]*Stream, 0, len(sm.streams))
+	for name, s := range sm.streams {
+		if req.matches(name) && sm.authorized(r, name) {
+			streams = append(streams, s)
+		}
+	}
+	sm.mutex.Unlock()
+	for _, s := range streams {
+		seq, ok := req.Seqs[s.name]
+		if !ok {
+			seq = -1
+		}
+		m.follow(s, seq)
+	}
+
+	// keep idle connections from being dropped by proxies
+	ticker := sm.config.Clock.NewTicker(sm.config.MuxPingInterval)
+	for done := false; !done; {
+		select {
+		case <-ticker.C():
+			m.writeFrame(framePing, nil)
+		case <-r.Context().Done():
+			done = true
+		}
+	}
+	ticker.Stop()
+
+	sm.mutex.Lock()
+	delete(sm.muxes, m)
+	sm.mutex.Unlock()
+	m.mu.Lock()
+	m.done = true
+	m.mu.Unlock()
+	m.wg.Wait()
+}
+
+// Starts following newly created channels
+func (sm *Server) notifyMuxes(s *Stream) {
+	sm.mutex.RLock()
+	var muxes []*muxSubscription
+	for m := range sm.muxes {
+		if m.req.matches(s.name) && sm.authorized(m.r, s.name) {
+			muxes = append(muxes, m)
+		}
+	}
+	sm.mutex.RUnlock()
+	for _, m := range muxes {
+		seq, ok := m.req.Seqs[s.name]
+		if !ok {
+			seq = 0
+		}
+		m.follow(s, seq)
+	}
+}
+
+func (m *muxSubscription) follow(s *Stream, seq int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.following[s.name]; ok || m.done {
+		return
+	}
+	id := m.nextID
+	m.nextID++
+	m.following[s.name] = id
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer func() {
+			m.mu.Lock()
+			delete(m.following, s.name)
+			m.mu.Unlock()
+		}()
+		for ok := true; ok && m.ctx.Err() == nil; {
+			seq, ok = m.sendSegment(s, id, seq)
+		}
+	}()
+}
+
+// Sends the segment at seq. Returns the seq to send next and whether
+// to carry on following the channel.
+func (m *muxSubscription) sendSegment(s *Stream, id uint32, seq int) (int, bool) {
+	defer s.presence.add()()
+	header := &muxHeader{ID: id, Channel: s.name, Seq: seq}
+	segment, latestSeq, exists, closed := s.getForRead(seq)
+	if !exists {
+		header.Latest = latestSeq
+		if closed {
+			header.Status, header.Closed = http.StatusOK, true
+			m.writeJSON(header)
+			return 0, false
+		}
+		// skip ahead to the live edge
+		header.Status = 470
+		return latestSeq, m.writeJSON(header) == nil
+	}
+
+	defer context.AfterFunc(m.ctx, segment.wake)()
+	subscriber := &SegmentSubscriber{segment: segment, ctx: m.ctx}
+	readData := subscriber.readData
+	if s.name == CHANGEFEED {
+		readData = m.sm.changefeedReader(m.r, subscriber)
+	}
+	totalWrites := 0
+	for {
+		data, eof := readData()
+		if m.ctx.Err() != nil {
+			return 0, false
+		}
+		if len(data) > 0 {
+			if totalWrites <= 0 {
+				info := segment.info()
+				header.Status = http.StatusOK
+				header.Seq = segment.idx
+				header.Latest = latestSeq
+				header.ContentType = s.mimeType
+				header.Created = formatTrickleTime(info.firstByte)
+				header.Epoch = info.epoch
+				header.Discontinuity = info.discontinuity
+				if err := m.writeJSON(header); err != nil {
+					return 0, false
+				}
+			}
+			if err := m.writeTagged(frameData, id, data); err != nil {
+				slog.Error("Error sending data to mux subscriber", "stream", s.name, "idx", segment.idx, "sentBytes", totalWrites, "err", err)
+				return 0, false
+			}
+			totalWrites += len(data)
+		}
+		if !eof {
+			continue
+		}
+		if totalWrites > 0 {
+			var end []byte
+			if segment.info().aborted {
+				end = []byte(socketAborted)
+			}
+			return segment.idx + 1, m.writeTagged(frameEnd, id, end) == nil
+		}
+		// nothing was sent; check if the channel was closed
+		s.mutex.RLock()
+		closed := s.closed
+		latestSeq := s.nextWrite
+		s.mutex.RUnlock()
+		header.Seq, header.Latest = segment.idx, latestSeq
+		if closed {
+			header.Status, header.Closed = http.StatusOK, true
+			m.writeJSON(header)
+			return 0, false
+		}
+		if latestSeq == segment.idx {
+			// cancelled before it started; give the publisher a
+			// moment to retry rather than spin on the closed segment
+			select {
+			case <-m.ctx.Done():
+			case <-s.clock.After(muxRetryInterval):
+			}
+			return segment.idx, true
+		}
+		header.Status = 470
+		return latestSeq, m.writeJSON(header) == nil
+	}
+}
+
+func (m *muxSubscription) writeJSON(header *muxHeader) error {
+	jb, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	return m.writeFrame(frameResponse, jb)
+}
+
+func (m *muxSubscription) writeTagged(frameType byte, id uint32, data []byte) error {
+	payload := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	copy(payload[4:], data)
+	return m.writeFrame(frameType, payload)
+}
+
+func (m *muxSubscription) writeFrame(frameType byte, payload []byte) error {
+	m.mu.Lock()
+	done := m.done
+	m.mu.Unlock()
+	if done {
+		return errors.New("subscription ended")
+	}
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := writeFrame(m.w, frameType, payload); err != nil {
+		return err
+	}
+	m.flusher.Flush()
+	return nil
+}
+
+// TrickleMuxSubscriber follows several channels over a single request and
+// demultiplexes their segments into a MuxChannel per channel. Segments
+// are buffered until read, up to a limit per channel, so read every
+// channel that is followed.
+type TrickleMuxSubscriber struct {
+	resp *http.Response
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	channels map[string]*MuxChannel
+	ids      map[uint32]*MuxChannel
+	accepts  []*MuxChannel // seen but not returned from Channel or Accept
+	err      error
+}
+
+// MuxChannel reads the segments of one channel of a TrickleMuxSubscriber
+type MuxChannel struct {
+	Name string
+
+	sub      *TrickleMuxSubscriber
+	queue    []muxItem
+	current  *muxBuffer // segment being received
+	accepted bool
+	backlog  atomic.Int64 // bytes received but not read yet
+}
+
+type muxItem struct {
+	data *TrickleData
+	buf  *muxBuffer
+	err  error
+}
+
+// NewTrickleMuxSubscriber subscribes to the channels selected by req on the
+// trickle server at url, eg http://localhost:2939/
+func NewTrickleMuxSubscriber(url string, req MuxRequest) (*TrickleMuxSubscriber, error) {
+	jb, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient().Post(strings.TrimSuffix(url, "/")+"/"+SUBSCRIBE, "application/json", bytes.NewReader(jb))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, &HTTPError{Code: resp.StatusCode, Body: string(body)}
+	}
+	return newMuxSubscriber(resp), nil
+}
+
+// Demultiplexes the response body until it ends
+func newMuxSubscriber(resp *http.Response) *TrickleMuxSubscriber {
+	c := &TrickleMuxSubscriber{
+		resp:     resp,
+		channels: map[string]*MuxChannel{},
+		ids:      map[uint32]*MuxChannel{},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.demux()
+	return c
+}
+
+// Channel returns the reader for the named channel
+func (c *TrickleMuxSubscriber) Channel(name string) *MuxChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := c.channel(name)
+	if !ch.accepted {
+		ch.accepted = true
+		c.accepts = slices.DeleteFunc(c.accepts, func(a *MuxChannel) bool { return a == ch })
+	}
+	return ch
+}
+
+// Accept waits for a channel that has not been returned from Channel or
+// Accept yet, eg one matching a prefix that was created after subscribing
+func (c *TrickleMuxSubscriber) Accept() (*MuxChannel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.accepts) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(c.accepts) == 0 {
+		return nil, c.err
+	}
+	ch := c.accepts[0]
+	c.accepts = c.accepts[1:]
+	ch.accepted = true
+	return ch, nil
+}
+
+// Close ends the subscription
+func (c *TrickleMuxSubscriber) Close() error {
+	return c.resp.Body.Close()
+}
+
+// Read returns the channel's next segment. Returns SequenceNonexistent
+// if the subscription skipped segments to catch up with the channel and
+// EOS if the channel was closed; later reads pick up again if a channel
+// of the same name is created.
+func (ch *MuxChannel) Read() (*TrickleData, error) {
+	c := ch.sub
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(ch.queue) == 0 && c.err == nil {
+		c.cond.Wait()
+	}
+	if len(ch.queue) == 0 {
+		return nil, c.err
+	}
+	item := ch.queue[0]
+	ch.queue = ch.queue[1:]
+	return item.data, item.err
+}
+
+// needs c.mu
+func (c *TrickleMuxSubscriber) channel(name string) *MuxChannel {
+	ch, ok := c.channels[name]
+	if !ok {
+		ch = &MuxChannel{Name: name, sub: c}
+		c.channels[name] = ch
+	}
+	return ch
+}
+
+func (c *TrickleMuxSubscriber) demux() {
+	reader := bufio.NewReader(c.resp.Body)
+	var err error
+	for err == nil {
+		var frameType byte
+		var payload []byte
+		frameType, payload, err = readFrame(reader)
+		if err != nil {
+			break
+		}
+		switch frameType {
+		case frameResponse:
+			var h muxHeader
+			if err = json.Unmarshal(payload, &h); err == nil {
+				c.handleHeader(&h)
+			}
+		case frameData, frameEnd:
+			if len(payload) < 4 {
+				err = errors.New("short mux frame")
+				break
+			}
+			c.mu.Lock()
+			ch := c.ids[binary.BigEndian.Uint32(payload)]
+			c.mu.Unlock()
+			if ch == nil || ch.current == nil {
+				err = errors.New("mux frame for unknown segment")
+				break
+			}
+			if frameType == frameData {
+				if ch.backlog.Load()+int64(len(payload)-4) > maxMuxBacklogBytes {
+					c.mu.Lock()
+					c.dropBacklog(ch)
+					c.mu.Unlock()
+				}
+				ch.current.Write(payload[4:])
+			} else {
+				var end error
+				if string(payload[4:]) == socketAborted {
+					end = ErrSegmentAborted
+				}
+				ch.current.closeWithError(end)
+				ch.current = nil
+			}
+		}
+	}
+	if err == io.EOF {
+		err = EOS
+	}
+	c.resp.Body.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+	for _, ch := range c.channels {
+		if ch.current != nil {
+			ch.current.closeWithError(err)
+		}
+	}
+	c.cond.Broadcast()
+}
+
+func (c *TrickleMuxSubscriber) handleHeader(h *muxHeader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, seen := c.channels[h.Channel]
+	if !seen {
+		ch = c.channel(h.Channel)
+	}
+	if !ch.accepted && !slices.Contains(c.accepts, ch) {
+		c.accepts = append(c.accepts, ch)
+	}
+	c.ids[h.ID] = ch
+	if len(ch.queue) >= maxMuxBacklogSegments {
+		c.dropBacklog(ch)
+	}
+	var item muxItem
+	switch {
+	case h.Closed:
+		item.err = EOS
+	case h.Status == 470:
+		item.err = &SequenceNonexistent{Seq: h.Seq, Latest: h.Latest}
+	default:
+		ch.current = newMuxBuffer(&ch.backlog)
+		metadata := map[string]string{
+			"Lp-Trickle-Latest":  strconv.Itoa(h.Latest),
+			"Lp-Trickle-Seq":     strconv.Itoa(h.Seq),
+			"Lp-Trickle-Epoch":   strconv.Itoa(h.Epoch),
+			"Lp-Trickle-Created": h.Created,
+			"Content-Type":       h.ContentType,
+		}
+		if h.Discontinuity {
+			metadata["Lp-Trickle-Discontinuity"] = "true"
+		}
+		item.data = &TrickleData{Reader: ch.current, Metadata: metadata}
+		item.buf = ch.current
+	}
+	ch.queue = append(ch.queue, item)
+	c.cond.Broadcast()
+}
+
+// Drops everything the channel has received but not read, leaving
+// an error in its place. needs c.mu
+func (c *TrickleMuxSubscriber) dropBacklog(ch *MuxChannel) {
+	if len(ch.queue) != 1 || ch.queue[0].err != ErrMuxOverflow {
+		slog.Warn("Dropping mux channel backlog", "channel", ch.Name, "segments", len(ch.queue), "bytes", ch.backlog.Load())
+	}
+	for _, item := range ch.queue {
+		if item.buf != nil {
+			item.buf.drop()
+		}
+	}
+	if ch.current != nil {
+		// also covers a segment the reader is partway through
+		ch.current.drop()
+	}
+	ch.queue = []muxItem{{err: ErrMuxOverflow}}
+	c.cond.Broadcast()
+}
+
+// Buffer for a segment being received, so one slow channel does not
+// hold up the others. Its size counts towards the channel's backlog.
+type muxBuffer struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	backlog *atomic.Int64
+	done    bool
+	err     error
+}
+
+func newMuxBuffer(backlog *atomic.Int64) *muxBuffer {
+	b := &muxBuffer{backlog: backlog}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *muxBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		// dropped; discard the rest of the segment
+		return len(p), nil
+	}
+	b.buf.Write(p)
+	b.backlog.Add(int64(len(p)))
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+func (b *muxBuffer) closeWithError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.done {
+		return
+	}
+	b.done, b.err = true, err
+	b.cond.Broadcast()
+}
+
+// Discards the buffered data and fails any further reads
+func (b *muxBuffer) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.backlog.Add(-int64(b.buf.Len()))
+	b.buf.Reset()
+	b.done, b.err = true, ErrMuxOverflow
+	b.cond.Broadcast()
+}
+
+func (b *muxBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.buf.Len() == 0 && !b.done {
+		b.cond.Wait()
+	}
+	if b.buf.Len() > 0 {
+		n, err := b.buf.Read(p)
+		b.backlog.Add(-int64(n))
+		return n, err
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return 0, io.EOF
+}
@@ -0,0 +1,101 @@
+package trickle
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func setMuxBacklog(t *testing.T, bytes int64, segments int) {
+	t.Helper()
+	origBytes, origSegments := maxMuxBacklogBytes, maxMuxBacklogSegments
+	maxMuxBacklogBytes, maxMuxBacklogSegments = bytes, segments
+	t.Cleanup(func() { maxMuxBacklogBytes, maxMuxBacklogSegments = origBytes, origSegments })
+}
+
+// Feeds the segments of one channel to a mux subscriber and returns it
+// once everything has been demultiplexed
+func muxFeed(t *testing.T, segments ...[]string) *TrickleMuxSubscriber {
+	t.Helper()
+	pr, pw := io.Pipe()
+	c := newMuxSubscriber(&http.Response{Body: pr})
+	t.Cleanup(func() { c.Close() })
+	tagged := func(frameType byte, data string) {
+		payload := binary.BigEndian.AppendUint32(nil, 1)
+		if err := writeFrame(pw, frameType, append(payload, data...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for seq, chunks := range segments {
+		jb, _ := json.Marshal(&muxHeader{ID: 1, Channel: "backlog", Status: http.StatusOK, Seq: seq})
+		if err := writeFrame(pw, frameResponse, jb); err != nil {
+			t.Fatal(err)
+		}
+		for _, chunk := range chunks {
+			tagged(frameData, chunk)
+		}
+		tagged(frameEnd, "")
+	}
+	pw.Close()
+	c.mu.Lock()
+	for c.err == nil {
+		c.cond.Wait()
+	}
+	c.mu.Unlock()
+	return c
+}
+
+func readMuxSegment(t *testing.T, ch *MuxChannel) (string, error) {
+	t.Helper()
+	seg, err := ch.Read()
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(seg.Reader)
+	return seg.Metadata["Lp-Trickle-Seq"] + ":" + string(data), err
+}
+
+func TestMux_BacklogBytes(t *testing.T) {
+	setMuxBacklog(t, 1000, 10)
+	big := strings.Repeat("x", 600)
+	c := muxFeed(t, []string{big, big, big}, []string{"after"})
+	ch := c.Channel("backlog")
+
+	// the segment that went over is dropped along with the rest of
+	// the backlog, and the channel carries on after
+	if _, err := readMuxSegment(t, ch); !errors.Is(err, ErrMuxOverflow) {
+		t.Fatalf("expected overflow, got %v", err)
+	}
+	if data, err := readMuxSegment(t, ch); err != nil || data != "1:after" {
+		t.Errorf("unexpected segment %q %v", data, err)
+	}
+	if n := ch.backlog.Load(); n != 0 {
+		t.Errorf("unexpected backlog of %d bytes", n)
+	}
+}
+
+func TestMux_BacklogSegments(t *testing.T) {
+	setMuxBacklog(t, 1000, 4)
+	var segments [][]string
+	for i := 0; i < 6; i++ {
+		segments = append(segments, []string{"seg"})
+	}
+	// nobody accepts or reads the channel while it arrives
+	c := muxFeed(t, segments...)
+	ch, err := c.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMuxSegment(t, ch); !errors.Is(err, ErrMuxOverflow) {
+		t.Fatalf("expected overflow, got %v", err)
+	}
+	for _, want := range []string{"4:seg", "5:seg"} {
+		if data, err := readMuxSegment(t, ch); err != nil || data != want {
+			t.Errorf("unexpected segment %q %v, expected %q", data, err, want)
+		}
+	}
+}
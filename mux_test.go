@@ -0,0 +1,263 @@
+package trickle_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func readMux(t *testing.T, ch *trickle.MuxChannel) (string, string) {
+	t.Helper()
+	seg, err := ch.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(seg.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seg.Metadata["Lp-Trickle-Seq"], string(data)
+}
+
+func TestMux_Channels(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, MuxSubscribe: true})
+	pubs := map[string]*trickle.TricklePublisher{}
+	for _, name := range []string{"m1", "m2", "m3"} {
+		pubs[name] = ts.Publisher(t, name)
+	}
+	trickletest.Publish(t, pubs["m2"], "before")
+
+	sub, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{
+		Channels: []string{"m1", "m2"},
+		Seqs:     map[string]int{"m2": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "m1").Subscribers >= 1 })
+
+	// segments of both channels arrive over the one response
+	trickletest.Publish(t, pubs["m1"], "one")
+	trickletest.Publish(t, pubs["m2"], "two")
+	trickletest.Publish(t, pubs["m3"], "not followed")
+	m1, m2 := sub.Channel("m1"), sub.Channel("m2")
+	if seq, data := readMux(t, m1); seq != "0" || data != "one" {
+		t.Errorf("unexpected m1 segment %s %q", seq, data)
+	}
+	if seq, data := readMux(t, m2); seq != "0" || data != "before" {
+		t.Errorf("unexpected m2 segment %s %q", seq, data)
+	}
+	if seq, data := readMux(t, m2); seq != "1" || data != "two" {
+		t.Errorf("unexpected m2 segment %s %q", seq, data)
+	}
+
+	// closing one channel leaves the others going
+	if err := pubs["m1"].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m1.Read(); !errors.Is(err, trickle.EOS) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+	trickletest.Publish(t, pubs["m2"], "three")
+	if seq, data := readMux(t, m2); seq != "2" || data != "three" {
+		t.Errorf("unexpected m2 segment %s %q", seq, data)
+	}
+}
+
+func TestMux_Prefix(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, Changefeed: true, MuxSubscribe: true})
+	sub, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{Prefixes: []string{"dash-"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	// channels created later are picked up from their first segment
+	other := ts.Publisher(t, "other")
+	pub := ts.Publisher(t, "dash-cpu")
+	trickletest.Publish(t, other, "ignored")
+	trickletest.Publish(t, pub, "first", "second")
+	ch, err := sub.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.Name != "dash-cpu" {
+		t.Fatalf("unexpected channel %s", ch.Name)
+	}
+	for i, want := range []string{"first", "second"} {
+		if seq, data := readMux(t, ch); seq != fmt.Sprint(i) || data != want {
+			t.Errorf("unexpected segment %s %q", seq, data)
+		}
+	}
+	if info := ts.Info(t, "other"); info.Subscribers != 0 {
+		t.Errorf("unexpected subscribers %+v", info)
+	}
+}
+
+func TestMux_Gap(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, MuxSubscribe: true})
+	pub := ts.Publisher(t, "gappy")
+	for i := 0; i < 7; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+
+	// starting outside the window skips ahead to the live edge
+	sub, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{
+		Channels: []string{"gappy"},
+		Seqs:     map[string]int{"gappy": 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	ch := sub.Channel("gappy")
+	var nonexistent *trickle.SequenceNonexistent
+	if _, err := ch.Read(); !errors.As(err, &nonexistent) || nonexistent.Latest != 7 {
+		t.Fatalf("expected 470, got %v", err)
+	}
+	trickletest.Publish(t, pub, "live")
+	if seq, data := readMux(t, ch); seq != "7" || data != "live" {
+		t.Errorf("unexpected segment %s %q", seq, data)
+	}
+}
+
+func TestMux_InvalidRequest(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{MuxSubscribe: true})
+	for _, body := range []string{"", "{}", "not json"} {
+		resp, err := http.Post(ts.URL+"/"+trickle.SUBSCRIBE, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected 400, got %d", body, resp.StatusCode)
+		}
+	}
+	if _, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{}); err == nil {
+		t.Error("expected error for an empty subscription")
+	}
+}
+
+func TestMux_Authorize(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:        true,
+		Changefeed:        true,
+		HierarchicalNames: true,
+		MuxSubscribe:      true,
+		Prefixes: map[string]trickle.PrefixConfig{
+			"private/": {Authorize: func(r *http.Request, channel string) bool {
+				return r.Header.Get("Authorization") == "Bearer "+channel
+			}},
+		},
+	})
+
+	// channels asked for by name must all be authorized
+	_, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{Channels: []string{"public", "private/a"}})
+	var httpErr *trickle.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %v", err)
+	}
+
+	// while prefixes and the changefeed skip the ones that are not
+	sub, err := trickle.NewTrickleMuxSubscriber(ts.URL, trickle.MuxRequest{
+		Prefixes: []string{"private/", "public"},
+		Channels: []string{trickle.CHANGEFEED},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, trickle.CHANGEFEED).Subscribers >= 1 })
+	req, _ := http.NewRequest("POST", ts.ChannelURL("private/a"), nil)
+	req.Header.Set("Authorization", "Bearer private/a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	trickletest.Publish(t, ts.Publisher(t, "public"), "data")
+
+	changes := sub.Channel(trickle.CHANGEFEED)
+	for data := ""; !strings.Contains(data, `"public"`); {
+		if _, data = readMux(t, changes); strings.Contains(data, "private/a") {
+			t.Errorf("unauthorized channel in the changefeed %s", data)
+		}
+	}
+	if seq, data := readMux(t, sub.Channel("public")); seq != "0" || data != "data" {
+		t.Errorf("unexpected segment %s %q", seq, data)
+	}
+
+	// and the endpoint is off unless enabled
+	plain := trickletest.NewServer(t, trickle.TrickleServerConfig{})
+	if _, err := trickle.NewTrickleMuxSubscriber(plain.URL, trickle.MuxRequest{Channels: []string{"public"}}); err == nil {
+		t.Error("expected error without mux subscriptions enabled")
+	}
+}
+
+func TestMux_PingInterval(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		MuxSubscribe:       true,
+		MuxPingInterval:    time.Second,
+		FirstByteKeepalive: time.Hour,
+		Clock:              clock,
+	})
+	pending := clock.Pending()
+	resp, err := http.Post(ts.URL+"/"+trickle.SUBSCRIBE, "application/json", strings.NewReader(`{"prefixes":["idle-"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	trickletest.WaitFor(t, func() bool { return clock.Pending() > pending })
+
+	// pinged on its own interval, not the POST keepalive one
+	clock.Advance(time.Second)
+	ping := make([]byte, 5)
+	if _, err := io.ReadFull(resp.Body, ping); err != nil {
+		t.Fatal(err)
+	}
+	if string(ping) != "P\x00\x00\x00\x00" {
+		t.Errorf("unexpected frame %q", ping)
+	}
+}
+
+func TestMux_StalledClient(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, MuxSubscribe: true})
+	pub := ts.Publisher(t, "stall-big")
+
+	// subscribe without ever reading the response
+	resp, err := http.Post(ts.URL+"/"+trickle.SUBSCRIBE, "application/json", strings.NewReader(`{"prefixes":["stall-"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "stall-big").Subscribers >= 1 })
+
+	// more than the connection buffers, so sending it stalls
+	trickletest.Publish(t, pub, strings.Repeat("x", 32<<20))
+
+	// which does not hold up new channels for the subscription
+	done := make(chan error, 1)
+	go func() {
+		pub, err := trickle.NewTricklePublisher(ts.ChannelURL("stall-new"))
+		if err == nil {
+			err = pub.Create()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("creating a channel was blocked by the stalled subscriber")
+	}
+}
@@ -0,0 +1,318 @@
+package trickle
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Hierarchical channel names: with HierarchicalNames set, names may
+// contain slashes, eg session/123/in, to group channels under common
+// prefixes. Since the channel name can span several path elements, a
+// reserved - element separates it from the rest of the URL:
+//
+//	POST   /session/123/in/-          create the channel
+//	POST   /session/123/in/-/0        publish seq 0
+//	GET    /session/123/in/-/info     and so on for the other routes
+//
+// So the channel URL for clients is the name followed by /-, to which
+// they append the usual suffixes. The first - element always ends the
+// name, so names may not contain one. Single element names can be used
+// with or without the separator. Two element names may not end in hls,
+// dash or batch, since eg /cam/hls/- is a file of the cam channel's
+// HLS gateway.
+//
+// Prefix operations live under {prefix}/-/channels, or /-/channels for
+// every channel: GET lists the channels below the prefix and DELETE
+// closes all of them. The changefeed can also be filtered by prefix
+// with the prefix query param.
+
+const channelSeparator = "-"
+
+// Second elements of two element names that the {name}/{x}/{file} routes
+// would take over
+var reservedElements = []string{"hls", "dash", "batch"}
+
+// Whether remote clients may create a channel with this name
+func (sm *Server) validName(name string) bool {
+	if !sm.config.HierarchicalNames {
+		return true
+	}
+	elements := strings.Split(name, "/")
+	if len(elements) == 2 && slices.Contains(reservedElements, elements[1]) {
+		return false
+	}
+	return !slices.Contains(elements, channelSeparator)
+}
+
+// ChannelURL returns the URL clients should use for the named channel on
+// the server at base, adding the separator for hierarchical names
+func ChannelURL(base, name string) string {
+	url := strings.TrimSuffix(base, "/") + "/" + name
+	if strings.Contains(name, "/") {
+		url += "/" + channelSeparator
+	}
+	return url
+}
+
+// PrefixConfig overrides server settings for channels whose names start
+// with a given prefix, eg "session/". The longest matching prefix applies.
+type PrefixConfig struct {
+	// Amount of time a channel has no new segments before being swept
+	// (default the server's IdleTimeout)
+	IdleTimeout time.Duration
+
+	// Decides whether an HTTP request for a channel may go ahead, or
+	// a socket request, see socket_server.go. Rejected requests get a
+	// 403 and channels the request may not see are left out of
+	// listings, the changefeed and multiplexed subscriptions.
+	// (default allow everything)
+	Authorize func(r *http.Request, channel string) bool
+}
+
+// Returns the config for the longest prefix of name, if any
+func (sm *Server) prefixConfig(name string) (PrefixConfig, bool) {
+	var (
+		best   PrefixConfig
+		length = -1
+	)
+	for prefix, pc := range sm.config.Prefixes {
+		if strings.HasPrefix(name, prefix) && len(prefix) > length {
+			best, length = pc, len(prefix)
+		}
+	}
+	return best, length >= 0
+}
+
+func (sm *Server) idleTimeout(name string) time.Duration {
+	if pc, ok := sm.prefixConfig(name); ok && pc.IdleTimeout > 0 {
+		return pc.IdleTimeout
+	}
+	return sm.config.IdleTimeout
+}
+
+func (sm *Server) authorized(r *http.Request, name string) bool {
+	pc, ok := sm.prefixConfig(name)
+	return !ok || pc.Authorize == nil || pc.Authorize(r, name)
+}
+
+// Rejects requests for channels the prefix config does not authorize
+func (sm *Server) authorize(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !sm.authorized(r, r.PathValue("streamName")) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Routes URLs for hierarchical names to the regular handlers
+func (sm *Server) handleNested(w http.ResponseWriter, r *http.Request) {
+	// the name ends at the first separator
+	path := strings.Split(r.PathValue("first")+"/"+r.PathValue("second")+"/"+r.PathValue("rest"), "/")
+	sep := slices.Index(path, channelSeparator)
+	if sep < 0 {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	name, rest := strings.Join(path[:sep], "/"), strings.Join(path[sep+1:], "/")
+	if name == "" {
+		http.Error(w, "Invalid channel name", http.StatusBadRequest)
+		return
+	}
+	r.SetPathValue("streamName", name)
+
+	var h http.HandlerFunc
+	elems := strings.Split(rest, "/")
+	switch {
+	case rest == "":
+		switch r.Method {
+		case http.MethodPost:
+			h = sm.handleCreate
+		case http.MethodDelete:
+			h = sm.handleDelete
+		case http.MethodHead:
+			h = sm.handleHeadChannel
+		}
+	case rest == "channels":
+		// name is a prefix here rather than a channel
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			sm.listChannels(w, r, name+"/")
+			return
+		case http.MethodDelete:
+			sm.deleteChannels(w, r, name+"/")
+			return
+		}
+	case len(elems) == 1:
+		switch rest {
+		case "info":
+			h = methodHandler(r, http.MethodGet, sm.handleInfo)
+		case "init":
+			h = methodHandler(r, http.MethodGet, sm.handleGetInit)
+			if r.Method == http.MethodPost {
+				h = sm.handlePostInit
+			}
+		case "epoch":
+			h = methodHandler(r, http.MethodPost, sm.handleNewEpoch)
+		case "ws":
+			if sm.config.WebSocket {
+				h = methodHandler(r, http.MethodGet, sm.handleWebSocket)
+			}
+		default:
+			r.SetPathValue("idx", rest)
+			switch r.Method {
+			case http.MethodGet, http.MethodHead:
+				h = sm.handleGet
+			case http.MethodPost:
+				h = sm.handlePost
+			case http.MethodDelete:
+				h = sm.closeSeq
+			}
+		}
+	case len(elems) == 2:
+		switch {
+		case elems[0] == "batch":
+			r.SetPathValue("idx", elems[1])
+			h = methodHandler(r, http.MethodGet, sm.handleBatch)
+		case elems[0] == "hls" && sm.config.HLS:
+			r.SetPathValue("file", elems[1])
+			h = methodHandler(r, http.MethodGet, sm.handleHLS)
+		case elems[0] == "dash" && sm.config.DASH:
+			r.SetPathValue("file", elems[1])
+			h = methodHandler(r, http.MethodGet, sm.handleDASH)
+		}
+	}
+	if h == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	sm.authorize(h)(w, r)
+}
+
+// Returns h if the request is for method, GET also covering HEAD
+func methodHandler(r *http.Request, method string, h http.HandlerFunc) http.HandlerFunc {
+	if r.Method == method || (method == http.MethodGet && r.Method == http.MethodHead) {
+		return h
+	}
+	return nil
+}
+
+// Names of the channels under prefix that the request may see
+func (sm *Server) channelsWithPrefix(r *http.Request, prefix string) []string {
+	sm.mutex.RLock()
+	names := slices.Sorted(maps.Keys(sm.streams))
+	sm.mutex.RUnlock()
+	return slices.DeleteFunc(names, func(name string) bool {
+		return !strings.HasPrefix(name, prefix) || !sm.authorized(r, name)
+	})
+}
+
+func (sm *Server) handleListAll(w http.ResponseWriter, r *http.Request) {
+	sm.listChannels(w, r, "")
+}
+
+func (sm *Server) handleDeleteAll(w http.ResponseWriter, r *http.Request) {
+	sm.deleteChannels(w, r, "")
+}
+
+func (sm *Server) listChannels(w http.ResponseWriter, r *http.Request, prefix string) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm.channelsWithPrefix(r, prefix))
+}
+
+// Closes every channel under the prefix, responding with their names
+func (sm *Server) deleteChannels(w http.ResponseWriter, r *http.Request, prefix string) {
+	deleted := []string{}
+	for _, name := range sm.channelsWithPrefix(r, prefix) {
+		if strings.HasPrefix(name, "_") {
+			continue // internal channels, eg changefeed
+		}
+		if err := sm.closeStream(name); err != nil {
+			slog.Warn("Could not close channel", "channel", name, "err", err)
+			continue
+		}
+		deleted = append(deleted, name)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deleted)
+}
+
+// Leaves out the channels in a changefeed segment that the request may
+// not see or that are not under the prefix
+func (sm *Server) filterChangefeed(r *http.Request, prefix string, body []byte) []byte {
+	var cf Changefeed
+	if len(body) == 0 || json.Unmarshal(body, &cf) != nil {
+		return body
+	}
+	keep := func(names []string) []string {
+		return slices.DeleteFunc(names, func(name string) bool {
+			return !strings.HasPrefix(name, prefix) || !sm.authorized(r, name)
+		})
+	}
+	cf.Added, cf.Removed = keep(cf.Added), keep(cf.Removed)
+	cf.Watched, cf.Unwatched = keep(cf.Watched), keep(cf.Unwatched)
+	body, _ = json.Marshal(&cf)
+	return body
+}
+
+// Reads a changefeed segment as a whole, filtered like changefeed GETs,
+// for transports that stream segments as they are read
+func (sm *Server) changefeedReader(r *http.Request, subscriber *SegmentSubscriber) func() ([]byte, bool) {
+	return func() ([]byte, bool) {
+		var body []byte
+		for {
+			data, eof := subscriber.readData()
+			body = append(body, data...)
+			if eof {
+				return sm.filterChangefeed(r, "", body), true
+			}
+		}
+	}
+}
+
+// Buffers a changefeed segment so it can be filtered down to the
+// channels the request is authorized for, and to those under a prefix
+// if it is set. The segment's size and digest no longer apply to the
+// filtered body, so those are dropped.
+type changefeedFilter struct {
+	http.ResponseWriter
+	sm     *Server
+	r      *http.Request
+	prefix string
+	status int
+	buf    bytes.Buffer
+}
+
+func (f *changefeedFilter) WriteHeader(status int) { f.status = status }
+func (f *changefeedFilter) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+func (f *changefeedFilter) Flush() {}
+
+func (f *changefeedFilter) finish() {
+	if f.status == 0 {
+		f.status = http.StatusOK
+	}
+	body := f.buf.Bytes()
+	if f.status == http.StatusOK {
+		body = f.sm.filterChangefeed(f.r, f.prefix, body)
+	}
+	h := f.Header()
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(h, k)
+		}
+	}
+	h.Del("Trailer")
+	h.Del("Lp-Trickle-Bytes")
+	h.Del("Lp-Trickle-Digest")
+	f.ResponseWriter.WriteHeader(f.status)
+	f.ResponseWriter.Write(body)
+}
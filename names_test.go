@@ -0,0 +1,344 @@
+package trickle_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func getJSON(t *testing.T, method, url string, v any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestNames_Hierarchical(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, HierarchicalNames: true})
+	if url := ts.ChannelURL("session/1/in"); url != ts.URL+"/session/1/in/-" {
+		t.Fatalf("unexpected channel URL %s", url)
+	}
+
+	// the usual clients work with the channel URL
+	in, out := ts.Publisher(t, "session/1/in"), ts.Publisher(t, "session/1/out")
+	trickletest.Publish(t, in, "in 0")
+	trickletest.Publish(t, out, "out 0", "out 1")
+	if seq, data := trickletest.Read(t, ts.Subscriber("session/1/in", 0)); seq != 0 || data != "in 0" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	if seq, data := trickletest.Read(t, ts.Subscriber("session/1/out", -2)); seq != 1 || data != "out 1" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	if info := ts.Info(t, "session/1/out"); info.Name != "session/1/out" || info.Latest != 2 {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if probe, err := ts.Subscriber("session/1/in", 0).Probe(0); err != nil || !probe.Complete {
+		t.Errorf("unexpected probe %+v %v", probe, err)
+	}
+
+	// single element names work either way
+	plain, err := trickle.NewTricklePublisher(ts.URL + "/plain/-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Create(); err != nil {
+		t.Fatal(err)
+	}
+	trickletest.Publish(t, plain, "plain")
+	sub := trickle.NewTrickleSubscriber(ts.URL + "/plain/-")
+	sub.SetSeq(0)
+	if seq, data := trickletest.Read(t, sub); seq != 0 || data != "plain" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	if _, data := trickletest.Read(t, ts.Subscriber("plain", -2)); data != "plain" {
+		t.Errorf("unexpected segment %q", data)
+	}
+
+	// deleting one channel leaves its siblings alone
+	if err := in.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Subscriber("session/1/in", 0).Info(); !errors.Is(err, trickle.StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+	ts.Info(t, "session/1/out")
+
+	// without the separator there is no channel to find
+	if status := getJSON(t, "GET", ts.URL+"/session/1/out/0", nil); status != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", status)
+	}
+}
+
+func TestNames_PrefixOperations(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, HierarchicalNames: true})
+	for _, name := range []string{"session/1/in", "session/1/out", "session/2/in", "session/10/in", "other"} {
+		ts.Publisher(t, name)
+	}
+
+	var names []string
+	getJSON(t, "GET", ts.URL+"/session/1/-/channels", &names)
+	if !slices.Equal(names, []string{"session/1/in", "session/1/out"}) {
+		t.Errorf("unexpected channels %v", names)
+	}
+	getJSON(t, "GET", ts.URL+"/-/channels", &names)
+	if len(names) != 5 {
+		t.Errorf("unexpected channels %v", names)
+	}
+
+	// bulk delete only takes out the channels under the prefix
+	var deleted []string
+	if status := getJSON(t, "DELETE", ts.URL+"/session/1/-/channels", &deleted); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if !slices.Equal(deleted, []string{"session/1/in", "session/1/out"}) {
+		t.Errorf("unexpected deletions %v", deleted)
+	}
+	getJSON(t, "GET", ts.URL+"/session/-/channels", &names)
+	if !slices.Equal(names, []string{"session/10/in", "session/2/in"}) {
+		t.Errorf("unexpected channels %v", names)
+	}
+}
+
+func TestNames_ChangefeedFilter(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, Changefeed: true, HierarchicalNames: true})
+	ts.Publisher(t, "other")
+	ts.Publisher(t, "session/1/in")
+
+	// changes to other channels are filtered out but keep their seq
+	read := func(seq string) trickle.Changefeed {
+		resp, err := http.Get(ts.URL + "/" + trickle.CHANGEFEED + "/" + seq + "?prefix=session/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var ch trickle.Changefeed
+		if err := json.Unmarshal(body, &ch); err != nil {
+			t.Fatalf("%s: %v %q", seq, err, body)
+		}
+		if resp.Header.Get("Lp-Trickle-Seq") != seq {
+			t.Errorf("unexpected seq %v", resp.Header)
+		}
+		return ch
+	}
+	if ch := read("1"); len(ch.Added) != 0 {
+		t.Errorf("unexpected change %+v", ch)
+	}
+	if ch := read("2"); !slices.Equal(ch.Added, []string{"session/1/in"}) {
+		t.Errorf("unexpected change %+v", ch)
+	}
+}
+
+func TestNames_ChangefeedAuthorize(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:        true,
+		Changefeed:        true,
+		HierarchicalNames: true,
+		Prefixes: map[string]trickle.PrefixConfig{
+			"private/": {Authorize: func(r *http.Request, channel string) bool {
+				return r.Header.Get("Authorization") == "Bearer "+channel
+			}},
+		},
+	})
+	req, _ := http.NewRequest("POST", ts.ChannelURL("private/a"), nil)
+	req.Header.Set("Authorization", "Bearer private/a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ts.Publisher(t, "public")
+
+	// reads everything added so far, without a prefix
+	added := func(auth string) []string {
+		names := []string{}
+		for seq := 0; !slices.Contains(names, "public"); seq++ {
+			req, _ := http.NewRequest("GET", ts.URL+"/"+trickle.CHANGEFEED+"/"+strconv.Itoa(seq), nil)
+			req.Header.Set("Authorization", auth)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ch trickle.Changefeed
+			err = json.NewDecoder(resp.Body).Decode(&ch)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("%d: %v", seq, err)
+			}
+			names = append(names, ch.Added...)
+		}
+		return names
+	}
+	if names := added(""); slices.Contains(names, "private/a") {
+		t.Errorf("unauthorized channel in the changefeed %v", names)
+	}
+	if names := added("Bearer private/a"); !slices.Contains(names, "private/a") {
+		t.Errorf("authorized channel missing from the changefeed %v", names)
+	}
+}
+
+func TestNames_PrefixConfig(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:        true,
+		HierarchicalNames: true,
+		Clock:             clock,
+		Prefixes: map[string]trickle.PrefixConfig{
+			"scratch/": {IdleTimeout: 30 * time.Second},
+			"private/": {Authorize: func(r *http.Request, channel string) bool {
+				return r.Header.Get("Authorization") == "Bearer "+channel
+			}},
+		},
+	})
+
+	// unauthorized requests are turned away and the channel is hidden
+	status := getJSON(t, "POST", ts.ChannelURL("private/a"), nil)
+	if status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", status)
+	}
+	req, _ := http.NewRequest("POST", ts.ChannelURL("private/a"), nil)
+	req.Header.Set("Authorization", "Bearer private/a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+	if status := getJSON(t, "GET", ts.ChannelURL("private/a")+"/info", nil); status != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", status)
+	}
+	var names []string
+	getJSON(t, "GET", ts.URL+"/-/channels", &names)
+	if len(names) != 0 {
+		t.Errorf("unexpected channels %v", names)
+	}
+
+	// channels under the prefix are swept sooner
+	ts.Publisher(t, "scratch/tmp")
+	ts.Publisher(t, "kept")
+	clock.Advance(time.Minute)
+	trickletest.WaitFor(t, func() bool {
+		return getJSON(t, "GET", ts.ChannelURL("scratch/tmp")+"/info", nil) == http.StatusNotFound
+	})
+	ts.Info(t, "kept")
+}
+
+func TestNames_ExistingRoutes(t *testing.T) {
+	for _, tt := range []struct {
+		basePath     string
+		hierarchical bool
+	}{
+		{"/", false},
+		{"/", true},
+		{"/trickle/", true},
+	} {
+		// mounting alongside the app's own routes must not panic
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "home") })
+		mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+		srv := trickle.ConfigureServer(trickle.TrickleServerConfig{
+			Mux:               mux,
+			BasePath:          tt.basePath,
+			Autocreate:        true,
+			HierarchicalNames: tt.hierarchical,
+		})
+		ts := httptest.NewServer(mux)
+		stop := srv.Start()
+
+		get := func(path string) string {
+			resp, err := http.Get(ts.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}
+		for path, want := range map[string]string{"/": "home", "/api/status": "ok", "/other": "home"} {
+			if got := get(path); got != want {
+				t.Errorf("%s hierarchical %v: expected %q for %s, got %q", tt.basePath, tt.hierarchical, want, path, got)
+			}
+		}
+		if tt.basePath != "/" {
+			// deeper paths outside the base path are left alone too
+			if got := get("/other/page"); got != "home" {
+				t.Errorf("%s: expected home for /other/page, got %q", tt.basePath, got)
+			}
+		}
+
+		// and channels still work
+		name := "plain"
+		if tt.hierarchical {
+			name = "session/1/in"
+		}
+		url := trickle.ChannelURL(ts.URL+tt.basePath, name)
+		pub, err := trickle.NewTricklePublisher(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trickletest.Publish(t, pub, "data")
+		sub := trickle.NewTrickleSubscriber(url)
+		sub.SetSeq(0)
+		if seq, data := trickletest.Read(t, sub); seq != 0 || data != "data" {
+			t.Errorf("%s hierarchical %v: unexpected segment %d %q", tt.basePath, tt.hierarchical, seq, data)
+		}
+		stop()
+		ts.Close()
+	}
+}
+
+func TestNames_SeparatorInName(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, HierarchicalNames: true})
+
+	// the first separator ends the name, so a/-/b is not a channel name
+	if status := getJSON(t, "POST", ts.ChannelURL("a/-/b"), nil); status == http.StatusOK {
+		t.Error("expected a name with a separator element to be rejected")
+	}
+	if status := getJSON(t, "POST", ts.URL+"/-", nil); status == http.StatusOK {
+		t.Error("expected the separator to be rejected as a name")
+	}
+	var names []string
+	getJSON(t, "GET", ts.URL+"/-/channels", &names)
+	if len(names) != 0 {
+		t.Errorf("unexpected channels %v", names)
+	}
+}
+
+func TestNames_ReservedElements(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, HierarchicalNames: true, HLS: true, DASH: true})
+
+	// cam/hls/- would be a file of cam's HLS gateway
+	for _, name := range []string{"cam/hls", "cam/dash", "cam/batch"} {
+		if status := getJSON(t, "POST", ts.ChannelURL(name), nil); status == http.StatusOK {
+			t.Errorf("expected %s to be rejected", name)
+		}
+	}
+
+	// the words are fine anywhere else
+	for _, name := range []string{"hls/cam", "cam/hls/in", "cam/dashboard"} {
+		pub := ts.Publisher(t, name)
+		trickletest.Publish(t, pub, name)
+		if seq, data := trickletest.Read(t, ts.Subscriber(name, 0)); seq != 0 || data != name {
+			t.Errorf("%s: unexpected segment %d %q", name, seq, data)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package trickle_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestPreconnect_SubscribersBeforePublisher(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "early")
+
+	// several subscribers wait on the same upcoming segment
+	const subscribers = 3
+	var wg sync.WaitGroup
+	results := make([]string, subscribers)
+	for i := 0; i < subscribers; i++ {
+		sub := ts.Subscriber("early", -1)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, data := trickletest.Read(t, sub)
+			results[i] = fmt.Sprintf("%d:%s", seq, data)
+		}()
+	}
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "early").Subscribers >= subscribers })
+	trickletest.Publish(t, pub, "hello")
+	wg.Wait()
+	for i, r := range results {
+		if r != "0:hello" {
+			t.Errorf("subscriber %d got %q", i, r)
+		}
+	}
+}
+
+func TestPreconnect_Streaming(t *testing.T) {
+	for _, h2c := range []bool{false, true} {
+		t.Run(fmt.Sprintf("h2c=%v", h2c), func(t *testing.T) {
+			newServer := trickletest.NewServer
+			if h2c {
+				newServer = trickletest.NewH2CServer
+			}
+			ts := newServer(t, trickle.TrickleServerConfig{Autocreate: true})
+			pub := ts.PublisherWithConfig(t, "stream", trickle.TricklePublisherConfig{HTTP2: h2c})
+			sub := ts.SubscriberWithConfig("stream", 0, trickle.TrickleSubscriberConfig{HTTP2: h2c})
+
+			// publish faster than the window so the subscriber
+			// races its preconnects against the publisher's
+			const segments = 20
+			go func() {
+				for i := 0; i < segments; i++ {
+					seg := trickletest.SlowReader(time.Millisecond, fmt.Sprintf("seg %d ", i), "end")
+					if err := pub.Write(seg); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			for i := 0; i < segments; i++ {
+				seq, data := trickletest.Read(t, sub)
+				if seq != i || data != fmt.Sprintf("seg %d end", i) {
+					t.Fatalf("expected segment %d, got %d %q", i, seq, data)
+				}
+			}
+		})
+	}
+}
+
+func TestPreconnect_PublisherHangup(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "hangup")
+	sub := ts.Subscriber("hangup", 0)
+
+	// the preconnect for seq 1 is set up by the first write
+	ts.InjectFault(trickletest.Request("POST", "/hangup/1"), trickletest.Hangup(), 1)
+	trickletest.Publish(t, pub, "zero")
+	if seq, data := trickletest.Read(t, sub); seq != 0 || data != "zero" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	// the failed preconnect surfaces on the next write
+	if err := pub.Write(strings.NewReader("one")); err == nil {
+		t.Error("expected an error writing to the dropped preconnect")
+	}
+
+	// later segments are unaffected. Seq 1 is left pending since
+	// nothing was written to it, so skip over it
+	trickletest.Publish(t, pub, "two")
+	sub.SetSeq(2)
+	if seq, data := trickletest.Read(t, sub); seq != 2 || data != "two" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	info := ts.Info(t, "hangup")
+	if info.Latest != 3 || len(info.Segments) != 3 || info.Segments[1].Complete || info.Segments[2].Bytes != 3 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestPreconnect_SubscriberReconnects(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "drop")
+	sub := ts.Subscriber("drop", 0)
+
+	// drop the subscriber's preconnect for the next segment
+	ts.InjectFault(trickletest.Request("GET", "/drop/1"), trickletest.Hangup(), 1)
+	trickletest.Publish(t, pub, "zero")
+	trickletest.Read(t, sub)
+	trickletest.Publish(t, pub, "one")
+	for i := 0; ; i++ {
+		resp, err := sub.Read()
+		if err != nil {
+			// failed preconnects are surfaced once, then retried
+			if i > 3 {
+				t.Fatal(err)
+			}
+			continue
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != "one" {
+			t.Errorf("unexpected segment %d %q", trickle.GetSeq(resp), data)
+		}
+		break
+	}
+}
+
+func TestPreconnect_DropConnections(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "drop")
+	trickletest.Publish(t, pub, "zero")
+	ts.DropConnections()
+
+	// the dropped preconnect fails the next write but not later ones
+	trickletest.WaitFor(t, func() bool {
+		return pub.Write(strings.NewReader("again")) == nil
+	})
+	sub := ts.Subscriber("drop", -2)
+	if _, data := trickletest.Read(t, sub); data != "again" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
+
+func TestPreconnect_ServerErrors(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "errors")
+	ts.InjectFault(trickletest.Request("POST", "/errors/1"), trickletest.Status(503), 1)
+	trickletest.Publish(t, pub, "zero")
+	err := pub.Write(strings.NewReader("one"))
+	var httpErr *trickle.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Code != 503 {
+		t.Errorf("expected 503, got %v", err)
+	}
+
+	sub := ts.Subscriber("missing", 0)
+	if _, err := sub.Read(); !errors.Is(err, trickle.StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+}
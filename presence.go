@@ -0,0 +1,81 @@
+package trickle
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Subscriber presence: the server counts active GETs per channel, including
+// preconnects, and reports the count to publishers in the
+// Lp-Trickle-Subscribers header of POST responses and in the info endpoint.
+// With SubscriberEvents, the changefeed also announces channels that gain
+// their first subscriber or lose their last one, so publishers can pause
+// work while nobody is watching.
+
+// How long a channel must go without subscribers before it is announced
+// as unwatched. Smooths over gaps between a GET and its preconnect.
+var presenceGracePeriod = 5 * time.Second
+
+type presence struct {
+	mu          sync.Mutex
+	subscribers int
+	watched     bool
+	clock       Clock
+
+	// invoked when the channel becomes watched or unwatched, if set
+	onChange func(watched bool)
+}
+
+// Tracks an active subscriber; call the returned func when it is done
+func (p *presence) add() func() {
+	p.mu.Lock()
+	p.subscribers++
+	if p.onChange != nil && !p.watched {
+		p.watched = true
+		// called under the lock so events stay in order
+		p.onChange(true)
+	}
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.subscribers--
+		if p.subscribers == 0 && p.onChange != nil {
+			p.clock.AfterFunc(presenceGracePeriod, p.checkUnwatched)
+		}
+	}
+}
+
+func (p *presence) checkUnwatched() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.subscribers == 0 && p.watched && p.onChange != nil {
+		p.watched = false
+		p.onChange(false)
+	}
+}
+
+func (p *presence) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.subscribers
+}
+
+// Stops any further events, eg once the channel is deleted
+func (p *presence) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onChange = nil
+}
+
+func (sm *Server) announcePresence(streamName string, watched bool) {
+	feed := &Changefeed{Unwatched: []string{streamName}}
+	if watched {
+		feed = &Changefeed{Watched: []string{streamName}}
+	}
+	jb, _ := json.Marshal(feed)
+	sm.internalPub.Write(bytes.NewReader(jb))
+}
@@ -0,0 +1,106 @@
+package trickle
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	orig := presenceGracePeriod
+	presenceGracePeriod = 50 * time.Millisecond
+	t.Cleanup(func() { presenceGracePeriod = orig })
+
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, Changefeed: true, SubscriberEvents: true}, false)
+	changes := NewTrickleSubscriber(ts.URL + "/" + CHANGEFEED)
+	changes.SetSeq(0)
+	nextChange := func() Changefeed {
+		t.Helper()
+		resp, err := changes.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var ch Changefeed
+		if err := json.NewDecoder(resp.Body).Decode(&ch); err != nil {
+			t.Fatal(err)
+		}
+		return ch
+	}
+
+	pub, err := NewTricklePublisher(ts.URL + "/presence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	// the changefeed announces itself first
+	if ch := nextChange(); len(ch.Added) != 1 || ch.Added[0] != CHANGEFEED {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	if ch := nextChange(); len(ch.Added) != 1 || ch.Added[0] != "presence" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	if pub.Subscribers() != -1 {
+		t.Errorf("expected unknown subscribers, got %d", pub.Subscribers())
+	}
+
+	// an unwatched channel reports zero
+	if err := pub.Write(bytes.NewReader([]byte("nobody"))); err != nil {
+		t.Fatal(err)
+	}
+	if pub.Subscribers() != 0 {
+		t.Errorf("expected no subscribers, got %d", pub.Subscribers())
+	}
+
+	sub := NewTrickleSubscriber(ts.URL + "/presence")
+	sub.SetSeq(1)
+	segment := make(chan []byte, 1)
+	go func() {
+		resp, err := sub.Read()
+		if err != nil {
+			t.Error(err)
+			close(segment)
+			return
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		segment <- data
+	}()
+	if ch := nextChange(); len(ch.Watched) != 1 || ch.Watched[0] != "presence" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+
+	if err := pub.Write(bytes.NewReader([]byte("somebody"))); err != nil {
+		t.Fatal(err)
+	}
+	if data := <-segment; string(data) != "somebody" {
+		t.Errorf("unexpected segment %q", data)
+	}
+	if pub.Subscribers() < 1 {
+		t.Errorf("expected subscribers, got %d", pub.Subscribers())
+	}
+	// the subscriber preconnects to the next segment
+	var info *ChannelInfo
+	for i := 0; i < 100; i++ {
+		if info, err = sub.Info(); err != nil {
+			t.Fatal(err)
+		}
+		if info.Subscribers == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.Subscribers != 1 {
+		t.Errorf("expected one subscriber in info, got %d", info.Subscribers)
+	}
+
+	// hanging up the preconnect eventually unwatches the channel
+	sub.SetSeq(0)
+	if ch := nextChange(); len(ch.Unwatched) != 1 || ch.Unwatched[0] != "presence" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+}
@@ -0,0 +1,46 @@
+package trickle_test
+
+import (
+	"fmt"
+	"testing"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestResume(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	sub := ts.Subscriber("resume", 0)
+	first := ts.Publisher(t, "resume")
+	for i := 0; i < 3; i++ {
+		trickletest.Publish(t, first, fmt.Sprintf("seg %d", i))
+		trickletest.Read(t, sub)
+	}
+
+	// the publisher restarts without closing the channel
+	restarted := ts.PublisherWithConfig(t, "resume", trickle.TricklePublisherConfig{Resume: true})
+	trickletest.Publish(t, restarted, "after restart")
+	if seq, data := trickletest.Read(t, sub); seq != 3 || data != "after restart" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+
+	// earlier segments are left alone
+	sub.SetSeq(1)
+	if seq, data := trickletest.Read(t, sub); seq != 1 || data != "seg 1" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	if info := ts.Info(t, "resume"); info.Latest != 4 {
+		t.Errorf("unexpected info %+v", info)
+	}
+}
+
+func TestResume_NewChannel(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub, err := trickle.NewTricklePublisherWithConfig(ts.ChannelURL("fresh"), trickle.TricklePublisherConfig{Resume: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trickletest.Publish(t, pub, "first")
+	if seq, data := trickletest.Read(t, ts.Subscriber("fresh", 0)); seq != 0 || data != "first" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+}
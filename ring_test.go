@@ -0,0 +1,139 @@
+package trickle_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestRing_Wraparound(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "ring")
+	const segments = 12
+	for i := 0; i < segments; i++ {
+		trickletest.Publish(t, pub, fmt.Sprintf("seg %d", i))
+	}
+
+	// only the most recent segments are kept
+	info := ts.Info(t, "ring")
+	if info.Latest != segments || len(info.Segments) == 0 || len(info.Segments) >= segments {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	first := info.Segments[0].Seq
+	for i, seg := range info.Segments {
+		if seg.Seq != first+i || !seg.Complete {
+			t.Errorf("unexpected segment %+v", seg)
+		}
+	}
+
+	// segments that fell out of the window are a 470 with the latest seq
+	sub := ts.Subscriber("ring", 0)
+	_, err := sub.Read()
+	var nonexistent *trickle.SequenceNonexistent
+	if !errors.As(err, &nonexistent) || nonexistent.Seq != 0 || nonexistent.Latest != segments {
+		t.Fatalf("expected 470, got %v", err)
+	}
+
+	// everything in the window is still readable
+	sub.SetSeq(first)
+	for i := first; i < segments; i++ {
+		if seq, data := trickletest.Read(t, sub); seq != i || data != fmt.Sprintf("seg %d", i) {
+			t.Errorf("expected segment %d, got %d %q", i, seq, data)
+		}
+	}
+
+	// -2 is the most recent segment
+	if seq, data := trickletest.Read(t, ts.Subscriber("ring", -2)); seq != segments-1 || data != fmt.Sprintf("seg %d", segments-1) {
+		t.Errorf("unexpected latest segment %d %q", seq, data)
+	}
+}
+
+func TestRing_AheadOfWriter(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "ahead")
+	trickletest.Publish(t, pub, "zero")
+
+	// one ahead is a preconnect, further than that is a 470
+	sub := ts.Subscriber("ahead", 5)
+	_, err := sub.Read()
+	var nonexistent *trickle.SequenceNonexistent
+	if !errors.As(err, &nonexistent) || nonexistent.Seq != 5 || nonexistent.Latest != 1 {
+		t.Fatalf("expected 470, got %v", err)
+	}
+	sub.SetSeq(nonexistent.Latest)
+	done := make(chan string)
+	go func() {
+		_, data := trickletest.Read(t, sub)
+		done <- data
+	}()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "ahead").Subscribers >= 1 })
+	trickletest.Publish(t, pub, "one")
+	if data := <-done; data != "one" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
+
+func TestRing_Reset(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "reset")
+
+	// writing the same seq again replaces it, eg a publisher retry
+	pp, err := pub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pp.Write(strings.NewReader("first try")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pp.Write(strings.NewReader("second try")); err != nil {
+		t.Fatal(err)
+	}
+	sub := ts.Subscriber("reset", 0)
+	if seq, data := trickletest.Read(t, sub); seq != 0 || data != "second try" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+	info := ts.Info(t, "reset")
+	if len(info.Segments) != 1 || info.Segments[0].Bytes != len("second try") {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// and the channel carries on from there
+	trickletest.Publish(t, pub, "next")
+	if seq, data := trickletest.Read(t, sub); seq != 1 || data != "next" {
+		t.Errorf("unexpected segment %d %q", seq, data)
+	}
+}
+
+func TestRing_ClosedChannel(t *testing.T) {
+	// without autocreate so the channel stays gone once closed
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{})
+	trickle.NewLocalPublisher(ts.Trickle, "closing", "").CreateChannel()
+	pub, err := trickle.NewTricklePublisher(ts.ChannelURL("closing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := ts.Subscriber("closing", 0)
+	trickletest.Publish(t, pub, "zero")
+	trickletest.Read(t, sub)
+
+	// subscribers preconnected to the next segment see the end of stream
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "closing").Subscribers >= 1 })
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Read(); !errors.Is(err, trickle.EOS) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+
+	// and publishers can no longer write to it
+	if err := pub.Write(strings.NewReader("late")); err == nil {
+		t.Error("expected error writing to a closed channel")
+	}
+	late := ts.Subscriber("closing", -1)
+	if _, err := late.Read(); !errors.Is(err, trickle.StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+}
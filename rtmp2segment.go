@@ -25,6 +25,10 @@ type MediaSegmenter struct {
 
 	// File descriptors to inherit
 	ExtraFiles []*os.File
+
+	// Source of time for the wait on each segment pipe,
+	// eg a fake clock in tests (default SystemClock)
+	Clock Clock
 }
 
 func (ms *MediaSegmenter) RunSegmentation(in string, segmentHandler SegmentHandler) {
@@ -35,7 +39,7 @@ func (ms *MediaSegmenter) RunSegmentation(in string, segmentHandler SegmentHandl
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		processSegments(segmentHandler, outFilePattern, completionSignal)
+		processSegments(segmentHandler, outFilePattern, completionSignal, clockOrDefault(ms.Clock))
 	}()
 	// lpms currently does not work on joshs local mac
 	/*
@@ -82,7 +86,7 @@ func cleanUpPipe(pipeName string) {
 	}
 }
 
-func openNonBlockingWithRetry(name string, timeout time.Duration, completed <-chan bool) (*os.File, error) {
+func openNonBlockingWithRetry(name string, timeout time.Duration, completed <-chan bool, clock Clock) (*os.File, error) {
 	// Pipes block if there is no writer available
 
 	// Attempt to open the named pipe in non-blocking mode once
@@ -91,7 +95,7 @@ func openNonBlockingWithRetry(name string, timeout time.Duration, completed <-ch
 		return nil, fmt.Errorf("error opening file in non-blocking mode: %w", err)
 	}
 
-	deadline := time.Now().Add(timeout)
+	deadline := clock.Now().Add(timeout)
 
 	// setFd sets the given file descriptor in the fdSet
 	setFd := func(fd int, fdSet *syscall.FdSet) {
@@ -123,7 +127,7 @@ func openNonBlockingWithRetry(name string, timeout time.Duration, completed <-ch
 			// continue
 		}
 		// Calculate the remaining time until the deadline
-		timeLeft := time.Until(deadline)
+		timeLeft := deadline.Sub(clock.Now())
 		if timeLeft <= 0 {
 			syscall.Close(fd)
 			return nil, fmt.Errorf("timeout waiting for file to be ready: %s", name)
@@ -168,7 +172,7 @@ func openNonBlockingWithRetry(name string, timeout time.Duration, completed <-ch
 	}
 }
 
-func processSegments(segmentHandler SegmentHandler, outFilePattern string, completionSignal <-chan bool) {
+func processSegments(segmentHandler SegmentHandler, outFilePattern string, completionSignal <-chan bool, clock Clock) {
 
 	// things protected by the mutex mu
 	mu := &sync.Mutex{}
@@ -203,7 +207,7 @@ func processSegments(segmentHandler SegmentHandler, outFilePattern string, compl
 
 		// Open the current pipe for reading
 		// Blocks if no writer is available so do some tricks to it
-		file, err := openNonBlockingWithRetry(pipeName, waitTimeout, pipeCompletion)
+		file, err := openNonBlockingWithRetry(pipeName, waitTimeout, pipeCompletion, clock)
 		if err != nil {
 			slog.Error("Error opening pipe", "pipeName", pipeName, "err", err)
 			cleanUpPipe(pipeName)
@@ -0,0 +1,227 @@
+package trickle
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// TrickleSocketPublisher publishes over the framed socket protocol.
+// Like TricklePublisher, the next segment is preconnected
+// while the current one is being written.
+type TrickleSocketPublisher struct {
+	network     string
+	address     string
+	channel     string
+	contentType string
+	index       int
+	writeLock   sync.Mutex
+	pending     *pendingSocketPost
+}
+
+type pendingSocketPost struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+	index  int
+}
+
+// NewTrickleSocketPublisher creates a publisher for a channel on a socket server,
+// eg NewTrickleSocketPublisher("unix", "/tmp/trickle.sock", "mystream")
+func NewTrickleSocketPublisher(network, address, channel string) (*TrickleSocketPublisher, error) {
+	c := &TrickleSocketPublisher{
+		network:     network,
+		address:     address,
+		channel:     channel,
+		contentType: "video/MP2T",
+	}
+	p, err := c.preconnect()
+	if err != nil {
+		return nil, err
+	}
+	c.pending = p
+	return c, nil
+}
+
+// NB expects to have the lock already since we mutate the index
+func (c *TrickleSocketPublisher) preconnect() (*pendingSocketPost, error) {
+	conn, err := net.Dial(c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingSocketPost{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		writer: bufio.NewWriter(conn),
+		index:  c.index,
+	}
+	err = writeJSONFrame(p.writer, frameRequest, &socketRequest{
+		Op:          socketOpPublish,
+		Channel:     c.channel,
+		Seq:         p.index,
+		ContentType: c.contentType,
+	})
+	if err == nil {
+		err = p.writer.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.index += 1
+	return p, nil
+}
+
+func (c *TrickleSocketPublisher) next() (*pendingSocketPost, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	pp := c.pending
+	if pp == nil {
+		p, err := c.preconnect()
+		if err != nil {
+			return nil, err
+		}
+		pp = p
+	}
+
+	// Set up the next connection
+	nextPost, err := c.preconnect()
+	if err != nil {
+		// hang on to this one for the next write
+		c.pending = pp
+		return nil, err
+	}
+	c.pending = nextPost
+	return pp, nil
+}
+
+// Write sends data to the current segment, sets up the next segment concurrently, and blocks until completion
+func (c *TrickleSocketPublisher) Write(data io.Reader) error {
+	p, err := c.next()
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	buf := make([]byte, 1024*32)
+	var (
+		total   int64
+		ioError error
+	)
+	for ioError == nil {
+		n, err := data.Read(buf)
+		if n > 0 {
+			if ioError = writeFrame(p.writer, frameData, buf[:n]); ioError == nil {
+				ioError = p.writer.Flush()
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading data for segment %d: %w", p.index, err)
+		}
+	}
+	if ioError == nil {
+		if ioError = writeFrame(p.writer, frameEnd, nil); ioError == nil {
+			ioError = p.writer.Flush()
+		}
+	}
+
+	// The server may have replied early, eg if the channel closed.
+	// Prefer that response over any io errors.
+	resp, err := readSocketResponse(p.reader)
+	if err != nil {
+		if ioError != nil {
+			return fmt.Errorf("error streaming data to segment %d: %w", p.index, ioError)
+		}
+		return err
+	}
+	if err := resp.err(); err != nil {
+		return err
+	}
+	slog.Debug("Completed writing", "channel", c.channel, "idx", p.index, "totalBytes", humanBytes(total))
+	return nil
+}
+
+func (c *TrickleSocketPublisher) roundTrip(req *socketRequest) error {
+	resp, err := socketRoundTrip(c.network, c.address, req)
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+// Create the channel on the server
+func (c *TrickleSocketPublisher) Create() error {
+	return c.roundTrip(&socketRequest{Op: socketOpCreate, Channel: c.channel, ContentType: c.contentType})
+}
+
+// Close a segment. Only needed if the segment was dropped; see pendingPost.Close
+func (c *TrickleSocketPublisher) CloseSeq(seq int) error {
+	return c.roundTrip(&socketRequest{Op: socketOpClose, Channel: c.channel, Seq: seq})
+}
+
+// Close deletes the channel and hangs up any preconnect
+func (c *TrickleSocketPublisher) Close() error {
+	c.writeLock.Lock()
+	if c.pending != nil {
+		c.pending.conn.Close()
+		c.pending = nil
+	}
+	c.writeLock.Unlock()
+	return c.roundTrip(&socketRequest{Op: socketOpDelete, Channel: c.channel})
+}
+
+func socketRoundTrip(network, address string, req *socketRequest) (*socketResponse, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := writeJSONFrame(conn, frameRequest, req); err != nil {
+		return nil, err
+	}
+	return readSocketResponse(bufio.NewReader(conn))
+}
+
+func readSocketResponse(reader *bufio.Reader) (*socketResponse, error) {
+	frameType, payload, err := readFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	if frameType != frameResponse {
+		return nil, fmt.Errorf("unexpected frame type %c", frameType)
+	}
+	var resp socketResponse
+	if err := json.Unmarshal(payload, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Maps a response onto the same errors as the HTTP clients
+func (r *socketResponse) err() error {
+	if r.Closed {
+		return EOS
+	}
+	switch {
+	case r.Status == http.StatusOK:
+		return nil
+	case r.Status == http.StatusNotFound:
+		return StreamNotFoundErr
+	case r.Status == 470:
+		return &SequenceNonexistent{Seq: r.Seq, Latest: r.Latest}
+	case r.Status >= 400:
+		return &HTTPError{Code: r.Status, Body: r.Error}
+	}
+	return errors.New("unexpected status " + http.StatusText(r.Status))
+}
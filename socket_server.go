@@ -0,0 +1,430 @@
+package trickle
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// Framed binary protocol for trickle over TCP or unix domain sockets.
+// Meant for co-located processes where HTTP overhead is wasteful.
+//
+// Every frame is a one byte type, a four byte big-endian payload length,
+// then the payload. Requests and responses carry JSON payloads.
+//
+// Publish: the client sends a publish request, then data frames, then an
+// end frame. The server responds once the segment is closed. The request
+// may be sent ahead of time as a preconnect.
+//
+// Subscribe: the client sends a subscribe request. The server responds
+// once data is available, followed by data frames and an end frame.
+//
+// Create, close (a seq) and delete are a single request and response.
+//
+// Requests go through the same PrefixConfig.Authorize hooks as HTTP ones,
+// as a request with the method and path of the HTTP equivalent and the
+// request's authorization, if any, as its Authorization header.
+//
+// Response statuses follow their HTTP counterparts: 200, 404, 470 etc.
+// A connection may carry any number of operations back to back.
+
+const (
+	frameRequest  byte = 'Q'
+	frameResponse byte = 'R'
+	frameData     byte = 'D'
+	frameEnd      byte = 'E'
+
+	maxFrameSize = 16 * 1024 * 1024
+)
+
+const (
+	socketOpCreate    = "create"
+	socketOpPublish   = "publish"
+	socketOpSubscribe = "subscribe"
+	socketOpClose     = "close"
+	socketOpDelete    = "delete"
+)
+
+type socketRequest struct {
+	Op          string `json:"op"`
+	Channel     string `json:"channel"`
+	Seq         int    `json:"seq"`
+	ContentType string `json:"content_type,omitempty"`
+
+	// passed on to Authorize hooks as the Authorization header
+	Authorization string `json:"authorization,omitempty"`
+}
+
+// End frame payload for segments that were aborted
+const socketAborted = "aborted"
+
+type socketResponse struct {
+	Status      int    `json:"status"`
+	Seq         int    `json:"seq"`
+	Latest      int    `json:"latest"`
+	Closed      bool   `json:"closed,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// set on segment responses
+	Epoch         int  `json:"epoch,omitempty"`
+	Discontinuity bool `json:"discontinuity,omitempty"`
+}
+
+func writeFrame(w io.Writer, frameType byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = frameType
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func writeJSONFrame(w io.Writer, frameType byte, v any) error {
+	jb, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, frameType, jb)
+}
+
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+func respond(w *bufio.Writer, resp *socketResponse) error {
+	if err := writeJSONFrame(w, frameResponse, resp); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// ServeSocket serves the framed trickle protocol on the listener until it fails.
+// Uses the same channels as the HTTP server.
+func (sm *Server) ServeSocket(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go sm.handleSocket(conn)
+	}
+}
+
+func (sm *Server) handleSocket(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		frameType, payload, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Info("Error reading socket request", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		if frameType != frameRequest {
+			slog.Info("Unexpected socket frame", "remote", conn.RemoteAddr(), "type", frameType)
+			return
+		}
+		var req socketRequest
+		if err := json.Unmarshal(payload, &req); err != nil {
+			respond(writer, &socketResponse{Status: http.StatusBadRequest, Error: "Invalid request"})
+			return
+		}
+		r := sm.socketHTTPRequest(conn, &req)
+		if !sm.authorized(r, req.Channel) {
+			// keep the connection usable for the next request
+			if req.Op == socketOpPublish && discardSegment(reader) != nil {
+				return
+			}
+			if respond(writer, &socketResponse{Status: http.StatusForbidden, Error: "Forbidden"}) != nil {
+				return
+			}
+			continue
+		}
+		var ok bool
+		switch req.Op {
+		case socketOpCreate:
+			resp := &socketResponse{Status: http.StatusOK}
+			if sm.getOrCreateStream(req.Channel, req.ContentType, false) == nil {
+				resp = &socketResponse{Status: http.StatusNotFound, Error: "Stream not found"}
+			}
+			ok = respond(writer, resp) == nil
+		case socketOpDelete:
+			resp := &socketResponse{Status: http.StatusOK}
+			if err := sm.closeStream(req.Channel); err != nil {
+				resp = &socketResponse{Status: http.StatusBadRequest, Error: err.Error()}
+			}
+			ok = respond(writer, resp) == nil
+		case socketOpClose:
+			ok = sm.socketCloseSeq(writer, &req)
+		case socketOpPublish:
+			ok = sm.socketPublish(conn, reader, writer, &req)
+		case socketOpSubscribe:
+			ctx, stop := watchHangup(conn, reader)
+			ok = sm.socketSubscribe(r.WithContext(ctx), writer, &req)
+			stop()
+		default:
+			respond(writer, &socketResponse{Status: http.StatusBadRequest, Error: "Unknown op " + req.Op})
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+// Stands in for the HTTP request equivalent to a socket request, so that
+// Authorize hooks can treat both transports alike
+func (sm *Server) socketHTTPRequest(conn net.Conn, req *socketRequest) *http.Request {
+	method := http.MethodPost
+	switch req.Op {
+	case socketOpSubscribe:
+		method = http.MethodGet
+	case socketOpClose, socketOpDelete:
+		method = http.MethodDelete
+	}
+	r := &http.Request{
+		Method:     method,
+		URL:        &url.URL{Path: sm.config.BasePath + req.Channel},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	if req.Authorization != "" {
+		r.Header.Set("Authorization", req.Authorization)
+	}
+	return r
+}
+
+func (sm *Server) socketCloseSeq(writer *bufio.Writer, req *socketRequest) bool {
+	s, exists := sm.getStream(req.Channel)
+	if !exists {
+		return respond(writer, &socketResponse{Status: http.StatusNotFound, Error: "Stream not found"}) == nil
+	}
+	slog.Info("Socket closing seq", "channel", s.name, "seq", req.Seq)
+	if !s.closeSegment(req.Seq) {
+		return respond(writer, &socketResponse{Status: http.StatusBadRequest, Error: "Nonexistent segment"}) == nil
+	}
+	return respond(writer, &socketResponse{Status: http.StatusOK, Seq: req.Seq}) == nil
+}
+
+// Returns a context that is cancelled once the client hangs up, since
+// nothing else reads from the connection while a subscribe waits for
+// data. Call stop before reading from the connection again.
+func watchHangup(conn net.Conn, reader *bufio.Reader) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// a pipelined request is left for the next read
+		if _, err := reader.Peek(1); err != nil {
+			cancel()
+		}
+	}()
+	return ctx, func() {
+		// unblock the peek, then let the connection be read again
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// drains data frames up to the end of the segment
+func discardSegment(reader *bufio.Reader) error {
+	for {
+		frameType, _, err := readFrame(reader)
+		if err != nil {
+			return err
+		}
+		if frameType == frameEnd {
+			return nil
+		}
+	}
+}
+
+func (sm *Server) socketPublish(conn net.Conn, reader *bufio.Reader, writer *bufio.Writer, req *socketRequest) bool {
+	stream := sm.getOrCreateStream(req.Channel, req.ContentType, false)
+	if stream == nil {
+		// keep the connection usable for the next request
+		if err := discardSegment(reader); err != nil {
+			return false
+		}
+		return respond(writer, &socketResponse{Status: http.StatusNotFound, Error: "Stream not found"}) == nil
+	}
+	if req.Seq < -1 {
+		discardSegment(reader)
+		return respond(writer, &socketResponse{Status: http.StatusBadRequest, Error: "Invalid idx"}) == nil
+	}
+	segment, _ := stream.getForWrite(req.Seq)
+	idx := segment.idx
+
+	// If the segment is closed while a preconnected publisher is waiting,
+	// unblock the read so we can tell the publisher
+	var (
+		started   atomic.Bool
+		preempted atomic.Bool
+		done      = make(chan struct{})
+		closeCh   = segment.closeCh
+	)
+	defer close(done)
+	go func() {
+		select {
+		case <-closeCh:
+			if !started.Load() {
+				preempted.Store(true)
+				conn.SetReadDeadline(time.Now())
+			}
+		case <-done:
+		}
+	}()
+
+	totalRead := 0
+	for {
+		frameType, data, err := readFrame(reader)
+		if err != nil {
+			if preempted.Load() {
+				stream.mutex.RLock()
+				isClosed := stream.closed
+				stream.mutex.RUnlock()
+				// the connection is out of sync now so hang up after this
+				respond(writer, &socketResponse{Status: http.StatusOK, Seq: idx, Closed: isClosed})
+				return false
+			}
+			slog.Info("Error reading socket publish", "stream", stream.name, "idx", idx, "bytes written", totalRead, "err", err)
+			if totalRead > 0 {
+				segment.abort()
+			}
+			return false
+		}
+		switch frameType {
+		case frameData:
+			if len(data) <= 0 {
+				continue
+			}
+			if totalRead == 0 {
+				started.Store(true)
+				stream.startWrite(segment)
+			}
+			segment.writeData(data)
+			totalRead += len(data)
+		case frameEnd:
+			started.Store(true)
+			segment.close()
+			return respond(writer, &socketResponse{Status: http.StatusOK, Seq: idx}) == nil
+		default:
+			slog.Info("Unexpected frame in socket publish", "stream", stream.name, "idx", idx, "type", frameType)
+			return false
+		}
+	}
+}
+
+func (sm *Server) socketSubscribe(r *http.Request, writer *bufio.Writer, req *socketRequest) bool {
+	s, exists := sm.getStream(req.Channel)
+	if !exists {
+		return respond(writer, &socketResponse{Status: http.StatusNotFound, Error: "Stream not found"}) == nil
+	}
+	if req.Seq < -2 {
+		return respond(writer, &socketResponse{Status: http.StatusBadRequest, Error: "Invalid idx"}) == nil
+	}
+	defer s.presence.add()()
+	segment, latestSeq, exists, closed := s.getForRead(req.Seq)
+	if !exists {
+		resp := &socketResponse{Status: 470, Seq: req.Seq, Latest: latestSeq}
+		if closed {
+			resp = &socketResponse{Status: http.StatusOK, Seq: req.Seq, Latest: latestSeq, Closed: true}
+		}
+		return respond(writer, resp) == nil
+	}
+
+	// stop waiting for data once the client is gone
+	defer context.AfterFunc(r.Context(), segment.wake)()
+	subscriber := &SegmentSubscriber{
+		segment: segment,
+		ctx:     r.Context(),
+	}
+	readData := subscriber.readData
+	if s.name == CHANGEFEED {
+		readData = sm.changefeedReader(r, subscriber)
+	}
+	totalWrites := 0
+	for {
+		data, eof := readData()
+		if len(data) > 0 {
+			if totalWrites <= 0 {
+				info := segment.info()
+				err := writeJSONFrame(writer, frameResponse, &socketResponse{
+					Status:        http.StatusOK,
+					Seq:           segment.idx,
+					Latest:        latestSeq,
+					ContentType:   s.mimeType,
+					Epoch:         info.epoch,
+					Discontinuity: info.discontinuity,
+				})
+				if err != nil {
+					return false
+				}
+			}
+			if err := writeFrame(writer, frameData, data); err != nil {
+				slog.Error("Error sending data to socket client", "stream", s.name, "idx", segment.idx, "sentBytes", totalWrites, "err", err)
+				return false
+			}
+			if err := writer.Flush(); err != nil {
+				slog.Error("Error sending data to socket client", "stream", s.name, "idx", segment.idx, "sentBytes", totalWrites, "err", err)
+				return false
+			}
+			totalWrites += len(data)
+		}
+		if !eof {
+			continue
+		}
+		if totalWrites > 0 {
+			// incomplete segments are flagged in the end frame
+			var end []byte
+			if segment.info().aborted {
+				end = []byte(socketAborted)
+			}
+			if err := writeFrame(writer, frameEnd, end); err != nil {
+				return false
+			}
+			return writer.Flush() == nil
+		}
+		// nothing was sent; check if the channel was closed
+		s.mutex.RLock()
+		closed := s.closed
+		latestSeq := s.nextWrite
+		s.mutex.RUnlock()
+		resp := &socketResponse{Status: 470, Seq: segment.idx, Latest: latestSeq}
+		if closed {
+			resp = &socketResponse{Status: http.StatusOK, Seq: segment.idx, Closed: true}
+		}
+		return respond(writer, resp) == nil
+	}
+}
@@ -0,0 +1,187 @@
+package trickle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// TrickleSocketSubscriber reads a channel over the framed socket protocol.
+// Like TrickleSubscriber, it starts at the live edge (-1) and
+// preconnects the next segment once the current one is returned.
+type TrickleSocketSubscriber struct {
+	network   string
+	address   string
+	channel   string
+	mu        sync.Mutex
+	pending   *socketSegment
+	ctx       context.Context
+	cancelCtx func()
+	idx       int
+}
+
+type socketSegment struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	resp   *socketResponse
+	stop   func() bool
+}
+
+// socketSegmentReader reads data frames for a single segment
+type socketSegmentReader struct {
+	seg  *socketSegment
+	buf  []byte
+	done bool
+}
+
+// NewTrickleSocketSubscriber creates a subscriber for a channel on a socket server,
+// eg NewTrickleSocketSubscriber("unix", "/tmp/trickle.sock", "mystream")
+func NewTrickleSocketSubscriber(network, address, channel string) *TrickleSocketSubscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TrickleSocketSubscriber{
+		network:   network,
+		address:   address,
+		channel:   channel,
+		ctx:       ctx,
+		cancelCtx: cancel,
+		idx:       -1, // shortcut for 'latest'
+	}
+}
+
+func (c *TrickleSocketSubscriber) SetSeq(seq int) {
+	// cancel outside the lock since a preconnect may be holding it
+	c.cancelCtx()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.idx = seq
+	c.ctx, c.cancelCtx = context.WithCancel(context.Background())
+	c.pending = nil
+}
+
+// Blocks until the server responds, usually once data is available
+func (c *TrickleSocketSubscriber) connect() (*socketSegment, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(c.ctx, c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	// tear down the connection if the subscriber is reset
+	stop := context.AfterFunc(c.ctx, func() { conn.Close() })
+	err = writeJSONFrame(conn, frameRequest, &socketRequest{
+		Op:      socketOpSubscribe,
+		Channel: c.channel,
+		Seq:     c.idx,
+	})
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := readSocketResponse(reader)
+	if err != nil {
+		stop()
+		conn.Close()
+		return nil, fmt.Errorf("failed to complete subscribe for next segment: %w", err)
+	}
+	return &socketSegment{conn: conn, reader: reader, resp: resp, stop: stop}, nil
+}
+
+func (s *socketSegment) close() {
+	s.stop()
+	s.conn.Close()
+}
+
+// Read returns the next segment and sets up the one after concurrently
+func (c *TrickleSocketSubscriber) Read() (*TrickleData, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg := c.pending
+	c.pending = nil
+	if seg == nil {
+		s, err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+		seg = s
+	}
+
+	if err := seg.resp.err(); err != nil {
+		seg.close()
+		return nil, err
+	}
+
+	// Set to use the next index for the next (pre-)connection
+	if seg.resp.Seq >= 0 {
+		c.idx = seg.resp.Seq + 1
+	}
+
+	go func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		next, err := c.connect()
+		if err != nil {
+			slog.Error("failed to preconnect next segment", "channel", c.channel, "idx", c.idx, "err", err)
+			return
+		}
+		c.pending = next
+	}()
+
+	metadata := map[string]string{
+		"Lp-Trickle-Latest": strconv.Itoa(seg.resp.Latest),
+		"Lp-Trickle-Seq":    strconv.Itoa(seg.resp.Seq),
+		"Lp-Trickle-Epoch":  strconv.Itoa(seg.resp.Epoch),
+		"Content-Type":      seg.resp.ContentType,
+	}
+	if seg.resp.Discontinuity {
+		metadata["Lp-Trickle-Discontinuity"] = "true"
+	}
+	return &TrickleData{
+		Reader:   &socketSegmentReader{seg: seg},
+		Metadata: metadata,
+	}, nil
+}
+
+func (r *socketSegmentReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		frameType, payload, err := readFrame(r.seg.reader)
+		if err != nil {
+			r.Close()
+			return 0, err
+		}
+		switch frameType {
+		case frameData:
+			r.buf = payload
+		case frameEnd:
+			r.Close()
+			if string(payload) == socketAborted {
+				return 0, ErrSegmentAborted
+			}
+			return 0, io.EOF
+		default:
+			r.Close()
+			return 0, fmt.Errorf("unexpected frame type %c", frameType)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Close hangs up the segment early. Not needed if read to EOF.
+func (r *socketSegmentReader) Close() error {
+	if !r.done {
+		r.done = true
+		r.seg.close()
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newSocketServer(t *testing.T, config TrickleServerConfig) (*Server, string) {
+	t.Helper()
+	config.Mux = http.NewServeMux()
+	srv := ConfigureServer(config)
+	addr := filepath.Join(t.TempDir(), "trickle.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.ServeSocket(l)
+	return srv, addr
+}
+
+func TestSocket_PublishSubscribe(t *testing.T) {
+	_, addr := newSocketServer(t, TrickleServerConfig{Autocreate: true})
+
+	pub, err := NewTrickleSocketPublisher("unix", addr, "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTrickleSocketSubscriber("unix", addr, "sock")
+	sub.SetSeq(0)
+
+	const segments = 4
+	go func() {
+		for i := 0; i < segments; i++ {
+			data := bytes.Repeat([]byte{byte(i)}, 100000+i)
+			if err := pub.Write(bytes.NewReader(data)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < segments; i++ {
+		seg, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(seg.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seg.Metadata["Lp-Trickle-Seq"] != string(rune('0'+i)) {
+			t.Errorf("unexpected seq %s, expected %d", seg.Metadata["Lp-Trickle-Seq"], i)
+		}
+		if len(data) != 100000+i || data[0] != byte(i) {
+			t.Errorf("unexpected segment contents for seq %d, len %d", i, len(data))
+		}
+	}
+
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sub.Read(); !errors.Is(err, EOS) && !errors.Is(err, StreamNotFoundErr) {
+		t.Errorf("expected end of stream, got %v", err)
+	}
+}
+
+func TestSocket_Errors(t *testing.T) {
+	srv, addr := newSocketServer(t, TrickleServerConfig{})
+
+	// no autocreate, so publishing to a missing channel fails
+	pub, err := NewTrickleSocketPublisher("unix", addr, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Write(bytes.NewReader([]byte("hello"))); !errors.Is(err, StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+	if _, err := NewTrickleSocketSubscriber("unix", addr, "missing").Read(); !errors.Is(err, StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+
+	// remote creation also requires autocreate
+	if err := pub.Create(); !errors.Is(err, StreamNotFoundErr) {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+
+	// channels created on the server work; preconnects made before
+	// creation were already rejected so start with a fresh publisher
+	NewLocalPublisher(srv, "missing", "text/plain").CreateChannel()
+	pub, err = NewTrickleSocketPublisher("unix", addr, "missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Write(bytes.NewReader([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// seq 0 falls out of the window
+	for i := 0; i < maxSegmentsPerStream; i++ {
+		if err := pub.Write(bytes.NewReader([]byte("hello"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := NewTrickleSocketSubscriber("unix", addr, "missing")
+	sub.SetSeq(0)
+	_, err = sub.Read()
+	var sne *SequenceNonexistent
+	if !errors.As(err, &sne) {
+		t.Fatalf("expected nonexistent sequence, got %v", err)
+	}
+	if sne.Latest != maxSegmentsPerStream+1 {
+		t.Errorf("expected latest %d, got %d", maxSegmentsPerStream+1, sne.Latest)
+	}
+}
+
+func TestSocket_Authorize(t *testing.T) {
+	_, addr := newSocketServer(t, TrickleServerConfig{
+		Autocreate:        true,
+		Changefeed:        true,
+		HierarchicalNames: true,
+		Prefixes: map[string]PrefixConfig{
+			"private/": {Authorize: func(r *http.Request, channel string) bool {
+				return r.Header.Get("Authorization") == "Bearer "+channel
+			}},
+		},
+	})
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	send := func(frameType byte, v any) {
+		t.Helper()
+		var err error
+		if b, ok := v.([]byte); ok {
+			err = writeFrame(conn, frameType, b)
+		} else {
+			err = writeJSONFrame(conn, frameType, v)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func() int {
+		t.Helper()
+		resp, err := readSocketResponse(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.Status
+	}
+
+	const auth = "Bearer private/a"
+	for _, op := range []string{socketOpCreate, socketOpSubscribe, socketOpClose, socketOpDelete} {
+		send(frameRequest, &socketRequest{Op: op, Channel: "private/a"})
+		if s := status(); s != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", op, s)
+		}
+	}
+	// rejected publishes still consume the segment
+	send(frameRequest, &socketRequest{Op: socketOpPublish, Channel: "private/a"})
+	send(frameData, []byte("hello"))
+	send(frameEnd, []byte{})
+	if s := status(); s != http.StatusForbidden {
+		t.Errorf("publish: expected 403, got %d", s)
+	}
+	send(frameRequest, &socketRequest{Op: socketOpCreate, Channel: "private/a", Authorization: auth})
+	if s := status(); s != http.StatusOK {
+		t.Errorf("create: expected 200, got %d", s)
+	}
+
+	// and the channel is left out of the changefeed
+	send(frameRequest, &socketRequest{Op: socketOpSubscribe, Channel: CHANGEFEED, Seq: 1})
+	if s := status(); s != http.StatusOK {
+		t.Fatalf("changefeed: expected 200, got %d", s)
+	}
+	frameType, data, err := readFrame(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frameType != frameData || string(data) != "{}" {
+		t.Errorf("unexpected changefeed frame %c %q", frameType, data)
+	}
+}
+
+func TestSocket_SubscriberHangup(t *testing.T) {
+	srv, addr := newSocketServer(t, TrickleServerConfig{})
+	NewLocalPublisher(srv, "hangup", "").CreateChannel()
+	stream, _ := srv.getStream("hangup")
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal("timed out")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// waits for a segment that is not being written
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSONFrame(conn, frameRequest, &socketRequest{Op: socketOpSubscribe, Channel: "hangup", Seq: 0}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return stream.presence.count() == 1 })
+
+	// the server stops waiting once the client is gone
+	conn.Close()
+	waitFor(func() bool { return stream.presence.count() == 0 })
+
+	// and connections that stay up can go on to the next request
+	conn, err = net.Dial("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sub := &socketRequest{Op: socketOpSubscribe, Channel: "hangup", Seq: 0}
+	create := &socketRequest{Op: socketOpCreate, Channel: "hangup"}
+	for _, req := range []*socketRequest{sub, create} {
+		if err := writeJSONFrame(conn, frameRequest, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	NewLocalPublisher(srv, "hangup", "").Write(bytes.NewReader([]byte("data")))
+	for _, want := range []byte{frameResponse, frameData, frameEnd, frameResponse} {
+		frameType, _, err := readFrame(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frameType != want {
+			t.Errorf("expected frame %c, got %c", want, frameType)
+		}
+	}
+}
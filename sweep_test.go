@@ -0,0 +1,81 @@
+package trickle_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+// Reads the next changefeed message
+func readChange(t *testing.T, sub *trickle.TrickleSubscriber) trickle.Changefeed {
+	t.Helper()
+	_, data := trickletest.Read(t, sub)
+	var ch trickle.Changefeed
+	if err := json.Unmarshal([]byte(data), &ch); err != nil {
+		t.Fatal(err)
+	}
+	return ch
+}
+
+func TestSweep_IdleChannels(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{
+		Autocreate:    true,
+		Changefeed:    true,
+		IdleTimeout:   200 * time.Millisecond,
+		SweepInterval: 10 * time.Millisecond,
+	})
+	changes := ts.Subscriber(trickle.CHANGEFEED, 0)
+	if ch := readChange(t, changes); len(ch.Added) != 1 || ch.Added[0] != trickle.CHANGEFEED {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+
+	idle := ts.Publisher(t, "idle")
+	active := ts.Publisher(t, "active")
+	for _, name := range []string{"idle", "active"} {
+		if ch := readChange(t, changes); len(ch.Added) != 1 || ch.Added[0] != name {
+			t.Fatalf("unexpected change %+v, expected %s to be added", ch, name)
+		}
+	}
+	trickletest.Publish(t, idle, "once")
+
+	// keep one channel busy for longer than the idle timeout
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		trickletest.Publish(t, active, "data")
+		time.Sleep(20 * time.Millisecond)
+	}
+	if ch := readChange(t, changes); len(ch.Removed) != 1 || ch.Removed[0] != "idle" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	if _, err := trickle.NewTrickleSubscriber(ts.ChannelURL("idle")).Info(); err != trickle.StreamNotFoundErr {
+		t.Errorf("expected idle channel to be swept, got %v", err)
+	}
+	if info := ts.Info(t, "active"); info.Latest < 10 {
+		t.Errorf("unexpected info for active channel %+v", info)
+	}
+
+	// the changefeed itself is never swept
+	ts.Info(t, trickle.CHANGEFEED)
+}
+
+func TestChangefeed_Delete(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true, Changefeed: true})
+	changes := ts.Subscriber(trickle.CHANGEFEED, -2)
+	pub := ts.Publisher(t, "deleted")
+	// the changefeed may or may not have been announced before we subscribed
+	ch := readChange(t, changes)
+	if len(ch.Added) == 1 && ch.Added[0] == trickle.CHANGEFEED {
+		ch = readChange(t, changes)
+	}
+	if len(ch.Added) != 1 || ch.Added[0] != "deleted" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ch := readChange(t, changes); len(ch.Removed) != 1 || ch.Removed[0] != "deleted" {
+		t.Fatalf("unexpected change %+v", ch)
+	}
+}
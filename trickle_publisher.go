@@ -1,17 +1,25 @@
 package trickle
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var StreamNotFoundErr = errors.New("stream not found")
 
+// The server closed a preconnect that waited too long for data
+var preconnectExpiredErr = errors.New("preconnect expired")
+
 // TricklePublisher represents a trickle streaming client
 type TricklePublisher struct {
 	client      *http.Client
@@ -20,6 +28,40 @@ type TricklePublisher struct {
 	writeLock   sync.Mutex   // Mutex to manage concurrent access
 	pendingPost *pendingPost // Pre-initialized POST request
 	contentType string
+	config      TricklePublisherConfig
+
+	// time from sending the last byte of a segment to the server response
+	uploadLatency LatencyStats
+
+	// subscriber count from the most recent server response, or -1
+	subscribers atomic.Int64
+}
+
+type TricklePublisherConfig struct {
+	// Content type of the channel (default video/MP2T)
+	ContentType string
+
+	// Multiplex preconnects and segments over a single HTTP/2 connection.
+	// Uses h2c for http:// URLs so the server must support it. (default false)
+	HTTP2 bool
+
+	// Send a digest of each segment for the server to verify.
+	// Mismatches are returned as a ChecksumMismatchError. (default false)
+	Digest bool
+
+	// Continue from the channel's current write position instead of
+	// seq 0, eg after a publisher restart, so earlier segments are not
+	// overwritten. New channels start at 0. (default false)
+	Resume bool
+
+	// Start a new epoch with the first segment, flagging it to
+	// subscribers as a discontinuity, eg when resuming with new
+	// encoder settings. (default false)
+	NewEpoch bool
+
+	// Source of time for send timestamps and upload latency,
+	// eg a fake clock in tests (default SystemClock)
+	Clock Clock
 }
 
 // HTTPError gets returned with a >=400 status code (non-400)
@@ -34,9 +76,10 @@ func (e *HTTPError) Error() string {
 
 // pendingPost represents a pre-initialized POST request waiting for data
 type pendingPost struct {
-	index  int
-	writer *io.PipeWriter
-	errCh  chan error
+	index   int
+	writer  *io.PipeWriter
+	errCh   chan error
+	trailer http.Header // send times, filled in once the segment is written
 
 	// needed to help with reconnects
 	written bool
@@ -45,10 +88,35 @@ type pendingPost struct {
 
 // NewTricklePublisher creates a new trickle stream client
 func NewTricklePublisher(url string) (*TricklePublisher, error) {
+	return NewTricklePublisherWithConfig(url, TricklePublisherConfig{})
+}
+
+func NewTricklePublisherWithConfig(url string, config TricklePublisherConfig) (*TricklePublisher, error) {
+	if config.ContentType == "" {
+		config.ContentType = "video/MP2T"
+	}
+	config.Clock = clockOrDefault(config.Clock)
 	c := &TricklePublisher{
 		baseURL:     url,
-		contentType: "video/MP2T",
-		client:      httpClient(),
+		contentType: config.ContentType,
+		config:      config,
+	}
+	c.client = c.freshClient()
+	c.subscribers.Store(-1)
+	if config.Resume {
+		info, err := fetchInfo(c.client, url)
+		if err != nil && err != StreamNotFoundErr {
+			return nil, fmt.Errorf("could not resume channel: %w", err)
+		}
+		if info != nil {
+			c.index = info.Latest
+			slog.Info("Resuming channel", "url", url, "seq", c.index)
+		}
+	}
+	if config.NewEpoch {
+		if _, err := c.NewEpoch(); err != nil {
+			return nil, err
+		}
 	}
 	p, err := c.preconnect()
 	if err != nil {
@@ -75,6 +143,11 @@ func (c *TricklePublisher) preconnect() (*pendingPost, error) {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", c.contentType)
+	// Declare trailers upfront; HTTP/2 servers drop undeclared ones
+	req.Trailer = http.Header{"Lp-Trickle-Sent": nil, "Lp-Trickle-Sent-End": nil}
+	if c.config.Digest {
+		req.Trailer["Lp-Trickle-Digest"] = nil
+	}
 	httpclient := c.client
 
 	// Start the POST request in a background goroutine
@@ -86,6 +159,9 @@ func (c *TricklePublisher) preconnect() (*pendingPost, error) {
 			return
 		}
 		isEOS := resp.Header.Get("Lp-Trickle-Closed") != ""
+		if n, err := strconv.Atoi(resp.Header.Get("Lp-Trickle-Subscribers")); err == nil {
+			c.subscribers.Store(int64(n))
+		}
 		body, err := io.ReadAll(resp.Body)
 		if err != nil && !isEOS {
 			slog.Error("Error reading body", "url", url, "err", err)
@@ -99,12 +175,26 @@ func (c *TricklePublisher) preconnect() (*pendingPost, error) {
 			return
 		}
 
+		if resp.StatusCode == http.StatusRequestTimeout && resp.Header.Get("Lp-Trickle-Reconnect") != "" {
+			slog.Debug("Preconnect expired", "url", url)
+			errCh <- preconnectExpiredErr
+			return
+		}
+
 		if resp.StatusCode != http.StatusOK {
 			slog.Error("Failed POST segment", "url", url, "status_code", resp.StatusCode, "msg", string(body))
 			if resp.StatusCode == http.StatusNotFound {
 				errCh <- StreamNotFoundErr
 				return
 			}
+			if resp.StatusCode == http.StatusUnprocessableEntity && resp.Header.Get("Lp-Trickle-Digest") != "" {
+				errCh <- &ChecksumMismatchError{
+					Seq:      index,
+					Expected: req.Trailer.Get("Lp-Trickle-Digest"),
+					Actual:   resp.Header.Get("Lp-Trickle-Digest"),
+				}
+				return
+			}
 			if resp.StatusCode >= 400 {
 				errCh <- &HTTPError{Code: resp.StatusCode, Body: string(body)}
 				return
@@ -117,10 +207,11 @@ func (c *TricklePublisher) preconnect() (*pendingPost, error) {
 
 	c.index += 1
 	return &pendingPost{
-		writer: pw,
-		index:  index,
-		errCh:  errCh,
-		client: c,
+		writer:  pw,
+		index:   index,
+		errCh:   errCh,
+		trailer: req.Trailer,
+		client:  c,
 	}, nil
 }
 
@@ -130,7 +221,7 @@ func (c *TricklePublisher) Close() error {
 		return err
 	}
 	// Use a new client for a fresh connection
-	resp, err := httpClient().Do(req)
+	resp, err := c.freshClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -147,7 +238,8 @@ func (c *TricklePublisher) Create() error {
 	if err != nil {
 		return err
 	}
-	resp, err := httpClient().Do(req)
+	req.Header.Set("Expect-Content", c.contentType)
+	resp, err := c.freshClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -185,17 +277,24 @@ func (c *TricklePublisher) Next() (*pendingPost, error) {
 	return pp, nil
 }
 
-func (p *pendingPost) reconnect() (*pendingPost, error) {
+func (p *pendingPost) reconnect(fresh bool) (*pendingPost, error) {
 	// This is a little gnarly but works for now:
 	// Set the publisher's sequence sequence to the intended reconnect
 	// Call publisher's preconnect (which increments its sequence)
 	// then reset publisher's sequence back to the original
-	// Also recreate the client to force a fresh connection
+	// Optionally recreate the client to force a fresh connection
 	p.client.writeLock.Lock()
 	defer p.client.writeLock.Unlock()
 	currentSeq := p.client.index
 	p.client.index = p.index
-	p.client.client = httpClient()
+	if fresh {
+		old := p.client.client
+		p.client.client = p.client.freshClient()
+		if old != p.client.client {
+			// connections still in use are reaped by the idle timeout
+			old.CloseIdleConnections()
+		}
+	}
 	pp, err := p.client.preconnect()
 	p.client.index = currentSeq
 	return pp, err
@@ -205,7 +304,7 @@ func (p *pendingPost) Write(data io.Reader) (int64, error) {
 
 	// If writing multiple times, reconnect
 	if p.written {
-		pp, err := p.reconnect()
+		pp, err := p.reconnect(true)
 		if err != nil {
 			return 0, err
 		}
@@ -224,30 +323,66 @@ func (p *pendingPost) Write(data io.Reader) (int64, error) {
 	// before writing, check for error from preconnects
 	select {
 	case err := <-errCh:
-		return 0, err
+		if err != preconnectExpiredErr {
+			return 0, err
+		}
+		// the server closed the idle preconnect, so set it up again
+		pp, err := p.reconnect(false)
+		if err != nil {
+			return 0, err
+		}
+		pp.written = true
+		writer, index, errCh = pp.writer, pp.index, pp.errCh
+		p = pp
 	default:
 		// no error, continue
 	}
 
 	// Start streaming data to the current POST request
-	n, ioError := io.Copy(writer, data)
-
-	// if no io errors, close the writer
-	var closeErr error
-	if ioError == nil {
-		slog.Debug("Completed writing", "idx", index, "totalBytes", humanBytes(n))
-
-		// Close the pipe writer to signal end of data for the current POST request
-		closeErr = writer.Close()
+	var digest hash.Hash
+	if p.client.config.Digest {
+		digest = newDigest()
+		data = io.TeeReader(data, digest)
 	}
+	timer := &sendTimer{reader: data, clock: p.client.config.Clock}
+	replay := &replayBuffer{}
+	n, ioError := io.Copy(io.MultiWriter(replay, writer), timer)
+	closeErr := p.finish(n, ioError, timer, digest)
 
 	// check for errors after write, eg >=400 status codes
 	// these typically do not result in io errors eg, with io.Copy
 	// also prioritize errors over this channel compared to io errors
 	// such as "read/write on closed pipe"
-	if err := <-errCh; err != nil {
+	err := <-errCh
+	if err == preconnectExpiredErr {
+		// The preconnect expired just as the write started. The server
+		// only expires preconnects that have not received anything, so
+		// send whatever was written so far again on a new one.
+		if replay.overflow {
+			return n, fmt.Errorf("preconnect for segment %d expired during write", index)
+		}
+		pp, rerr := p.reconnect(false)
+		if rerr != nil {
+			return n, rerr
+		}
+		pp.written = true
+		writer, index, errCh = pp.writer, pp.index, pp.errCh
+		p = pp
+		if ioError == nil {
+			// the first write reached the end of the data
+			n, ioError = io.Copy(writer, bytes.NewReader(replay.buf.Bytes()))
+		} else {
+			n, ioError = io.Copy(writer, io.MultiReader(bytes.NewReader(replay.buf.Bytes()), timer))
+		}
+		closeErr = p.finish(n, ioError, timer, digest)
+		err = <-errCh
+	}
+	if err != nil {
 		return n, err
 	}
+	if ioError == nil && n > 0 {
+		p.client.uploadLatency.Add(p.client.config.Clock.Now().Sub(timer.last))
+	}
 
 	if ioError != nil {
 		return n, fmt.Errorf("error streaming data to segment %d: %w", index, ioError)
@@ -260,12 +395,60 @@ func (p *pendingPost) Write(data io.Reader) (int64, error) {
 	return n, nil
 }
 
+// Ends the upload once the data has been copied: closes the body on
+// success or cancels it on error so the server aborts the segment
+// rather than treating it as complete.
+func (p *pendingPost) finish(n int64, ioError error, timer *sendTimer, digest hash.Hash) error {
+	if ioError != nil {
+		p.writer.CloseWithError(ioError)
+		return nil
+	}
+	slog.Debug("Completed writing", "idx", p.index, "totalBytes", humanBytes(n))
+
+	// Stamp the segment with send times for latency measurements.
+	// Trailers are sent once the body is closed.
+	if n > 0 {
+		p.trailer.Set("Lp-Trickle-Sent", formatTrickleTime(timer.first))
+		p.trailer.Set("Lp-Trickle-Sent-End", formatTrickleTime(timer.last))
+		if digest != nil {
+			p.trailer.Set("Lp-Trickle-Digest", formatDigest(digest))
+		}
+	}
+
+	// Close the pipe writer to signal end of data for the current POST request
+	return p.writer.Close()
+}
+
+// How much of the start of a segment is kept to send again if its
+// preconnect turns out to have expired. The server stops reading an
+// expired preconnect right away, so only a little can go into one.
+const maxReplayBytes = 256 * 1024
+
+// Keeps a copy of the first bytes written to a preconnect
+type replayBuffer struct {
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (r *replayBuffer) Write(data []byte) (int, error) {
+	if !r.overflow {
+		if r.buf.Len()+len(data) > maxReplayBytes {
+			r.overflow = true
+			r.buf = bytes.Buffer{}
+		} else {
+			r.buf.Write(data)
+		}
+	}
+	return len(data), nil
+}
+
 /*
 Close a segment. This is a polite action to notify any
 subscribers that might be waiting for this segment.
 
 Only needed if the segment is dropped or otherwise errored;
-not required if the segment is written normally.
+not required if the segment is written normally. Segments that
+were partially written are marked as aborted for subscribers.
 
 Note that subscribers still work fine even without this call;
 it would just take longer for them to stop waiting when
@@ -281,11 +464,34 @@ func (p *pendingPost) Close() error {
 	// Since this method typically gets invoked when
 	// there is a problem sending the segment, use a
 	// new client for a fresh connection just in case
-	resp, err := httpClient().Do(req)
+	resp, err := p.client.freshClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return &HTTPError{Code: resp.StatusCode, Body: string(body)}
+	}
+	return nil
+}
+
+// WriteInit uploads the channel's init segment, eg CMAF ftyp + moov.
+// Subscribers fetch it from {url}/init or have it prepended on request.
+func (c *TricklePublisher) WriteInit(data []byte) error {
+	req, err := http.NewRequest("POST", c.baseURL+"/init", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", c.contentType)
+	resp, err := c.freshClient().Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return StreamNotFoundErr
+	}
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		return &HTTPError{Code: resp.StatusCode, Body: string(body)}
@@ -293,6 +499,42 @@ func (p *pendingPost) Close() error {
 	return nil
 }
 
+// NewEpoch starts a new epoch with the next segment to be written,
+// flagging it to subscribers as a discontinuity. Returns the new epoch.
+func (c *TricklePublisher) NewEpoch() (int, error) {
+	req, err := http.NewRequest("POST", c.baseURL+"/epoch", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", c.contentType)
+	resp, err := c.freshClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, StreamNotFoundErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return 0, &HTTPError{Code: resp.StatusCode, Body: string(body)}
+	}
+	return strconv.Atoi(resp.Header.Get("Lp-Trickle-Epoch"))
+}
+
+// LatencyStats summarizes the time taken for the server to
+// acknowledge recent segments after their last byte was sent
+func (c *TricklePublisher) LatencyStats() LatencySummary {
+	return c.uploadLatency.Summary()
+}
+
+// Subscribers returns the number of subscribers the server reported when
+// the most recent segment completed, or -1 if not known yet. Idle publishers
+// can watch the changefeed for the channel becoming watched instead.
+func (c *TricklePublisher) Subscribers() int {
+	return int(c.subscribers.Load())
+}
+
 // Write sends data to the current segment, sets up the next segment concurrently, and blocks until completion
 func (c *TricklePublisher) Write(data io.Reader) error {
 	pp, err := c.Next()
@@ -303,12 +545,42 @@ func (c *TricklePublisher) Write(data io.Reader) error {
 	return err
 }
 
+// How long unused connections stay open
+const idleConnTimeout = 90 * time.Second
+
 func httpClient() *http.Client {
 	return &http.Client{Transport: &http.Transport{
 		// Re-enable keepalives to avoid connection pooling
 		// DisableKeepAlives: true,
 		// ignore orch certs for now
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		// also closes pooled connections of clients that were replaced
+		IdleConnTimeout: idleConnTimeout,
+	}}
+}
+
+// Returns a client with a new connection pool. Over HTTP/2 the existing
+// client is reused instead since everything shares one connection.
+func (c *TricklePublisher) freshClient() *http.Client {
+	if c.config.HTTP2 {
+		if c.client == nil {
+			c.client = http2Client()
+		}
+		return c.client
+	}
+	return httpClient()
+}
+
+func http2Client() *http.Client {
+	protocols := &http.Protocols{}
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{
+		Protocols: protocols,
+		// ignore orch certs for now
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		// also closes pooled connections of clients that were replaced
+		IdleConnTimeout: idleConnTimeout,
 	}}
 }
 
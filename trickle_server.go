@@ -2,9 +2,11 @@ package trickle
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"maps"
@@ -34,10 +36,77 @@ type TrickleServerConfig struct {
 	// Amount of time a channel has no new segments before being swept (default 5 minutes)
 	IdleTimeout time.Duration
 
+	// Whether channel names may contain slashes, eg session/123/in, and
+	// to serve prefix operations, see names.go. URLs for such names span
+	// several path elements, so GET, POST and DELETE requests for any
+	// path of three or more elements under BasePath that no other route
+	// matches are routed to the server. Give it a BasePath of its own if
+	// the mux serves other routes there. (default false)
+	HierarchicalNames bool
+
+	// Overrides for channels under name prefixes, eg "session/", for
+	// hierarchical names. The longest matching prefix applies. (default none)
+	Prefixes map[string]PrefixConfig
+
 	// How often to sweep for idle channels (default 1 minute)
 	SweepInterval time.Duration
+
+	// Whether to enable the websocket publish endpoint (default false)
+	WebSocket bool
+
+	// Whether to serve multiplexed subscriptions to several channels
+	// at {BasePath}_subscribe, see mux.go (default false)
+	MuxSubscribe bool
+
+	// How often multiplexed subscriptions send a ping frame to keep
+	// idle connections from being dropped (default 10 seconds)
+	MuxPingInterval time.Duration
+
+	// Whether to expose channels as HLS playlists (default false)
+	HLS bool
+
+	// Longest LL-HLS partial segment; TS and CMAF segments are cut into
+	// parts of about this long as they are written. Requires HLS.
+	// (default 1 second)
+	HLSPartTarget time.Duration
+
+	// Whether to expose CMAF channels as DASH manifests (default false)
+	DASH bool
+
+	// Whether to announce channels gaining their first subscriber or
+	// losing their last one on the changefeed. Requires Changefeed. (default false)
+	SubscriberEvents bool
+
+	// How long a preconnected POST waits for its first byte before the
+	// server sends a keepalive (default 10 seconds)
+	FirstByteKeepalive time.Duration
+
+	// How to keep preconnected POSTs alive while they wait: with
+	// provisional 100 Continue or 103 Early Hints responses, or
+	// not at all. Some proxies drop connections on either kind.
+	// (default KeepaliveContinue)
+	Keepalive KeepaliveMode
+
+	// Longest a preconnected POST may wait for its first byte before
+	// the server closes it with a 408 and Lp-Trickle-Reconnect, so
+	// publishers reconnect rather than hit a proxy or server timeout.
+	// (default 0, no limit)
+	MaxPreconnectIdle time.Duration
+
+	// Source of time for idle sweeps, keepalives and segment
+	// timestamps, eg a fake clock in tests (default SystemClock)
+	Clock Clock
 }
 
+// KeepaliveMode selects how preconnected POSTs are kept alive
+type KeepaliveMode string
+
+const (
+	KeepaliveContinue   KeepaliveMode = "continue"
+	KeepaliveEarlyHints KeepaliveMode = "early-hints"
+	KeepaliveNone       KeepaliveMode = "none"
+)
+
 type Server struct {
 	mutex   sync.RWMutex
 	streams map[string]*Stream
@@ -46,6 +115,9 @@ type Server struct {
 
 	// for internal channels
 	internalPub *TrickleLocalPublisher
+
+	// multiplexed subscriptions, to follow new channels
+	muxes map[*muxSubscription]bool
 }
 
 type Stream struct {
@@ -55,8 +127,28 @@ type Stream struct {
 	mimeType  string
 	nextWrite int
 	writeTime time.Time
-	closed    bool
-	canReset  bool
+	clock     Clock
+	config    *TrickleServerConfig
+
+	// time of the first write, used to anchor the DASH timeline
+	firstWrite time.Time
+	closed     bool
+	canReset   bool
+
+	// initialization segment for the channel, eg CMAF ftyp + moov
+	init []byte
+
+	// epoch of the most recently started segment, and whether the
+	// next segment to start begins a new one
+	epoch    int
+	newEpoch bool
+
+	// active subscribers
+	presence presence
+
+	// closed and replaced whenever a segment starts or the stream
+	// closes, to wake up waiters that must not pre-create segments
+	changed chan struct{}
 }
 
 type Segment struct {
@@ -66,24 +158,95 @@ type Segment struct {
 	buffer *bytes.Buffer
 	closed bool
 
+	// closed without being completed, eg the publisher errored mid-segment
+	aborted bool
+
+	// the channel's epoch when the segment started, and whether
+	// it is the first segment of that epoch
+	epoch         int
+	discontinuity bool
+
+	// wall clock times of the first and last bytes written, and of completion
+	firstByte time.Time
+	lastByte  time.Time
+	ended     time.Time
+
+	// trailers from the publisher relayed to subscribers, eg send times
+	trailer http.Header
+
+	// running digest of the data, finalized once the segment is closed
+	hash   hash.Hash
+	digest string
+
 	// to shut down any pending publishers
 	closeCh chan bool
+
+	// LL-HLS parts cut so far, if the channel has them, see hls.go
+	parts *hlsParts
+
+	clock Clock
 }
 
 type SegmentSubscriber struct {
 	segment *Segment
 	readPos int
+
+	// stops waiting for data once done, if set
+	ctx context.Context
+}
+
+// ChannelInfo is served as JSON from {channel}/info
+type ChannelInfo struct {
+	Name        string           `json:"name"`
+	ContentType string           `json:"content_type"`
+	Latest      int              `json:"latest"`
+	Epoch       int              `json:"epoch"`
+	Closed      bool             `json:"closed,omitempty"`
+	Subscribers int              `json:"subscribers"`
+	Segments    []ChannelSegment `json:"segments"`
+}
+
+// ChannelSegment describes a segment that is still in the window
+type ChannelSegment struct {
+	Seq       int       `json:"seq"`
+	Bytes     int       `json:"bytes"`
+	FirstByte time.Time `json:"first_byte,omitzero"`
+	LastByte  time.Time `json:"last_byte,omitzero"`
+	Complete  bool      `json:"complete"`
+	Aborted   bool      `json:"aborted,omitempty"`
+	Digest    string    `json:"digest,omitempty"`
+
+	Epoch         int  `json:"epoch"`
+	Discontinuity bool `json:"discontinuity,omitempty"`
 }
 
 type Changefeed struct {
 	Added   []string `json:"added,omitempty"`
 	Removed []string `json:"removed,omitempty"`
+
+	// channels that gained their first subscriber or lost their last one
+	Watched   []string `json:"watched,omitempty"`
+	Unwatched []string `json:"unwatched,omitempty"`
 }
 
 const maxSegmentsPerStream = 5
 
+// Publisher trailers that get relayed to subscribers
+var relayedTrailers = []string{"Lp-Trickle-Sent", "Lp-Trickle-Sent-End"}
+
+// Init segments are buffered in full, so cap them
+const maxInitSize = 4 * 1024 * 1024
+
 var FirstByteTimeout = errors.New("pending read timeout")
 
+// Returned by timeoutReader once a preconnect has waited too long
+var preconnectIdleErr = errors.New("preconnect idle")
+
+// How long to wait for the first byte of a POST before sending a keepalive.
+// This can't be too short for now but ideally it'd be like 1 second
+// https://github.com/golang/go/issues/65035
+var firstByteKeepalive = 10 * time.Second
+
 func applyDefaults(config *TrickleServerConfig) {
 	if config.BasePath == "" {
 		config.BasePath = "/"
@@ -97,6 +260,19 @@ func applyDefaults(config *TrickleServerConfig) {
 	if config.SweepInterval == 0 {
 		config.SweepInterval = time.Minute
 	}
+	if config.FirstByteKeepalive == 0 {
+		config.FirstByteKeepalive = firstByteKeepalive
+	}
+	if config.Keepalive == "" {
+		config.Keepalive = KeepaliveContinue
+	}
+	if config.MuxPingInterval == 0 {
+		config.MuxPingInterval = muxPingInterval
+	}
+	if config.HLSPartTarget == 0 {
+		config.HLSPartTarget = time.Second
+	}
+	config.Clock = clockOrDefault(config.Clock)
 }
 
 func ConfigureServer(config TrickleServerConfig) *Server {
@@ -105,28 +281,64 @@ func ConfigureServer(config TrickleServerConfig) *Server {
 		config:  config,
 	}
 
+	applyDefaults(&streamManager.config)
+
 	// set up changefeed
 	if config.Changefeed {
 		streamManager.internalPub = NewLocalPublisher(streamManager, CHANGEFEED, "application/json")
 		streamManager.internalPub.CreateChannel()
 	}
-
-	applyDefaults(&streamManager.config)
 	var (
 		mux      = streamManager.config.Mux
 		basePath = streamManager.config.BasePath
+		handle   = func(pattern string, h http.HandlerFunc) {
+			mux.HandleFunc(pattern, streamManager.authorize(h))
+		}
 	)
 
-	mux.HandleFunc("POST "+basePath+"{streamName}", streamManager.handleCreate)
-	mux.HandleFunc("GET "+basePath+"{streamName}/{idx}", streamManager.handleGet)
-	mux.HandleFunc("POST "+basePath+"{streamName}/{idx}", streamManager.handlePost)
-	mux.HandleFunc("DELETE "+basePath+"{streamName}/{idx}", streamManager.closeSeq)
-	mux.HandleFunc("DELETE "+basePath+"{streamName}", streamManager.handleDelete)
+	handle("POST "+basePath+"{streamName}", streamManager.handleCreate)
+	handle("GET "+basePath+"{streamName}/{idx}", streamManager.handleGet)
+	handle("POST "+basePath+"{streamName}/{idx}", streamManager.handlePost)
+	handle("DELETE "+basePath+"{streamName}/{idx}", streamManager.closeSeq)
+	handle("DELETE "+basePath+"{streamName}", streamManager.handleDelete)
+	handle("GET "+basePath+"{streamName}/info", streamManager.handleInfo)
+	handle("GET "+basePath+"{streamName}/init", streamManager.handleGetInit)
+	handle("POST "+basePath+"{streamName}/init", streamManager.handlePostInit)
+	handle("POST "+basePath+"{streamName}/epoch", streamManager.handleNewEpoch)
+	handle("HEAD "+basePath+"{streamName}", streamManager.handleHeadChannel)
+	handle("GET "+basePath+"{streamName}/batch/{idx}", streamManager.handleBatch)
+	if streamManager.config.MuxSubscribe {
+		mux.HandleFunc("POST "+basePath+SUBSCRIBE, streamManager.handleSubscribe)
+	}
+	if streamManager.config.WebSocket {
+		handle("GET "+basePath+"{streamName}/ws", streamManager.handleWebSocket)
+	}
+	if streamManager.config.HLS {
+		handle("GET "+basePath+"{streamName}/hls/{file}", streamManager.handleHLS)
+	}
+	if streamManager.config.DASH {
+		handle("GET "+basePath+"{streamName}/dash/{file}", streamManager.handleDASH)
+	}
+
+	// hierarchical names and prefix operations, see names.go
+	if streamManager.config.HierarchicalNames {
+		handle("POST "+basePath+"{streamName}/"+channelSeparator, streamManager.handleCreate)
+		handle("DELETE "+basePath+"{streamName}/"+channelSeparator, streamManager.handleDelete)
+		handle("HEAD "+basePath+"{streamName}/"+channelSeparator, streamManager.handleHeadChannel)
+		mux.HandleFunc("GET "+basePath+channelSeparator+"/channels", streamManager.handleListAll)
+		mux.HandleFunc("DELETE "+basePath+channelSeparator+"/channels", streamManager.handleDeleteAll)
+		// at least three elements, so neither a GET / on the mux nor
+		// shorter paths are taken over; those are covered above
+		nested := basePath + "{first}/{second}/{rest...}"
+		mux.HandleFunc("GET "+nested, streamManager.handleNested)
+		mux.HandleFunc("POST "+nested, streamManager.handleNested)
+		mux.HandleFunc("DELETE "+nested, streamManager.handleNested)
+	}
 	return streamManager
 }
 
 func (sm *Server) Start() func() {
-	ticker := time.NewTicker(sm.config.SweepInterval)
+	ticker := sm.config.Clock.NewTicker(sm.config.SweepInterval)
 	done := make(chan bool)
 	stop := func() {
 		ticker.Stop()
@@ -135,7 +347,7 @@ func (sm *Server) Start() func() {
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				sm.sweepIdleChannels()
 			case <-done:
 				sm.clearAllStreams()
@@ -157,13 +369,22 @@ func (sm *Server) getOrCreateStream(streamName, mimeType string, isLocal bool) *
 	sm.mutex.Lock()
 
 	stream, exists := sm.streams[streamName]
-	if !exists && (isLocal || sm.config.Autocreate) {
+	if !exists && (isLocal || sm.config.Autocreate) && (isLocal || sm.validName(streamName)) {
 		stream = &Stream{
 			segments:  make([]*Segment, maxSegmentsPerStream),
 			name:      streamName,
 			mimeType:  mimeType,
-			writeTime: time.Now(),
+			writeTime: sm.config.Clock.Now(),
+			clock:     sm.config.Clock,
+			config:    &sm.config,
 			canReset:  !isLocal,
+			changed:   make(chan struct{}),
+		}
+		stream.presence.clock = sm.config.Clock
+		if sm.config.Changefeed && sm.config.SubscriberEvents && streamName != CHANGEFEED {
+			stream.presence.onChange = func(watched bool) {
+				sm.announcePresence(streamName, watched)
+			}
 		}
 		sm.streams[streamName] = stream
 		slog.Info("Creating stream", "stream", streamName)
@@ -175,6 +396,10 @@ func (sm *Server) getOrCreateStream(streamName, mimeType string, isLocal bool) *
 		return nil
 	}
 
+	if !exists {
+		sm.notifyMuxes(stream)
+	}
+
 	// update changefeed
 	if !exists && sm.config.Changefeed {
 		jb, _ := json.Marshal(&Changefeed{
@@ -201,7 +426,7 @@ func (sm *Server) sweepIdleChannels() {
 	sm.mutex.Lock()
 	streams := slices.Collect(maps.Values(sm.streams))
 	sm.mutex.Unlock()
-	now := time.Now()
+	now := sm.config.Clock.Now()
 	for _, s := range streams {
 		// skip internal channels for now, eg changefeed
 		if strings.HasPrefix(s.name, "_") {
@@ -210,7 +435,7 @@ func (sm *Server) sweepIdleChannels() {
 		s.mutex.Lock()
 		writeTime := s.writeTime
 		s.mutex.Unlock()
-		if now.Sub(writeTime) > sm.config.IdleTimeout {
+		if now.Sub(writeTime) > sm.idleTimeout(s.name) {
 			if err := sm.closeStream(s.name); err != nil {
 				slog.Warn("Could not close idle channel", "channel", s.name, "err", err)
 			} else {
@@ -223,11 +448,27 @@ func (sm *Server) sweepIdleChannels() {
 func (s *Stream) close() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	// anything still in progress is cut short
 	for _, segment := range s.segments {
-		segment.close()
+		segment.abort()
 	}
 	s.segments = make([]*Segment, maxSegmentsPerStream)
 	s.closed = true
+	s.notifyLocked()
+}
+
+// Wakes up anyone waiting on changes(). Expects the stream lock.
+func (s *Stream) notifyLocked() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Returns a channel that is closed on the next change to the stream.
+// Grab it before looking at the stream so no change is missed.
+func (s *Stream) changes() <-chan struct{} {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.changed
 }
 
 func (sm *Server) closeStream(streamName string) error {
@@ -239,6 +480,7 @@ func (sm *Server) closeStream(streamName string) error {
 	// TODO there is a bit of an issue around session reuse
 
 	stream.close()
+	stream.presence.stop()
 	sm.mutex.Lock()
 	delete(sm.streams, streamName)
 	sm.mutex.Unlock()
@@ -278,14 +520,26 @@ func (sm *Server) closeSeq(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	slog.Info("DELETE closing seq", "channel", s.name, "seq", idx)
+	if !s.closeSegment(idx) {
+		http.Error(w, "Nonexistent segment", http.StatusBadRequest)
+		return
+	}
+}
+
+// Closes a segment if it is still in the window. Returns false if not found.
+// Segments that are still in progress are aborted.
+func (s *Stream) closeSegment(idx int) bool {
+	if idx < 0 {
+		return false
+	}
 	s.mutex.RLock()
 	seg := s.segments[idx%maxSegmentsPerStream]
 	s.mutex.RUnlock()
 	if seg == nil || seg.idx != idx {
-		http.Error(w, "Nonexistent segment", http.StatusBadRequest)
-		return
+		return false
 	}
-	seg.close()
+	seg.abort()
+	return true
 }
 
 func (sm *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
@@ -311,9 +565,115 @@ func (sm *Server) handlePost(w http.ResponseWriter, r *http.Request) {
 	stream.handlePost(w, r, idx)
 }
 
+func (sm *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stream.info())
+}
+
+func (s *Stream) info() *ChannelInfo {
+	infos, nextWrite, closed := s.segmentInfos()
+	s.mutex.RLock()
+	epoch := s.epoch
+	s.mutex.RUnlock()
+	info := &ChannelInfo{
+		Name:        s.name,
+		ContentType: s.mimeType,
+		Latest:      nextWrite,
+		Epoch:       epoch,
+		Closed:      closed,
+		Subscribers: s.presence.count(),
+		Segments:    []ChannelSegment{},
+	}
+	for _, seg := range infos {
+		if seg.idx >= nextWrite {
+			continue // preconnected but not started
+		}
+		info.Segments = append(info.Segments, ChannelSegment{
+			Seq:       seg.idx,
+			Bytes:     seg.size,
+			FirstByte: seg.firstByte,
+			LastByte:  seg.lastByte,
+			Complete:  seg.closed,
+			Aborted:   seg.aborted,
+			Digest:    seg.digest,
+
+			Epoch:         seg.epoch,
+			Discontinuity: seg.discontinuity,
+		})
+	}
+	return info
+}
+
+func (sm *Server) handlePostInit(w http.ResponseWriter, r *http.Request) {
+	stream := sm.getOrCreateStream(r.PathValue("streamName"), r.Header.Get("Content-Type"), false)
+	if stream == nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxInitSize+1))
+	if err != nil {
+		slog.Info("Error reading init segment", "stream", stream.name, "err", err)
+		http.Error(w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > maxInitSize {
+		http.Error(w, "Init segment too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	stream.setInit(data)
+}
+
+func (sm *Server) handleNewEpoch(w http.ResponseWriter, r *http.Request) {
+	stream := sm.getOrCreateStream(r.PathValue("streamName"), r.Header.Get("Content-Type"), false)
+	if stream == nil {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	epoch := stream.startEpoch()
+	slog.Info("New epoch", "stream", stream.name, "epoch", epoch)
+	w.Header().Set("Lp-Trickle-Epoch", strconv.Itoa(epoch))
+}
+
+func (sm *Server) handleGetInit(w http.ResponseWriter, r *http.Request) {
+	stream, exists := sm.getStream(r.PathValue("streamName"))
+	if !exists {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	init := stream.getInit()
+	if init == nil {
+		// channel exists but has no init segment (yet)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", stream.mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(init)))
+	w.Write(init)
+}
+
+func (s *Stream) setInit(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	slog.Info("Setting init segment", "stream", s.name, "bytes", len(data))
+	s.init = data
+}
+
+func (s *Stream) getInit() []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.init
+}
+
 type timeoutReader struct {
 	body          io.ReadCloser
 	timeout       time.Duration
+	clock         Clock
+	idle          <-chan time.Time // fires once the preconnect is stale, if set
 	firstByteRead bool
 	readStarted   bool
 	ch            chan struct {
@@ -359,7 +719,9 @@ func (tr *timeoutReader) Read(p []byte) (int, error) {
 	case <-tr.closeCh:
 		// Signals preconnected publishers that are waiting
 		return 0, io.EOF
-	case <-time.After(tr.timeout):
+	case <-tr.idle:
+		return 0, preconnectIdleErr
+	case <-tr.clock.After(tr.timeout):
 		return 0, FirstByteTimeout
 	}
 }
@@ -378,12 +740,14 @@ func (s *Stream) handlePost(w http.ResponseWriter, r *http.Request, idx int) {
 	// Wrap the request body with the custom timeoutReader so we can send
 	// provisional headers (keepalives) until receiving the first byte
 	reader := &timeoutReader{
-		body: r.Body,
-		// This can't be too short for now but ideally it'd be like 1 second
-		// https://github.com/golang/go/issues/65035
-		timeout: 10 * time.Second,
+		body:    r.Body,
+		timeout: s.config.FirstByteKeepalive,
+		clock:   s.clock,
 		closeCh: segment.closeCh,
 	}
+	if s.config.MaxPreconnectIdle > 0 {
+		reader.idle = s.clock.After(s.config.MaxPreconnectIdle)
+	}
 	defer reader.Close()
 
 	buf := make([]byte, 1024*32) // 32kb to begin with
@@ -392,10 +756,7 @@ func (s *Stream) handlePost(w http.ResponseWriter, r *http.Request, idx int) {
 		n, err := reader.Read(buf)
 		if n > 0 {
 			if totalRead == 0 {
-				s.mutex.Lock()
-				s.nextWrite = idx + 1
-				s.writeTime = time.Now()
-				s.mutex.Unlock()
+				s.startWrite(segment)
 			}
 			segment.writeData(buf[:n])
 			if n == len(buf) && n < 1024*1024 { // 1 MB max
@@ -407,9 +768,25 @@ func (s *Stream) handlePost(w http.ResponseWriter, r *http.Request, idx int) {
 		if err != nil {
 			if err == FirstByteTimeout {
 				// Keepalive via provisional headers
-				slog.Info("Sending provisional headers for", "stream", s.name, "idx", idx)
-				w.WriteHeader(http.StatusContinue)
+				switch s.config.Keepalive {
+				case KeepaliveContinue:
+					slog.Info("Sending provisional headers for", "stream", s.name, "idx", idx)
+					w.WriteHeader(http.StatusContinue)
+				case KeepaliveEarlyHints:
+					slog.Info("Sending early hints for", "stream", s.name, "idx", idx)
+					w.WriteHeader(http.StatusEarlyHints)
+				}
 				continue
+			} else if err == preconnectIdleErr {
+				// Ask the publisher to reconnect before something
+				// along the way drops the connection instead
+				slog.Info("Closing idle preconnect", "stream", s.name, "idx", idx)
+				w.Header().Set("Lp-Trickle-Reconnect", "idle")
+				w.Header().Set("Lp-Trickle-Subscribers", strconv.Itoa(s.presence.count()))
+				w.Header().Set("Connection", "close")
+				w.WriteHeader(http.StatusRequestTimeout)
+				reader.skipClose = true
+				return
 			} else if err == io.EOF {
 				// Usually this comes from a preconnect where the underlying channel is closed
 				if totalRead <= 0 {
@@ -419,6 +796,7 @@ func (s *Stream) handlePost(w http.ResponseWriter, r *http.Request, idx int) {
 					if isClosed {
 						w.Header().Set("Lp-Trickle-Closed", "terminated")
 					}
+					w.Header().Set("Lp-Trickle-Subscribers", strconv.Itoa(s.presence.count()))
 					w.Header().Set("Connection", "close")
 					w.WriteHeader(http.StatusOK)
 					// we have read nothing; don't attempt to read anything more
@@ -429,15 +807,70 @@ func (s *Stream) handlePost(w http.ResponseWriter, r *http.Request, idx int) {
 				break
 			}
 			slog.Info("Error reading POST body", "stream", s.name, "idx", idx, "bytes written", totalRead, "err", err)
+			// let subscribers know the segment is incomplete;
+			// empty preconnects are left for a retry
+			if totalRead > 0 {
+				segment.abort()
+			}
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
 	}
 
+	// Trailers are only available once the body is read
+	segment.setTrailer(r.Trailer)
+
+	// Check the publisher's digest, if any, before completing the segment
+	if expected := r.Trailer.Get("Lp-Trickle-Digest"); expected != "" && totalRead > 0 {
+		if actual, ok := segment.checkDigest(expected); !ok {
+			slog.Warn("Segment digest mismatch", "stream", s.name, "idx", idx, "expected", expected, "actual", actual)
+			// corrupt data should not pass for a complete segment
+			segment.abort()
+			w.Header().Set("Lp-Trickle-Digest", actual)
+			http.Error(w, "Digest mismatch", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// Let the publisher know whether anyone is watching
+	w.Header().Set("Lp-Trickle-Subscribers", strconv.Itoa(s.presence.count()))
+
 	// Mark segment as closed
 	segment.close()
 }
 
+// Advances the write head once the first byte of a segment arrives
+func (s *Stream) startWrite(segment *Segment) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nextWrite = segment.idx + 1
+	s.writeTime = s.clock.Now()
+	if s.firstWrite.IsZero() {
+		s.firstWrite = s.writeTime
+	}
+	s.notifyLocked()
+
+	segment.mutex.Lock()
+	defer segment.mutex.Unlock()
+	if s.newEpoch {
+		s.newEpoch = false
+		s.epoch++
+		segment.discontinuity = true
+	} else if segment.discontinuity {
+		return // a retry of the first segment keeps its epoch
+	}
+	segment.epoch = s.epoch
+}
+
+// Starts a new epoch with the next segment, eg once the publisher
+// restarts with new encoder settings. Returns the new epoch.
+func (s *Stream) startEpoch() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.newEpoch = true
+	return s.epoch + 1
+}
+
 func (s *Stream) getForWrite(idx int) (*Segment, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -459,35 +892,40 @@ func (s *Stream) getForWrite(idx int) (*Segment, bool) {
 		}
 		// something exists here but its not the expected segment
 		// probably an old segment so overwrite it
-		segment.close()
+		segment.abort()
 	}
-	segment := newSegment(idx)
+	segment := s.newSegment(idx)
 	s.segments[segmentPos] = segment
 	return segment, false
 }
 
-func (s *Stream) getForRead(idx int) (*Segment, int, bool, bool) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-	exists := func(seg *Segment, i int) bool {
-		return seg != nil && seg.idx == i
-	}
+// Resolves the special -1 and -2 indices. Expects the stream lock.
+func (s *Stream) resolveIdx(idx int) int {
 	if idx == -1 {
 		// -1 == next write
-		idx = s.nextWrite
+		return s.nextWrite
 	} else if idx == -2 {
 		// -2 == current write
 		if s.nextWrite > 0 {
-			idx = s.nextWrite - 1
-		} else {
-			idx = 0
+			return s.nextWrite - 1
 		}
+		return 0
+	}
+	return idx
+}
+
+func (s *Stream) getForRead(idx int) (*Segment, int, bool, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	exists := func(seg *Segment, i int) bool {
+		return seg != nil && seg.idx == i
 	}
+	idx = s.resolveIdx(idx)
 	segmentPos := idx % maxSegmentsPerStream
 	segment := s.segments[segmentPos]
 	if !exists(segment, idx) && (idx == s.nextWrite || (s.nextWrite == 0 && idx == 1)) && !s.closed {
 		// read request is just a little bit ahead of write head
-		segment = newSegment(idx)
+		segment = s.newSegment(idx)
 		s.segments[segmentPos] = segment
 		slog.Info("GET precreating", "stream", s.name, "idx", idx, "next", s.nextWrite)
 	}
@@ -506,10 +944,43 @@ func (sm *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid idx", http.StatusBadRequest)
 		return
 	}
+	// Only pass on changes to channels the request may see, and that
+	// are under the prefix if there is one
+	if stream.name == CHANGEFEED && r.Method == http.MethodGet {
+		f := &changefeedFilter{ResponseWriter: w, sm: sm, r: r, prefix: r.URL.Query().Get("prefix")}
+		stream.handleGet(f, r, idx)
+		f.finish()
+		return
+	}
+	// GET routes also serve HEAD
+	if r.Method == http.MethodHead {
+		if idx < -2 {
+			http.Error(w, "Invalid idx", http.StatusBadRequest)
+			return
+		}
+		stream.handleHead(w, idx)
+		return
+	}
 	stream.handleGet(w, r, idx)
 }
 
 func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
+	wait, bounded, err := parseWait(r)
+	if err != nil {
+		http.Error(w, "Invalid wait", http.StatusBadRequest)
+		return
+	}
+	defer s.presence.add()()
+	if bounded && wait <= 0 {
+		// Non-blocking polls only look at what is already there
+		// rather than pre-creating the next segment
+		if segment, seq, latestSeq, pending, _ := s.peek(idx); segment == nil && pending {
+			w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
+			w.Header().Set("Lp-Trickle-Seq", strconv.Itoa(seq))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
 	segment, latestSeq, exists, closed := s.getForRead(idx)
 	if !exists {
 		w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
@@ -530,8 +1001,31 @@ func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
 		return
 	}
 
+	// Stop waiting for the first byte once the client's wait is up.
+	// Once data is flowing, only a hangup stops the segment.
+	waitCtx, cancelWait := context.WithCancel(r.Context())
+	defer cancelWait()
+	if bounded {
+		if wait <= 0 {
+			cancelWait()
+		} else {
+			defer s.clock.AfterFunc(wait, cancelWait).Stop()
+		}
+	}
+
+	// Wake up any pending read if the subscriber hangs up or stops
+	// waiting so it doesn't linger until the segment is written
+	defer context.AfterFunc(waitCtx, segment.wake)()
 	subscriber := &SegmentSubscriber{
 		segment: segment,
+		ctx:     waitCtx,
+	}
+
+	// Prepend the init segment if requested, eg for new subscribers
+	// joining at -2. The query param is for clients that can't set headers.
+	var init []byte
+	if r.Header.Get("Lp-Trickle-Init") != "" || r.URL.Query().Get("init") != "" {
+		init = s.getInit()
 	}
 
 	// Function to write data to the client
@@ -546,13 +1040,31 @@ func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
 			}
 
 			data, eof := subscriber.readData()
+			if r.Context().Err() != nil {
+				return totalWrites, fmt.Errorf("client disconnected")
+			}
 			if len(data) > 0 {
 				if totalWrites <= 0 {
+					subscriber.ctx = r.Context()
 					if segment.idx != latestSeq {
 						w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
 					}
 					w.Header().Set("Lp-Trickle-Seq", strconv.Itoa(segment.idx))
 					w.Header().Set("Content-Type", s.mimeType)
+					info := segment.info()
+					w.Header().Set("Lp-Trickle-Created", formatTrickleTime(info.firstByte))
+					w.Header().Set("Lp-Trickle-Epoch", strconv.Itoa(info.epoch))
+					if info.discontinuity {
+						w.Header().Set("Lp-Trickle-Discontinuity", "true")
+					}
+					w.Header().Set("Trailer", "Lp-Trickle-Last-Byte, Lp-Trickle-Bytes, Lp-Trickle-Digest, Lp-Trickle-Aborted")
+					if init != nil {
+						w.Header().Set("Lp-Trickle-Init", "prepended")
+						w.Header().Set("Lp-Trickle-Init-Bytes", strconv.Itoa(len(init)))
+						if _, err := w.Write(init); err != nil {
+							return totalWrites, err
+						}
+					}
 				}
 				n, err := w.Write(data)
 				totalWrites += n
@@ -563,6 +1075,20 @@ func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
 				flusher.Flush()
 			}
 			if eof {
+				if totalWrites > 0 {
+					info := segment.info()
+					w.Header().Set("Lp-Trickle-Last-Byte", formatTrickleTime(info.lastByte))
+					w.Header().Set("Lp-Trickle-Bytes", strconv.Itoa(info.size))
+					if info.digest != "" {
+						w.Header().Set("Lp-Trickle-Digest", info.digest)
+					}
+					if info.aborted {
+						w.Header().Set("Lp-Trickle-Aborted", "true")
+					}
+					for k, v := range segment.getTrailer() {
+						w.Header()[http.TrailerPrefix+k] = v
+					}
+				}
 				if totalWrites <= 0 {
 					// check if the channel was closed; sometimes we drop / skip a segment
 					s.mutex.RLock()
@@ -572,6 +1098,10 @@ func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
 					w.Header().Set("Lp-Trickle-Seq", strconv.Itoa(segment.idx))
 					if closed {
 						w.Header().Set("Lp-Trickle-Closed", "terminated")
+					} else if waitCtx.Err() != nil && !segment.info().closed {
+						// nothing yet; the client should ask for the same seq again
+						w.Header().Set("Lp-Trickle-Latest", strconv.Itoa(latestSeq))
+						w.WriteHeader(http.StatusNoContent)
 					} else {
 						// usually happens if a publisher cancels a pending segment right before closing the channel
 						// other times, the subscriber is slow and the segment falls out of the live window
@@ -592,29 +1122,82 @@ func (s *Stream) handleGet(w http.ResponseWriter, r *http.Request, idx int) {
 	}
 }
 
-func newSegment(idx int) *Segment {
+// How long the client is willing to wait for the first byte, from the
+// Lp-Trickle-Wait header or the wait query param, as a Go duration or
+// in seconds. Returns false if the client did not say, ie wait until
+// the segment is written.
+func parseWait(r *http.Request) (time.Duration, bool, error) {
+	v := r.Header.Get("Lp-Trickle-Wait")
+	if v == "" {
+		v = r.URL.Query().Get("wait")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), true, nil
+	}
+	d, err := time.ParseDuration(v)
+	return d, true, err
+}
+
+// Timestamps in headers and metadata are RFC 3339 in UTC
+func formatTrickleTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func newSegment(idx int, clock Clock) *Segment {
 	mu := &sync.Mutex{}
 	return &Segment{
 		idx:     idx,
 		buffer:  new(bytes.Buffer),
+		hash:    newDigest(),
 		cond:    sync.NewCond(mu),
 		mutex:   mu,
 		closeCh: make(chan bool),
+		clock:   clock,
 	}
 }
 
+// Segment for this stream, cut into LL-HLS parts if it has them
+func (s *Stream) newSegment(idx int) *Segment {
+	segment := newSegment(idx, s.clock)
+	if s.hasHLSParts() {
+		segment.parts = newHLSParts(s.config.HLSPartTarget, s.isCMAF())
+	}
+	return segment
+}
+
 func (segment *Segment) writeData(data []byte) {
 	segment.mutex.Lock()
 	defer segment.mutex.Unlock()
 
+	if len(data) > 0 {
+		now := segment.clock.Now()
+		if segment.parts != nil {
+			segment.parts.beforeWrite(segment.buffer.Bytes(), segment.lastByte, now)
+		}
+		segment.lastByte = now
+		if segment.buffer.Len() == 0 {
+			segment.firstByte = segment.lastByte
+		}
+	}
+
 	// Write to buffer
 	segment.buffer.Write(data)
+	segment.hash.Write(data)
 
 	// Signal waiting readers
 	segment.cond.Broadcast()
 }
 
 func (s *Segment) readData(startPos int) ([]byte, bool) {
+	return s.readDataContext(context.Background(), startPos)
+}
+
+// Like readData but returns early once ctx is done.
+// Pair with wake so a pending wait notices.
+func (s *Segment) readDataContext(ctx context.Context, startPos int) ([]byte, bool) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	for {
@@ -632,6 +1215,9 @@ func (s *Segment) readData(startPos int) ([]byte, bool) {
 		if s.closed {
 			return nil, true
 		}
+		if ctx.Err() != nil {
+			return nil, true
+		}
 		// Wait for new data
 		s.cond.Wait()
 	}
@@ -643,8 +1229,35 @@ func (s *Segment) close() {
 	}
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	s.closeLocked()
+}
+
+// Closes the segment as incomplete. No-op if it was already closed.
+func (s *Segment) abort() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.aborted = true
+		s.closeLocked()
+	}
+}
+
+func (s *Segment) closeLocked() {
 	if !s.closed {
 		s.closed = true
+		if s.buffer.Len() > 0 {
+			s.ended = s.clock.Now()
+		}
+		// a digest of partial data is not useful
+		if s.digest == "" && !s.aborted {
+			s.digest = formatDigest(s.hash)
+		}
+		if s.parts != nil {
+			s.parts.finish(s.buffer.Len(), s.ended, s.aborted)
+		}
 		close(s.closeCh)
 		s.cond.Broadcast()
 	}
@@ -666,10 +1279,108 @@ func (s *Segment) reset() int {
 	// Kick off any writers
 	s.closeCh = make(chan bool, 1)
 	s.closed = false
+	s.aborted = false
 	s.buffer.Reset()
+	s.hash.Reset()
+	s.digest = ""
+	s.firstByte, s.lastByte, s.ended = time.Time{}, time.Time{}, time.Time{}
+	s.trailer = nil
+	if s.parts != nil {
+		s.parts.reset()
+	}
 	return blen
 }
 
+func (s *Segment) setTrailer(trailer http.Header) {
+	relayed := http.Header{}
+	for _, k := range relayedTrailers {
+		if v := trailer.Get(k); v != "" {
+			relayed.Set(k, v)
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.trailer = relayed
+}
+
+// Compares the digest of the data so far against the expected one.
+// On mismatch the segment takes on the expected digest so that
+// verifying subscribers reject it; returns the actual digest.
+func (s *Segment) checkDigest(expected string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	actual := formatDigest(s.hash)
+	if actual == expected {
+		return actual, true
+	}
+	s.digest = expected
+	return actual, false
+}
+
+func (s *Segment) getTrailer() http.Header {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.trailer
+}
+
+// Point in time view of a segment
+type segmentInfo struct {
+	idx       int
+	size      int
+	firstByte time.Time
+	lastByte  time.Time
+	ended     time.Time
+	closed    bool
+	aborted   bool
+	digest    string
+	parts     []segmentPart
+
+	epoch         int
+	discontinuity bool
+}
+
+func (s *Segment) info() segmentInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return segmentInfo{
+		idx:       s.idx,
+		size:      s.buffer.Len(),
+		firstByte: s.firstByte,
+		lastByte:  s.lastByte,
+		ended:     s.ended,
+		closed:    s.closed,
+		aborted:   s.aborted,
+		digest:    s.digest,
+		parts:     s.parts.clone(),
+
+		epoch:         s.epoch,
+		discontinuity: s.discontinuity,
+	}
+}
+
+// Returns the segments in the window ordered by seq, along with
+// the next write position and whether the stream is closed
+func (s *Stream) segmentInfos() ([]segmentInfo, int, bool) {
+	s.mutex.RLock()
+	segments := slices.Clone(s.segments)
+	nextWrite, closed := s.nextWrite, s.closed
+	s.mutex.RUnlock()
+	infos := []segmentInfo{}
+	for _, seg := range segments {
+		if seg != nil {
+			infos = append(infos, seg.info())
+		}
+	}
+	slices.SortFunc(infos, func(a, b segmentInfo) int { return a.idx - b.idx })
+	return infos, nextWrite, closed
+}
+
+func (s *Segment) isClosed() (bool, chan bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed, s.closeCh
+}
+
 func (s *Segment) isFresh() bool {
 	// fresh segments have not been written to yet
 	s.mutex.Lock()
@@ -677,8 +1388,19 @@ func (s *Segment) isFresh() bool {
 	return !s.closed && s.buffer.Len() == 0
 }
 
+// Wakes up any pending reads so they can check their context
+func (s *Segment) wake() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
 func (ss *SegmentSubscriber) readData() ([]byte, bool) {
-	data, eof := ss.segment.readData(ss.readPos)
+	ctx := ss.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	data, eof := ss.segment.readDataContext(ctx, ss.readPos)
 	ss.readPos += len(data)
 	return data, eof
 }
@@ -0,0 +1,513 @@
+package trickle
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, config TrickleServerConfig, h2c bool) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	config.Mux = mux
+	srv := ConfigureServer(config)
+	ts := httptest.NewUnstartedServer(mux)
+	if h2c {
+		ts.Config.Protocols = &http.Protocols{}
+		ts.Config.Protocols.SetHTTP1(true)
+		ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	// Runs before ts.Close to release any preconnected GETs
+	t.Cleanup(srv.Start())
+	return ts
+}
+
+func setKeepalive(t *testing.T, d time.Duration) {
+	t.Helper()
+	orig := firstByteKeepalive
+	firstByteKeepalive = d
+	t.Cleanup(func() { firstByteKeepalive = orig })
+}
+
+// Preconnect a POST, stall before sending data, and make sure
+// provisional responses keep arriving until the data does.
+func testPostKeepalive(t *testing.T, h2c bool) {
+	setKeepalive(t, 50*time.Millisecond)
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, h2c)
+
+	client := httpClient()
+	if h2c {
+		client = http2Client()
+	}
+	var continues atomic.Int32
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				continues.Add(1)
+			}
+			return nil
+		},
+	}
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", ts.URL+"/keepalive/0", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := client.Do(req)
+		done <- result{resp, err}
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	payload := bytes.Repeat([]byte("a"), 100000)
+	if _, err := pw.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	res := <-done
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	defer res.resp.Body.Close()
+	if res.resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.resp.StatusCode)
+	}
+	wantProto := 1
+	if h2c {
+		wantProto = 2
+	}
+	if res.resp.ProtoMajor != wantProto {
+		t.Errorf("expected HTTP/%d, got %s", wantProto, res.resp.Proto)
+	}
+	if continues.Load() < 2 {
+		t.Errorf("expected repeated 100 Continue keepalives, got %d", continues.Load())
+	}
+
+	sub := NewTrickleSubscriberWithConfig(ts.URL+"/keepalive", TrickleSubscriberConfig{HTTP2: h2c})
+	sub.SetSeq(0)
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("subscriber got %d bytes, expected %d", len(body), len(payload))
+	}
+}
+
+func TestHandlePost_KeepaliveHTTP1(t *testing.T) {
+	testPostKeepalive(t, false)
+}
+
+func TestHandlePost_KeepaliveH2C(t *testing.T) {
+	testPostKeepalive(t, true)
+}
+
+func TestHTTP2_SingleConnection(t *testing.T) {
+	setKeepalive(t, 50*time.Millisecond)
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux, Autocreate: true})
+	// track connections that actually carry requests; the transport
+	// may race an extra dial on startup that is then discarded
+	var (
+		connsMu sync.Mutex
+		conns   = map[string]bool{}
+	)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connsMu.Lock()
+		conns[r.RemoteAddr] = true
+		connsMu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	ts.Config.Protocols = &http.Protocols{}
+	ts.Config.Protocols.SetHTTP1(true)
+	ts.Config.Protocols.SetUnencryptedHTTP2(true)
+	ts.Start()
+	defer ts.Close()
+	defer srv.Start()()
+
+	pub, err := NewTricklePublisherWithConfig(ts.URL+"/multiplex", TricklePublisherConfig{HTTP2: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTrickleSubscriberWithConfig(ts.URL+"/multiplex", TrickleSubscriberConfig{HTTP2: true})
+	sub.SetSeq(0)
+
+	const segments = 5
+	go func() {
+		for i := 0; i < segments; i++ {
+			if err := pub.Write(bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 5000))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < segments; i++ {
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if GetSeq(resp) != i || len(body) != 5000 || body[0] != byte(i) {
+			t.Fatalf("unexpected segment seq=%d len=%d", GetSeq(resp), len(body))
+		}
+	}
+	if err := pub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// one connection for the publisher and one for the subscriber
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	if n := len(conns); n != 2 {
+		t.Errorf("expected 2 connections, got %d", n)
+	}
+}
+
+func TestSegmentTimestamps(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux, Autocreate: true})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	t.Cleanup(srv.Start())
+
+	pub, err := NewTricklePublisher(ts.URL + "/times")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTrickleSubscriber(ts.URL + "/times")
+	sub.SetSeq(0)
+
+	before := time.Now()
+	pr, pw := io.Pipe()
+	go pub.Write(pr)
+	pw.Write([]byte("first"))
+
+	// the response only starts once the server has the first byte, so
+	// the gap is not eaten into by getting it there
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	pw.Write([]byte("second"))
+	pw.Close()
+	created, ok := GetCreated(resp)
+	if !ok || created.Before(before) || created.After(time.Now()) {
+		t.Errorf("unexpected created time %v", resp.Header.Get("Lp-Trickle-Created"))
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	lastByte, err := time.Parse(time.RFC3339Nano, resp.Trailer.Get("Lp-Trickle-Last-Byte"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastByte.Sub(created) < 100*time.Millisecond {
+		t.Errorf("expected last byte at least 100ms after first byte, got %v", lastByte.Sub(created))
+	}
+	if resp.Trailer.Get("Lp-Trickle-Bytes") != "11" {
+		t.Errorf("unexpected size trailer %q", resp.Trailer.Get("Lp-Trickle-Bytes"))
+	}
+
+	info, err := sub.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "times" || info.Latest != 1 || len(info.Segments) != 1 {
+		t.Fatalf("unexpected info %+v", info)
+	}
+	seg := info.Segments[0]
+	if seg.Seq != 0 || seg.Bytes != 11 || !seg.Complete || !seg.FirstByte.Equal(created) || !seg.LastByte.Equal(lastByte) {
+		t.Errorf("unexpected segment info %+v", seg)
+	}
+	if _, err := NewTrickleSubscriber(ts.URL + "/missing").Info(); err != StreamNotFoundErr {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+
+	// local subscribers get the same metadata
+	local := NewLocalSubscriber(srv, "times")
+	local.SetSeq(0)
+	data, err := local.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Metadata["Lp-Trickle-Created"] != resp.Header.Get("Lp-Trickle-Created") {
+		t.Errorf("unexpected local created time %q", data.Metadata["Lp-Trickle-Created"])
+	}
+	if data.Metadata["Lp-Trickle-Bytes"] != "11" {
+		t.Errorf("unexpected local size %q", data.Metadata["Lp-Trickle-Bytes"])
+	}
+}
+
+func TestSegmentAbort(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/abort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	sub := NewTrickleSubscriber(ts.URL + "/abort")
+	sub.SetSeq(0)
+
+	// the publisher errors partway through the segment
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("partial"))
+		time.Sleep(50 * time.Millisecond)
+		pw.CloseWithError(errors.New("encoder crashed"))
+	}()
+	pubErr := make(chan error, 1)
+	go func() { pubErr <- pub.Write(pr) }()
+
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !errors.Is(err, ErrSegmentAborted) || string(data) != "partial" {
+		t.Errorf("expected aborted segment, got %q %v", data, err)
+	}
+	if err := <-pubErr; err == nil {
+		t.Error("expected publisher error")
+	}
+
+	// late joiners see the same
+	late := NewTrickleSubscriber(ts.URL + "/abort")
+	late.SetSeq(0)
+	resp, err = late.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(resp.Body); !errors.Is(err, ErrSegmentAborted) {
+		t.Errorf("expected aborted segment for late subscriber, got %v", err)
+	}
+	resp.Body.Close()
+
+	info, err := late.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Segments) != 1 || !info.Segments[0].Aborted || info.Segments[0].Digest != "" {
+		t.Errorf("unexpected info %+v", info.Segments)
+	}
+
+	// completed segments are unaffected
+	if err := pub.Write(bytes.NewReader([]byte("complete"))); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = late.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(resp.Body); err != nil || string(data) != "complete" {
+		t.Errorf("unexpected segment %q %v", data, err)
+	}
+	resp.Body.Close()
+}
+
+func TestSegmentAbort_Local(t *testing.T) {
+	srv := ConfigureServer(TrickleServerConfig{Mux: http.NewServeMux()})
+	pub := NewLocalPublisher(srv, "abort", "application/octet-stream")
+	pub.CreateChannel()
+	sub := NewLocalSubscriber(srv, "abort")
+	sub.SetSeq(0)
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("partial"))
+		pw.CloseWithError(errors.New("encoder crashed"))
+	}()
+	if err := pub.Write(pr); err == nil {
+		t.Error("expected publisher error")
+	}
+	segment, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := io.ReadAll(segment.Reader); !errors.Is(err, ErrSegmentAborted) || string(data) != "partial" {
+		t.Errorf("expected aborted segment, got %q %v", data, err)
+	}
+}
+
+func TestLateJoin_Header(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux, Autocreate: true, HLS: true})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	t.Cleanup(srv.Start())
+
+	url := ts.URL + "/late"
+	pub, err := NewTricklePublisherWithConfig(url, TricklePublisherConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	header := []byte("PAT and PMT")
+	if err := pub.WriteInit(header); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscribers join at -2 while the segment is in progress
+	pr, pw := io.Pipe()
+	go pub.Write(pr)
+	pw.Write([]byte("first half "))
+	waitFor := func(cond func() bool) {
+		t.Helper()
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	stream, _ := srv.getStream("late")
+	waitFor(func() bool { return stream.info().Latest == 1 })
+
+	sub := NewTrickleSubscriberWithConfig(url, TrickleSubscriberConfig{PrependInit: true})
+	sub.SetSeq(-2)
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GetSeq(resp) != 0 || resp.Header.Get("Lp-Trickle-Init") == "" {
+		t.Errorf("unexpected seq %d or missing init header", GetSeq(resp))
+	}
+
+	local := NewLocalSubscriber(srv, "late")
+	local.SetPrependInit(true)
+	local.SetSeq(-2)
+	localSeg, err := local.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain, err := http.Get(url + "/-2?init=prepend")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pw.Write([]byte("second half"))
+	pw.Close()
+	expected := "PAT and PMTfirst half second half"
+	if data, err := io.ReadAll(resp.Body); err != nil || string(data) != expected {
+		t.Errorf("unexpected segment %q %v", data, err)
+	}
+	resp.Body.Close()
+	if data, err := io.ReadAll(localSeg.Reader); err != nil || string(data) != expected {
+		t.Errorf("unexpected local segment %q %v", data, err)
+	}
+	if localSeg.Metadata["Lp-Trickle-Init-Bytes"] != "11" {
+		t.Errorf("unexpected local metadata %v", localSeg.Metadata)
+	}
+	if data, err := io.ReadAll(plain.Body); err != nil || string(data) != expected {
+		t.Errorf("unexpected segment for query param %q %v", data, err)
+	}
+	plain.Body.Close()
+
+	// TS headers are not mistaken for CMAF
+	_, playlist := httpGet(t, url+"/hls/index.m3u8")
+	if !strings.Contains(playlist, `#EXT-X-MAP:URI="init.ts"`) || !strings.Contains(playlist, "0.ts") {
+		t.Errorf("unexpected playlist:\n%s", playlist)
+	}
+	if _, body := httpGet(t, url+"/hls/init.ts"); body != string(header) {
+		t.Errorf("unexpected header %q", body)
+	}
+}
+
+func TestPublisher_ExpiredPreconnectKeepsClient(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, MaxPreconnectIdle: 50 * time.Millisecond}, false)
+	pub, err := NewTricklePublisher(ts.URL + "/expiry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+	client := pub.client
+
+	// let the preconnect expire and the publisher see it
+	time.Sleep(200 * time.Millisecond)
+	if err := pub.Write(bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	// reconnecting an expired preconnect does not leave a transport behind
+	if pub.client != client {
+		t.Error("expected the publisher to keep its client")
+	}
+	sub := NewTrickleSubscriber(ts.URL + "/expiry")
+	sub.SetSeq(0)
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "data" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
+
+func TestWait_NonBlockingPeeks(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := ConfigureServer(TrickleServerConfig{Mux: mux})
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	t.Cleanup(srv.Start())
+	pub := NewLocalPublisher(srv, "poll", "video/MP2T")
+	pub.CreateChannel()
+
+	for _, url := range []string{"/poll/-1?wait=0", "/poll/0?wait=0"} {
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent || GetSeq(resp) != 0 || GetLatest(resp) != 0 {
+			t.Errorf("%s: unexpected response %d %v", url, resp.StatusCode, resp.Header)
+		}
+	}
+
+	// polling leaves the ring alone
+	stream, _ := srv.getStream("poll")
+	stream.mutex.RLock()
+	defer stream.mutex.RUnlock()
+	for _, segment := range stream.segments {
+		if segment != nil {
+			t.Errorf("unexpected segment %d created by the poll", segment.idx)
+		}
+	}
+}
@@ -2,10 +2,12 @@ package trickle
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"strconv"
 	"sync"
@@ -14,6 +16,10 @@ import (
 
 var EOS = errors.New("End of stream")
 
+// Returned from the segment body in place of io.EOF if the
+// publisher did not complete the segment, eg it errored midway
+var ErrSegmentAborted = errors.New("segment aborted")
+
 type SequenceNonexistent struct {
 	Latest int
 	Seq    int
@@ -23,10 +29,15 @@ func (e *SequenceNonexistent) Error() string {
 	return fmt.Sprintf("Channel exists but sequence does not: requested %d latest %d", e.Seq, e.Latest)
 }
 
-const preconnectRefreshTimeout = 20 * time.Second
-
 var preconnectTimeoutErr = errors.New("preconnect timed out")
 
+// Bounds on the pause before asking again after a 204 that came back
+// well before the requested wait, eg from a proxy that doesn't hold GETs
+const (
+	waitBackoffMin = 50 * time.Millisecond
+	waitBackoffMax = time.Second
+)
+
 // TrickleSubscriber represents a trickle streaming reader that always fetches from index -1
 type TrickleSubscriber struct {
 	client     *http.Client
@@ -36,21 +47,89 @@ type TrickleSubscriber struct {
 	ctx        context.Context // Parent context to use for pending GETs. This is bad
 	cancelCtx  func()          // cancel the pending GET
 	idx        int             // Segment index to request
+	config     TrickleSubscriberConfig
+	needsInit  bool // whether to ask for the init segment to be prepended
+	epoch      int  // epoch of the last segment read, or -1 if none
+
+	// catch-up batch being read, if any
+	needsBatch bool
+	batch      *multipart.Reader
+	batchResp  *http.Response
+
+	firstByteLatency    LatencyStats
+	glassToGlassLatency LatencyStats
 
 	// Number of errors from preconnect
 	preconnectErrorCount int
 }
 
+type TrickleSubscriberConfig struct {
+	// Multiplex preconnects and segments over a single HTTP/2 connection.
+	// Uses h2c for http:// URLs so the server must support it. (default false)
+	HTTP2 bool
+
+	// Prepend the channel's init segment to the first segment read,
+	// eg for CMAF. Also applies after SetSeq. (default false)
+	PrependInit bool
+
+	// Invoked with the latency of each segment once it is read to the end.
+	// Only available if the publisher stamps segments with send times.
+	OnLatency func(SegmentLatency)
+
+	// Check each segment against the server's digest once it is read
+	// to the end. Mismatches are returned from the body as a
+	// ChecksumMismatchError instead of io.EOF. (default false)
+	VerifyDigest bool
+
+	// How long a preconnected GET may wait for its segment before it
+	// is re-established, eg to get past idle timeouts in proxies
+	// (default 20 seconds)
+	PreconnectRefresh time.Duration
+
+	// Ask the server to hold GETs for at most this long before
+	// answering 204, and then ask again. Replaces PreconnectRefresh
+	// for servers that support Lp-Trickle-Wait. Keep it below any
+	// proxy or server timeouts. 204s that come back early are retried
+	// with a short backoff, or after their Retry-After.
+	// (default 0, refresh on the client)
+	Wait time.Duration
+
+	// Catch up on completed segments with a single batch GET when
+	// reading from an earlier seq, initially or after SetSeq. Each
+	// segment must be read before the next Read. (default false)
+	Batch bool
+
+	// Source of time for preconnect refreshes, Wait backoffs and
+	// latency measurements, eg a fake clock in tests (default SystemClock)
+	Clock Clock
+}
+
 // NewTrickleSubscriber creates a new trickle stream reader for GET requests
 func NewTrickleSubscriber(url string) *TrickleSubscriber {
+	return NewTrickleSubscriberWithConfig(url, TrickleSubscriberConfig{})
+}
+
+func NewTrickleSubscriberWithConfig(url string, config TrickleSubscriberConfig) *TrickleSubscriber {
 	// No preconnect needed here; it will be handled by the first Read call.
 	ctx, cancel := context.WithCancel(context.Background())
+	if config.PreconnectRefresh == 0 {
+		config.PreconnectRefresh = 20 * time.Second
+	}
+	config.Clock = clockOrDefault(config.Clock)
+	client := httpClient()
+	if config.HTTP2 {
+		client = http2Client()
+	}
 	return &TrickleSubscriber{
-		client:    httpClient(),
-		url:       url,
-		ctx:       ctx,
-		cancelCtx: cancel,
-		idx:       -1, // shortcut for 'latest'
+		client:     client,
+		url:        url,
+		ctx:        ctx,
+		cancelCtx:  cancel,
+		idx:        -1, // shortcut for 'latest'
+		config:     config,
+		needsInit:  config.PrependInit,
+		needsBatch: config.Batch,
+		epoch:      -1,
 	}
 }
 
@@ -80,6 +159,33 @@ func GetLatest(resp *http.Response) int {
 	return i
 }
 
+// GetCreated returns when the server received the first byte of the segment
+func GetCreated(resp *http.Response) (time.Time, bool) {
+	if resp == nil {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, resp.Header.Get("Lp-Trickle-Created"))
+	return t, err == nil
+}
+
+// GetEpoch returns the channel's epoch when the segment started,
+// or 0 if the server did not say
+func GetEpoch(resp *http.Response) int {
+	if resp == nil {
+		return 0
+	}
+	i, _ := strconv.Atoi(resp.Header.Get("Lp-Trickle-Epoch"))
+	return i
+}
+
+// IsDiscontinuity reports whether the segment starts a new epoch,
+// eg so decoders can reinitialize. TrickleSubscriber also flags
+// segments where the epoch changed since the previous read, in
+// case the first segment of the epoch was skipped.
+func IsDiscontinuity(resp *http.Response) bool {
+	return resp.Header.Get("Lp-Trickle-Discontinuity") != ""
+}
+
 func IsEOS(resp *http.Response) bool {
 	return resp.Header.Get("Lp-Trickle-Closed") != ""
 }
@@ -94,6 +200,130 @@ func (c *TrickleSubscriber) SetSeq(seq int) {
 	c.ctx, c.cancelCtx = context.WithCancel(context.Background())
 	c.pendingGet = nil
 	c.preconnectErrorCount = 0
+	c.needsInit = c.config.PrependInit
+	if c.batchResp != nil {
+		c.batchResp.Body.Close()
+		c.batch, c.batchResp = nil, nil
+	}
+	c.needsBatch = c.config.Batch
+}
+
+// ReadInit fetches the channel's init segment, eg CMAF ftyp + moov.
+// Returns nil if the channel does not have one.
+func (c *TrickleSubscriber) ReadInit() ([]byte, error) {
+	resp, err := c.client.Get(c.url + "/init")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusNotFound:
+		return nil, StreamNotFoundErr
+	}
+	return nil, &HTTPError{Code: resp.StatusCode, Body: string(body)}
+}
+
+// Info fetches the channel's current state, including timestamps
+// and sizes of the segments in the window
+func (c *TrickleSubscriber) Info() (*ChannelInfo, error) {
+	return fetchInfo(c.client, c.url)
+}
+
+func fetchInfo(client *http.Client, url string) (*ChannelInfo, error) {
+	resp, err := client.Get(url + "/info")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, StreamNotFoundErr
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &HTTPError{Code: resp.StatusCode, Body: string(body)}
+	}
+	info := &ChannelInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// SegmentProbe is the state of a segment as reported by a HEAD probe
+type SegmentProbe struct {
+	Seq         int
+	Latest      int // the channel's next write
+	Subscribers int
+	ContentType string
+	Bytes       int // written so far
+	Epoch       int
+	Complete    bool
+	Aborted     bool
+	Closed      bool // the channel has ended and the segment is empty
+	Pending     bool // not started yet; a read would wait for the publisher
+}
+
+// Probe reports the state of a segment without reading it, waiting for
+// the publisher or preconnecting. -1 is the next write and -2 the most
+// recent segment. Returns SequenceNonexistent if the segment is not in
+// the window.
+func (c *TrickleSubscriber) Probe(seq int) (*SegmentProbe, error) {
+	resp, err := c.client.Head(fmt.Sprintf("%s/%d", c.url, seq))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, StreamNotFoundErr
+	case 470:
+		return nil, &SequenceNonexistent{Seq: GetSeq(resp), Latest: GetLatest(resp)}
+	default:
+		return nil, &HTTPError{Code: resp.StatusCode}
+	}
+	probe := &SegmentProbe{
+		Seq:         GetSeq(resp),
+		Latest:      GetLatest(resp),
+		ContentType: resp.Header.Get("Content-Type"),
+		Epoch:       GetEpoch(resp),
+		Complete:    resp.Header.Get("Lp-Trickle-Complete") != "",
+		Aborted:     resp.Header.Get("Lp-Trickle-Aborted") != "",
+		Closed:      IsEOS(resp),
+	}
+	probe.Subscribers, _ = strconv.Atoi(resp.Header.Get("Lp-Trickle-Subscribers"))
+	probe.Bytes, _ = strconv.Atoi(resp.Header.Get("Lp-Trickle-Bytes"))
+	_, created := GetCreated(resp)
+	probe.Pending = !created && !probe.Complete && !probe.Aborted && !probe.Closed
+	return probe, nil
+}
+
+func (c *TrickleSubscriber) recordLatency(resp *http.Response, firstByte, lastByte time.Time) {
+	latency, ok := segmentLatency(resp, firstByte, lastByte)
+	if !ok {
+		return
+	}
+	c.firstByteLatency.Add(latency.FirstByte)
+	c.glassToGlassLatency.Add(latency.GlassToGlass)
+	if c.config.OnLatency != nil {
+		c.config.OnLatency(latency)
+	}
+}
+
+// LatencyStats summarizes the latencies of recently read segments
+func (c *TrickleSubscriber) LatencyStats() SubscriberLatency {
+	return SubscriberLatency{
+		FirstByte:    c.firstByteLatency.Summary(),
+		GlassToGlass: c.glassToGlassLatency.Summary(),
+	}
 }
 
 func (c *TrickleSubscriber) connect(ctx context.Context) (*http.Response, error) {
@@ -105,6 +335,12 @@ func (c *TrickleSubscriber) connect(ctx context.Context) (*http.Response, error)
 		slog.Error("Failed to create request for segment", "url", url, "err", err)
 		return nil, err
 	}
+	if c.needsInit {
+		req.Header.Set("Lp-Trickle-Init", "prepend")
+	}
+	if c.config.Wait > 0 {
+		req.Header.Set("Lp-Trickle-Wait", c.config.Wait.String())
+	}
 
 	// Execute the GET request
 	resp, err := c.client.Do(req)
@@ -115,7 +351,7 @@ func (c *TrickleSubscriber) connect(ctx context.Context) (*http.Response, error)
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
 		resp.Body.Close() // Ensure we close the body to avoid leaking connections
-		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == 470 {
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == 470 || resp.StatusCode == http.StatusNoContent {
 			return resp, nil
 		}
 		return nil, fmt.Errorf("failed GET segment, status code: %d, msg: %s", resp.StatusCode, string(body))
@@ -125,10 +361,47 @@ func (c *TrickleSubscriber) connect(ctx context.Context) (*http.Response, error)
 	return resp, nil
 }
 
+// Seconds from the Retry-After header of a response, if it has one
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0, false
+	}
+	return time.Duration(secs) * time.Second, true
+}
+
 // preconnect pre-initializes the next GET request for fetching the next segment
 // This blocks until headers are received  as soon as data is ready.
 // If blocking takes a while, it re-creates the connection every so often.
 func (c *TrickleSubscriber) preconnect() (*http.Response, error) {
+	if c.config.Wait > 0 {
+		// the server bounds the wait, so keep asking until there is data
+		var backoff time.Duration
+		for {
+			// the server holds the GET on its own clock, so this is wall time
+			start := time.Now()
+			resp, err := c.connect(c.ctx)
+			if err != nil || resp.StatusCode != http.StatusNoContent {
+				return resp, err
+			}
+			delay, ok := retryAfter(resp)
+			if !ok {
+				if time.Since(start) < c.config.Wait/2 {
+					backoff = min(max(2*backoff, waitBackoffMin), waitBackoffMax)
+				} else {
+					backoff = 0
+				}
+				delay = backoff
+			}
+			if delay > 0 {
+				select {
+				case <-c.config.Clock.After(delay):
+				case <-c.ctx.Done():
+					return nil, c.ctx.Err()
+				}
+			}
+		}
+	}
 	respCh := make(chan *http.Response, 1)
 	errCh := make(chan error, 1)
 	runConnect := func(ctx context.Context) {
@@ -153,7 +426,7 @@ func (c *TrickleSubscriber) preconnect() (*http.Response, error) {
 			return nil, err
 		case resp := <-respCh:
 			return resp, nil
-		case <-time.After(preconnectRefreshTimeout):
+		case <-c.config.Clock.After(c.config.PreconnectRefresh):
 			// Use a custom error for the timeout to avoid clashes with parent cancellations
 			// Not doing so could lead to a deadlock due to runConnect returning nothing
 			cancel(preconnectTimeoutErr)
@@ -179,8 +452,23 @@ func (c *TrickleSubscriber) Read() (*http.Response, error) {
 		return nil, fmt.Errorf("Hit max preconnects")
 	}
 
+	// Catch up with a batch if we are behind
+	if c.needsBatch && c.pendingGet == nil && c.idx >= 0 {
+		c.needsBatch = false
+		resp, batch, err := c.fetchBatch()
+		if err != nil {
+			return nil, err
+		}
+		c.batch, c.batchResp = batch, resp
+	}
+
 	// Get the reader to use for the current segment
 	conn := c.pendingGet
+	batched := false
+	if conn == nil && c.batch != nil {
+		conn = c.nextBatchPart()
+		batched = conn != nil
+	}
 	if conn == nil {
 		// Preconnect if we don't have a pending GET
 		slog.Debug("No preconnect, connecting", "url", c.url, "idx", c.idx)
@@ -209,14 +497,28 @@ func (c *TrickleSubscriber) Read() (*http.Response, error) {
 		return nil, &SequenceNonexistent{Seq: GetSeq(conn), Latest: GetLatest(conn)}
 	}
 
+	// Only ask for the init segment until we have it
+	if conn.Header.Get("Lp-Trickle-Init") != "" {
+		c.needsInit = false
+	}
+
 	// Set to use the next index for the next (pre-)connection
 	idx := GetSeq(conn)
 	if idx >= 0 {
 		c.idx = idx + 1
 	}
 
-	// Set up the next connection
+	epoch := GetEpoch(conn)
+	if c.epoch >= 0 && epoch != c.epoch {
+		conn.Header.Set("Lp-Trickle-Discontinuity", "true")
+	}
+	c.epoch = epoch
+
+	// Set up the next connection, unless the batch has more
 	go func() {
+		if batched {
+			return
+		}
 		c.mu.Lock()
 		defer c.mu.Unlock()
 		nextConn, err := c.preconnect()
@@ -233,7 +535,42 @@ func (c *TrickleSubscriber) Read() (*http.Response, error) {
 	}()
 
 	// Now the segment is set up and we have the reader for the current one
+	if c.config.VerifyDigest {
+		skip, _ := strconv.Atoi(conn.Header.Get("Lp-Trickle-Init-Bytes"))
+		conn.Body = &digestReader{
+			body: conn.Body,
+			resp: conn,
+			hash: newDigest(),
+			skip: skip,
+		}
+	}
+	conn.Body = &abortReader{body: conn.Body, resp: conn}
+	conn.Body = &latencyReader{
+		body:   conn.Body,
+		resp:   conn,
+		clock:  c.config.Clock,
+		onDone: c.recordLatency,
+	}
 
 	// Return the reader for the current segment
 	return conn, nil
 }
+
+// Swaps io.EOF for ErrSegmentAborted if the server flagged the segment
+type abortReader struct {
+	body io.ReadCloser
+	resp *http.Response
+}
+
+func (ar *abortReader) Read(p []byte) (int, error) {
+	n, err := ar.body.Read(p)
+	// trailers are only available after EOF
+	if err == io.EOF && ar.resp.Trailer.Get("Lp-Trickle-Aborted") != "" {
+		return n, ErrSegmentAborted
+	}
+	return n, err
+}
+
+func (ar *abortReader) Close() error {
+	return ar.body.Close()
+}
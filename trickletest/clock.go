@@ -0,0 +1,133 @@
+package trickletest
+
+import (
+	"slices"
+	"sync"
+	"time"
+	"trickle"
+)
+
+// FakeClock is a trickle.Clock that only moves when advanced, so sweeps,
+// keepalives and preconnect refreshes can be triggered on demand.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+type waiter struct {
+	at     time.Time
+	period time.Duration // for tickers, otherwise zero
+	fire   func(now time.Time)
+}
+
+// NewFakeClock returns a clock stopped at start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.add(&waiter{at: c.Now().Add(d), fire: func(now time.Time) { ch <- now }})
+	return ch
+}
+
+// AfterFunc runs f on the goroutine that advances past d
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) trickle.Timer {
+	w := &waiter{at: c.Now().Add(d), fire: func(time.Time) { f() }}
+	c.add(w)
+	return &fakeTimer{clock: c, w: w}
+}
+
+// NewTicker drops ticks if the receiver falls behind, like time.Ticker
+func (c *FakeClock) NewTicker(d time.Duration) trickle.Ticker {
+	ch := make(chan time.Time, 1)
+	w := &waiter{at: c.Now().Add(d), period: d, fire: func(now time.Time) {
+		select {
+		case ch <- now:
+		default:
+		}
+	}}
+	c.add(w)
+	return &fakeTicker{clock: c, w: w, ch: ch}
+}
+
+// Advance moves the clock forward by d, firing anything that comes due
+// in order. Receivers of After and tickers run on their own goroutines,
+// so wait for their effects rather than assuming they happened.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		// fire the earliest due waiter first
+		i := -1
+		for j, w := range c.waiters {
+			if !w.at.After(end) && (i < 0 || w.at.Before(c.waiters[i].at)) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		w := c.waiters[i]
+		c.now = w.at
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = slices.Delete(c.waiters, i, i+1)
+		}
+		now := c.now
+		c.mu.Unlock()
+		w.fire(now)
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// Pending returns the number of timers and tickers that have yet to fire,
+// including any whose receivers have since gone away
+func (c *FakeClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (c *FakeClock) add(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waiters = append(c.waiters, w)
+}
+
+func (c *FakeClock) remove(w *waiter) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := slices.Index(c.waiters, w)
+	if i < 0 {
+		return false
+	}
+	c.waiters = slices.Delete(c.waiters, i, i+1)
+	return true
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	w     *waiter
+}
+
+func (t *fakeTimer) Stop() bool { return t.clock.remove(t.w) }
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *waiter
+	ch    chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.ch }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
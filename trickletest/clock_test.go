@@ -0,0 +1,51 @@
+package trickletest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	after := c.After(10 * time.Second)
+	ticker := c.NewTicker(3 * time.Second)
+	var fired []time.Duration
+	c.AfterFunc(5*time.Second, func() { fired = append(fired, c.Now().Sub(start)) })
+	stopped := c.AfterFunc(time.Second, func() { t.Error("stopped timer fired") })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("expected the first Stop to succeed and later ones to fail")
+	}
+
+	c.Advance(9 * time.Second)
+	select {
+	case <-after:
+		t.Error("fired early")
+	default:
+	}
+	if len(fired) != 1 || fired[0] != 5*time.Second {
+		t.Errorf("unexpected AfterFunc calls %v", fired)
+	}
+	// ticks are dropped if not received, like time.Ticker
+	if tick := <-ticker.C(); tick.Sub(start) != 3*time.Second {
+		t.Errorf("unexpected tick at %v", tick.Sub(start))
+	}
+	select {
+	case <-ticker.C():
+		t.Error("expected dropped ticks")
+	default:
+	}
+
+	c.Advance(time.Second)
+	if now := <-after; now.Sub(start) != 10*time.Second || c.Now() != now {
+		t.Errorf("unexpected time %v", now.Sub(start))
+	}
+	c.Advance(2 * time.Second)
+	if tick := <-ticker.C(); tick.Sub(start) != 12*time.Second {
+		t.Errorf("unexpected tick at %v", tick.Sub(start))
+	}
+	ticker.Stop()
+	if c.Pending() != 0 {
+		t.Errorf("expected nothing pending, got %d", c.Pending())
+	}
+}
@@ -0,0 +1,101 @@
+package trickletest
+
+import (
+	"net/http"
+	"time"
+)
+
+// Fault is applied to matching requests before they reach the server.
+// Returns true if it handled the request, or false to pass it on.
+type Fault func(w http.ResponseWriter, r *http.Request) bool
+
+// Matcher selects the requests a fault applies to
+type Matcher func(r *http.Request) bool
+
+type fault struct {
+	match Matcher
+	fault Fault
+	times int // remaining, or <= 0 for unlimited
+}
+
+// Status responds with the given status code
+func Status(code int) Fault {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		http.Error(w, http.StatusText(code), code)
+		return true
+	}
+}
+
+// Hangup closes the connection without responding
+func Hangup() Fault {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// Delay holds the request for a while before passing it on
+func Delay(d time.Duration) Fault {
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+		return false
+	}
+}
+
+// Request matches requests by method and path, eg "POST", "/channel/3".
+// An empty method or path matches anything.
+func Request(method, path string) Matcher {
+	return func(r *http.Request) bool {
+		return (method == "" || r.Method == method) && (path == "" || r.URL.Path == path)
+	}
+}
+
+// InjectFault applies the fault to the next `times` matching requests,
+// or to all of them if times <= 0. Returns a func that removes the fault.
+func (s *Server) InjectFault(match Matcher, f Fault, times int) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ft := &fault{match: match, fault: f, times: times}
+	s.faults = append(s.faults, ft)
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.removeFault(ft)
+	}
+}
+
+func (s *Server) removeFault(ft *fault) {
+	for i, f := range s.faults {
+		if f == ft {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Server) applyFaults(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.Lock()
+	var matched []*fault
+	for _, f := range s.faults {
+		if f.match(r) {
+			matched = append(matched, f)
+		}
+	}
+	for _, f := range matched {
+		if f.times > 0 {
+			f.times--
+			if f.times == 0 {
+				s.removeFault(f)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, f := range matched {
+		if f.fault(w, r) {
+			return true
+		}
+	}
+	return false
+}
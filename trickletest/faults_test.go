@@ -0,0 +1,51 @@
+package trickletest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"trickle"
+)
+
+func TestInjectFault(t *testing.T) {
+	ts := NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	get := func(path string) int {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			return -1
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	ts.Publisher(t, "faults")
+
+	// limited to the given number of matching requests
+	ts.InjectFault(Request("GET", "/faults/info"), Status(503), 2)
+	for i, want := range []int{503, 503, 200} {
+		if code := get("/faults/info"); code != want {
+			t.Errorf("request %d: expected %d, got %d", i, want, code)
+		}
+	}
+
+	// other requests are not affected
+	remove := ts.InjectFault(Request("", "/other/info"), Hangup(), 0)
+	if code := get("/faults/info"); code != 200 {
+		t.Errorf("expected 200, got %d", code)
+	}
+	for i := 0; i < 2; i++ {
+		if code := get("/other/info"); code != -1 {
+			t.Errorf("expected hangup, got %d", code)
+		}
+	}
+	remove()
+	if code := get("/other/info"); code != 404 {
+		t.Errorf("expected 404 once removed, got %d", code)
+	}
+
+	// delays pass the request on afterwards
+	ts.InjectFault(Request("GET", ""), Delay(50*time.Millisecond), 1)
+	start := time.Now()
+	if code := get("/faults/info"); code != 200 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected delayed 200, got %d after %v", code, time.Since(start))
+	}
+}
@@ -0,0 +1,175 @@
+// Package trickletest runs a trickle server in-process for tests, with
+// helpers to publish and subscribe and to inject network faults.
+package trickletest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"trickle"
+)
+
+// Server is a trickle server running on an httptest.Server
+type Server struct {
+	*httptest.Server
+	Trickle *trickle.Server
+
+	mu     sync.Mutex
+	faults []*fault
+}
+
+// NewServer starts a server over HTTP/1. It is shut down when the test ends.
+func NewServer(t testing.TB, config trickle.TrickleServerConfig) *Server {
+	return newServer(t, config, false)
+}
+
+// NewH2CServer starts a server that also accepts unencrypted HTTP/2,
+// for clients that multiplex over a single connection.
+func NewH2CServer(t testing.TB, config trickle.TrickleServerConfig) *Server {
+	return newServer(t, config, true)
+}
+
+func newServer(t testing.TB, config trickle.TrickleServerConfig, h2c bool) *Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	config.Mux = mux
+	s := &Server{}
+	s.Trickle = trickle.ConfigureServer(config)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.applyFaults(w, r) {
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	if h2c {
+		s.Config.Protocols = &http.Protocols{}
+		s.Config.Protocols.SetHTTP1(true)
+		s.Config.Protocols.SetUnencryptedHTTP2(true)
+	}
+	s.Start()
+	t.Cleanup(s.Close)
+	// Runs before Close to release any preconnected requests
+	t.Cleanup(s.Trickle.Start())
+	return s
+}
+
+// ChannelURL returns the URL of a channel on this server
+func (s *Server) ChannelURL(channel string) string {
+	return trickle.ChannelURL(s.URL, channel)
+}
+
+// Publisher creates the channel and returns a publisher for it
+func (s *Server) Publisher(t testing.TB, channel string) *trickle.TricklePublisher {
+	t.Helper()
+	return s.PublisherWithConfig(t, channel, trickle.TricklePublisherConfig{})
+}
+
+// PublisherWithConfig is like Publisher with a custom publisher config
+func (s *Server) PublisherWithConfig(t testing.TB, channel string, config trickle.TricklePublisherConfig) *trickle.TricklePublisher {
+	t.Helper()
+	pub, err := trickle.NewTricklePublisherWithConfig(s.ChannelURL(channel), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the preconnect may not have created the channel yet
+	if err := pub.Create(); err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+// Subscriber returns a subscriber for the channel starting at seq
+func (s *Server) Subscriber(channel string, seq int) *trickle.TrickleSubscriber {
+	return s.SubscriberWithConfig(channel, seq, trickle.TrickleSubscriberConfig{})
+}
+
+// SubscriberWithConfig is like Subscriber with a custom subscriber config
+func (s *Server) SubscriberWithConfig(channel string, seq int, config trickle.TrickleSubscriberConfig) *trickle.TrickleSubscriber {
+	sub := trickle.NewTrickleSubscriberWithConfig(s.ChannelURL(channel), config)
+	sub.SetSeq(seq)
+	return sub
+}
+
+// Info fetches the channel's info, failing the test if it does not exist
+func (s *Server) Info(t testing.TB, channel string) *trickle.ChannelInfo {
+	t.Helper()
+	info, err := trickle.NewTrickleSubscriber(s.ChannelURL(channel)).Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+// DropConnections hangs up every open client connection
+func (s *Server) DropConnections() {
+	s.CloseClientConnections()
+}
+
+// Publish writes each of the segments in order, failing the test on error
+func Publish(t testing.TB, pub *trickle.TricklePublisher, segments ...string) {
+	t.Helper()
+	for _, seg := range segments {
+		if err := pub.Write(strings.NewReader(seg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Read reads the next segment in full, failing the test on error
+func Read(t testing.TB, sub *trickle.TrickleSubscriber) (int, string) {
+	t.Helper()
+	resp, err := sub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return trickle.GetSeq(resp), string(data)
+}
+
+// SlowReader returns the chunks one at a time with a delay before each
+// one after the first, so segments stay in progress for a while
+func SlowReader(delay time.Duration, chunks ...string) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for i, chunk := range chunks {
+			if i > 0 {
+				time.Sleep(delay)
+			}
+			if _, err := pw.Write([]byte(chunk)); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// FailingReader returns data and then err instead of io.EOF
+func FailingReader(data string, err error) io.Reader {
+	return io.MultiReader(bytes.NewReader([]byte(data)), &errReader{err})
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// WaitFor polls until cond is true, failing the test after a few seconds
+func WaitFor(t testing.TB, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,297 @@
+package trickle
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+	tsPATPID     = 0x0000
+
+	// PTS is 33 bits at 90 kHz
+	tsClockRate = 90000
+	tsPTSWrap   = 1 << 33
+)
+
+// TSSegmenter splits an MPEG-TS byte stream into segments on video
+// keyframes, natively in Go. It is a drop-in replacement for running
+// MediaSegmenter over a byte stream without an ffmpeg dependency.
+//
+// Each segment after the first begins with the most recent PAT and PMT
+// so segments are decodable on their own. Only PAT / PMT sections that
+// fit into a single packet are supported, which is virtually all of them.
+//
+// Streams without video are split on audio PES boundaries instead,
+// so set a MinDuration for those.
+type TSSegmenter struct {
+	// Minimum segment duration based on presentation timestamps. Segments
+	// are cut on the first keyframe after this elapses. (default 0: cut on
+	// every keyframe)
+	MinDuration time.Duration
+}
+
+type tsSegmenterState struct {
+	pat      []byte
+	pmt      []byte
+	pmtPID   int
+	videoPID int
+	isHEVC   bool
+	audioPID int
+
+	writer   *TrickleWriter
+	hasMedia bool // whether the segment has any PES starts yet
+	startPTS int64
+	hasPTS   bool
+}
+
+// RunSegmentation reads MPEG-TS from `in` until EOF, invoking the handler
+// once per segment. Segment contents are trickled out as they are read.
+func (ts *TSSegmenter) RunSegmentation(in io.Reader, segmentHandler SegmentHandler) error {
+	st := &tsSegmenterState{
+		pmtPID:   -1,
+		videoPID: -1,
+		audioPID: -1,
+	}
+	defer func() {
+		if st.writer != nil {
+			st.writer.Close()
+		}
+	}()
+	minDuration := int64(ts.MinDuration.Seconds() * tsClockRate)
+	reader := &tsReader{reader: bufio.NewReaderSize(in, tsPacketSize*64)}
+	pkt := make([]byte, tsPacketSize)
+	for {
+		if err := reader.readPacket(pkt); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+
+		pusi, pid, payload, rai := parseTSPacket(pkt)
+		if pusi && len(payload) > 0 {
+			switch {
+			case pid == tsPATPID:
+				if pmtPID := parsePAT(payload); pmtPID >= 0 {
+					st.pmtPID = pmtPID
+					st.pat = append(st.pat[:0], pkt...)
+				}
+			case pid == st.pmtPID:
+				if video, hevc, audio, ok := parsePMT(payload); ok {
+					st.videoPID, st.isHEVC, st.audioPID = video, hevc, audio
+					st.pmt = append(st.pmt[:0], pkt...)
+				}
+			}
+		}
+
+		// Check for a segment boundary
+		splitPID := st.videoPID
+		if splitPID < 0 {
+			splitPID = st.audioPID
+		}
+		if pusi && pid == splitPID && st.hasMedia {
+			isKey := rai || splitPID != st.videoPID || isKeyframePES(payload, st.isHEVC)
+			pts, hasPTS := parsePESTimestamp(payload)
+			if isKey && st.elapsed(pts, hasPTS) >= minDuration {
+				st.writer.Close()
+				st.writer = nil
+			}
+		}
+
+		if st.writer == nil {
+			st.writer = NewTrickleWriter()
+			segmentHandler(st.writer.MakeReader())
+			// Repeat the program tables at the start of each segment
+			// unless the segment already begins with them
+			if pid != tsPATPID {
+				st.writer.Write(st.pat)
+				if pid != st.pmtPID {
+					st.writer.Write(st.pmt)
+				}
+			}
+			st.hasMedia = false
+		}
+		if pusi && pid == splitPID && !st.hasMedia {
+			st.hasMedia = true
+			st.startPTS, st.hasPTS = parsePESTimestamp(payload)
+		}
+		st.writer.Write(pkt)
+	}
+}
+
+// Time elapsed since the start of the segment in 90 kHz units
+func (st *tsSegmenterState) elapsed(pts int64, hasPTS bool) int64 {
+	if !hasPTS || !st.hasPTS {
+		// no timing info so always allow a cut
+		return tsPTSWrap
+	}
+	return (pts - st.startPTS + tsPTSWrap) % tsPTSWrap
+}
+
+type tsReader struct {
+	reader *bufio.Reader
+	inSync bool
+}
+
+// Reads the next packet, resyncing on the sync byte if needed
+func (r *tsReader) readPacket(pkt []byte) error {
+	for {
+		buf, err := r.reader.Peek(tsPacketSize + 1)
+		if len(buf) < tsPacketSize {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		// When (re)acquiring sync, make sure the next packet
+		// is aligned too, otherwise this is a false sync
+		aligned := r.inSync || len(buf) == tsPacketSize || buf[tsPacketSize] == tsSyncByte
+		if buf[0] == tsSyncByte && aligned {
+			copy(pkt, buf[:tsPacketSize])
+			r.inSync = true
+			_, err := r.reader.Discard(tsPacketSize)
+			return err
+		}
+		r.inSync = false
+		r.reader.Discard(1)
+	}
+}
+
+// Returns payload unit start, PID, payload and the random access indicator
+func parseTSPacket(pkt []byte) (bool, int, []byte, bool) {
+	pusi := pkt[1]&0x40 != 0
+	pid := int(pkt[1]&0x1F)<<8 | int(pkt[2])
+	afc := (pkt[3] >> 4) & 0x3
+	offset := 4
+	rai := false
+	if afc&0x2 != 0 {
+		afLen := int(pkt[4])
+		if afLen > 0 && 5 < len(pkt) {
+			rai = pkt[5]&0x40 != 0
+		}
+		offset = 5 + afLen
+	}
+	if afc&0x1 == 0 || offset >= len(pkt) {
+		return pusi, pid, nil, rai
+	}
+	return pusi, pid, pkt[offset:], rai
+}
+
+// Returns the PSI section after the pointer field
+func psiSection(payload []byte, tableID byte) ([]byte, bool) {
+	if len(payload) < 1 {
+		return nil, false
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) || payload[start] != tableID {
+		return nil, false
+	}
+	section := payload[start:]
+	sectionLen := int(section[1]&0x0F)<<8 | int(section[2])
+	end := 3 + sectionLen - 4 // exclude CRC
+	if end > len(section) || end < 8 {
+		return nil, false
+	}
+	return section[:end], true
+}
+
+// Returns the PMT PID of the first program, or -1
+func parsePAT(payload []byte) int {
+	section, ok := psiSection(payload, 0x00)
+	if !ok {
+		return -1
+	}
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program == 0 {
+			continue // network PID
+		}
+		return int(section[i+2]&0x1F)<<8 | int(section[i+3])
+	}
+	return -1
+}
+
+// Returns the video PID (and whether it is HEVC) and the audio PID, or -1
+func parsePMT(payload []byte) (int, bool, int, bool) {
+	section, ok := psiSection(payload, 0x02)
+	if !ok || len(section) < 12 {
+		return -1, false, -1, false
+	}
+	video, audio, hevc := -1, -1, false
+	programInfoLen := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + programInfoLen; i+5 <= len(section); {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1F)<<8 | int(section[i+2])
+		esInfoLen := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		switch streamType {
+		case 0x01, 0x02, 0x10, 0x1B: // mpeg1/2, mpeg4 part 2, h264
+			if video < 0 {
+				video = pid
+			}
+		case 0x24: // hevc
+			if video < 0 {
+				video, hevc = pid, true
+			}
+		case 0x03, 0x04, 0x0F, 0x11, 0x81: // mp3, aac, ac3
+			if audio < 0 {
+				audio = pid
+			}
+		}
+		i += 5 + esInfoLen
+	}
+	return video, hevc, audio, true
+}
+
+// Returns the start of the elementary stream data within a PES payload
+func pesData(payload []byte) ([]byte, bool) {
+	if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return nil, false
+	}
+	start := 9 + int(payload[8])
+	if start > len(payload) {
+		return nil, false
+	}
+	return payload[start:], true
+}
+
+func parsePESTimestamp(payload []byte) (int64, bool) {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+		return 0, false
+	}
+	if payload[7]&0x80 == 0 {
+		return 0, false // no PTS
+	}
+	b := payload[9:14]
+	pts := int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 | int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 | int64(b[4]>>1)
+	return pts, true
+}
+
+// Scans the start of a video PES for an IDR / IRAP NAL unit.
+// Used when the muxer does not set the random access indicator.
+func isKeyframePES(payload []byte, isHEVC bool) bool {
+	data, ok := pesData(payload)
+	if !ok {
+		return false
+	}
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		nal := data[i+3]
+		if isHEVC {
+			if nalType := (nal >> 1) & 0x3F; nalType >= 16 && nalType <= 21 {
+				return true
+			}
+		} else if nal&0x1F == 5 {
+			return true
+		}
+		i += 2
+	}
+	return false
+}
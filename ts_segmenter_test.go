@@ -0,0 +1,176 @@
+package trickle
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+	testAudioPID = 0x101
+)
+
+// Builds a single TS packet, padding with an adaptation field
+func tsPacket(pid int, pusi, rai bool, payload []byte) []byte {
+	pkt := make([]byte, 0, tsPacketSize)
+	b1 := byte(pid>>8) & 0x1F
+	if pusi {
+		b1 |= 0x40
+	}
+	pkt = append(pkt, tsSyncByte, b1, byte(pid))
+	afLen := tsPacketSize - 4 - len(payload)
+	if afLen == 0 && !rai {
+		pkt = append(pkt, 0x10)
+	} else {
+		// adaptation field length byte counts toward afLen
+		afLen -= 1
+		flags := byte(0)
+		if rai {
+			flags |= 0x40
+		}
+		pkt = append(pkt, 0x30, byte(afLen))
+		if afLen > 0 {
+			pkt = append(pkt, flags)
+			for i := 1; i < afLen; i++ {
+				pkt = append(pkt, 0xFF)
+			}
+		}
+	}
+	return append(pkt, payload...)
+}
+
+func psiPacket(pid int, tableID byte, body []byte) []byte {
+	sectionLen := 5 + len(body) + 4
+	section := []byte{0x00, tableID, 0xB0 | byte(sectionLen>>8), byte(sectionLen), 0x00, 0x01, 0xC1, 0x00, 0x00}
+	section = append(section, body...)
+	section = append(section, 0, 0, 0, 0) // CRC is not checked
+	return tsPacket(pid, true, false, section)
+}
+
+func patPacket() []byte {
+	return psiPacket(tsPATPID, 0x00, []byte{0x00, 0x01, 0xE0 | testPMTPID>>8, testPMTPID & 0xFF})
+}
+
+func pmtPacket(videoType byte) []byte {
+	body := []byte{0xE0 | testVideoPID>>8, testVideoPID & 0xFF, 0xF0, 0x00}
+	body = append(body, videoType, 0xE0|testVideoPID>>8, testVideoPID&0xFF, 0xF0, 0x00)
+	body = append(body, 0x0F, 0xE0|testAudioPID>>8, testAudioPID&0xFF, 0xF0, 0x00)
+	return psiPacket(testPMTPID, 0x02, body)
+}
+
+func pesPacket(pid int, pts int64, rai bool, es []byte) []byte {
+	pes := []byte{0x00, 0x00, 0x01, 0xE0, 0x00, 0x00, 0x80, 0x80, 0x05,
+		byte(0x21 | (pts>>29)&0x0E), byte(pts >> 22), byte((pts>>14)&0xFE | 1),
+		byte(pts >> 7), byte((pts<<1)&0xFE | 1)}
+	return tsPacket(pid, true, rai, append(pes, es...))
+}
+
+var (
+	h264IDR    = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0, 0x00, 0x00, 0x01, 0x65, 0x88}
+	h264NonIDR = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xF0, 0x00, 0x00, 0x01, 0x41, 0x9A}
+	hevcIDR    = []byte{0x00, 0x00, 0x00, 0x01, 0x26, 0x01, 0xAF}
+	hevcNonIDR = []byte{0x00, 0x00, 0x00, 0x01, 0x02, 0x01, 0xD0}
+)
+
+// Frames at 30fps with a keyframe every `gop` frames
+func syntheticTS(frames, gop int, useRAI bool, videoType byte, idr, nonIDR []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.Write(patPacket())
+	buf.Write(pmtPacket(videoType))
+	for i := 0; i < frames; i++ {
+		pts := int64(i * tsClockRate / 30)
+		isKey := i%gop == 0
+		es := nonIDR
+		if isKey {
+			es = idr
+		}
+		buf.Write(pesPacket(testVideoPID, pts, isKey && useRAI, es))
+		// continuation packet with no PUSI
+		buf.Write(tsPacket(testVideoPID, false, false, bytes.Repeat([]byte{0xAB}, 184)))
+		buf.Write(pesPacket(testAudioPID, pts, false, []byte{0xFF, 0xF1}))
+	}
+	return buf.Bytes()
+}
+
+func runTSSegmenter(t *testing.T, ts *TSSegmenter, in []byte) [][]byte {
+	t.Helper()
+	var readers []CloneableReader
+	err := ts.RunSegmentation(bytes.NewReader(in), func(r CloneableReader) {
+		readers = append(readers, r)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var segments [][]byte
+	for _, r := range readers {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, data)
+	}
+	return segments
+}
+
+func checkSegments(t *testing.T, segments [][]byte, expected int, in []byte) {
+	t.Helper()
+	if len(segments) != expected {
+		t.Fatalf("expected %d segments, got %d", expected, len(segments))
+	}
+	pat, pmt := in[:tsPacketSize], in[tsPacketSize:2*tsPacketSize]
+	total := 0
+	for i, seg := range segments {
+		if len(seg)%tsPacketSize != 0 {
+			t.Errorf("segment %d is not packet aligned: %d bytes", i, len(seg))
+		}
+		if !bytes.Equal(seg[:tsPacketSize], pat) || !bytes.Equal(seg[tsPacketSize:2*tsPacketSize], pmt) {
+			t.Errorf("segment %d does not start with PAT / PMT", i)
+		}
+		_, pid, payload, _ := parseTSPacket(seg[2*tsPacketSize : 3*tsPacketSize])
+		if pid != testVideoPID || (i > 0 && !bytes.HasSuffix(payload, []byte{0x65, 0x88}) && !bytes.HasSuffix(payload, []byte{0x26, 0x01, 0xAF})) {
+			t.Errorf("segment %d does not start with a keyframe", i)
+		}
+		total += len(seg)
+		if i > 0 {
+			total -= 2 * tsPacketSize // repeated tables
+		}
+	}
+	if total != len(in) {
+		t.Errorf("expected %d bytes of input across segments, got %d", len(in), total)
+	}
+}
+
+func TestTSSegmenter_RandomAccessIndicator(t *testing.T) {
+	in := syntheticTS(90, 30, true, 0x1B, h264IDR, h264NonIDR)
+	segments := runTSSegmenter(t, &TSSegmenter{}, in)
+	checkSegments(t, segments, 3, in)
+}
+
+func TestTSSegmenter_NALScan(t *testing.T) {
+	// no random access indicator so keyframes come from the NAL type
+	in := syntheticTS(100, 25, false, 0x1B, h264IDR, h264NonIDR)
+	checkSegments(t, runTSSegmenter(t, &TSSegmenter{}, in), 4, in)
+
+	in = syntheticTS(100, 25, false, 0x24, hevcIDR, hevcNonIDR)
+	checkSegments(t, runTSSegmenter(t, &TSSegmenter{}, in), 4, in)
+}
+
+func TestTSSegmenter_MinDuration(t *testing.T) {
+	// one second GOPs, so two seconds should skip every other keyframe
+	in := syntheticTS(300, 30, true, 0x1B, h264IDR, h264NonIDR)
+	segments := runTSSegmenter(t, &TSSegmenter{MinDuration: 2 * time.Second}, in)
+	checkSegments(t, segments, 5, in)
+}
+
+func TestTSSegmenter_Resync(t *testing.T) {
+	in := syntheticTS(60, 30, true, 0x1B, h264IDR, h264NonIDR)
+	// junk before the stream and in between packets
+	corrupted := append([]byte{0x47, 0x00, 0x12}, in[:5*tsPacketSize]...)
+	corrupted = append(corrupted, 0x00, 0x47, 0x47)
+	corrupted = append(corrupted, in[5*tsPacketSize:]...)
+	segments := runTSSegmenter(t, &TSSegmenter{}, corrupted)
+	checkSegments(t, segments, 2, in)
+}
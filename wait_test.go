@@ -0,0 +1,208 @@
+package trickle_test
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+	"trickle"
+	"trickle/trickletest"
+)
+
+func TestWait_NonBlocking(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "poll")
+	trickletest.Publish(t, pub, "zero")
+
+	// nothing written yet is a 204 with the seq to ask for again
+	resp, err := http.Get(ts.ChannelURL("poll") + "/1?wait=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || trickle.GetSeq(resp) != 1 || trickle.GetLatest(resp) != 1 {
+		t.Errorf("unexpected response %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// written segments are returned as usual
+	req, _ := http.NewRequest("GET", ts.ChannelURL("poll")+"/0", nil)
+	req.Header.Set("Lp-Trickle-Wait", "0")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "zero" {
+		t.Errorf("unexpected response %d %q", resp.StatusCode, body)
+	}
+
+	// segments outside the window are still a 470
+	resp, err = http.Get(ts.ChannelURL("poll") + "/5?wait=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 470 {
+		t.Errorf("expected 470, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(ts.ChannelURL("poll") + "/1?wait=soon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestWait_Bounded(t *testing.T) {
+	clock := trickletest.NewFakeClock(time.Now())
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Clock: clock})
+	// no publisher yet, so the only new timer is the GET's
+	trickle.NewLocalPublisher(ts.Trickle, "bounded", "").CreateChannel()
+
+	get := func() <-chan *http.Response {
+		ch := make(chan *http.Response, 1)
+		go func() {
+			req, _ := http.NewRequest("GET", ts.ChannelURL("bounded")+"/0", nil)
+			req.Header.Set("Lp-Trickle-Wait", "5s")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				close(ch)
+				return
+			}
+			ch <- resp
+		}()
+		return ch
+	}
+
+	// the server gives up once the wait is over
+	pending := clock.Pending()
+	ch := get()
+	trickletest.WaitFor(t, func() bool { return clock.Pending() > pending })
+	clock.Advance(4 * time.Second)
+	select {
+	case resp := <-ch:
+		t.Fatalf("returned before the wait was up: %d", resp.StatusCode)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.Advance(time.Second)
+	if resp := <-ch; resp == nil || resp.StatusCode != http.StatusNoContent || trickle.GetSeq(resp) != 0 {
+		t.Fatalf("expected 204, got %+v", resp)
+	}
+
+	// segments that start within the wait are read to the end,
+	// even if that takes longer than the wait
+	pub, err := trickle.NewTricklePublisher(ts.ChannelURL("bounded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch = get()
+	trickletest.WaitFor(t, func() bool { return ts.Info(t, "bounded").Subscribers >= 1 })
+	pp, err := pub.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	go pp.Write(r)
+	w.Write([]byte("first "))
+	resp := <-ch
+	if resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %+v", resp)
+	}
+	clock.Advance(10 * time.Second)
+	w.Write([]byte("second"))
+	w.Close()
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "first second" {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+}
+
+func TestWait_Subscriber(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "waiting")
+	var gets atomic.Int32
+	ts.InjectFault(trickletest.Request("GET", "/waiting/0"), func(w http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("Lp-Trickle-Wait") == "" {
+			t.Error("missing wait header")
+		}
+		gets.Add(1)
+		return false
+	}, 0)
+
+	// the subscriber asks again after each 204 without a client timer
+	clock := trickletest.NewFakeClock(time.Now())
+	sub := ts.SubscriberWithConfig("waiting", 0, trickle.TrickleSubscriberConfig{
+		Wait:  50 * time.Millisecond,
+		Clock: clock,
+	})
+	done := make(chan string)
+	go func() {
+		_, data := trickletest.Read(t, sub)
+		done <- data
+	}()
+	trickletest.WaitFor(t, func() bool { return gets.Load() >= 3 })
+	if clock.Pending() != 0 {
+		t.Errorf("unexpected client timers %d", clock.Pending())
+	}
+	trickletest.Publish(t, pub, "waited")
+	if data := <-done; data != "waited" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
+
+func TestWait_Early204(t *testing.T) {
+	ts := trickletest.NewServer(t, trickle.TrickleServerConfig{Autocreate: true})
+	pub := ts.Publisher(t, "early")
+	var gets atomic.Int32
+	ts.InjectFault(trickletest.Request("GET", "/early/0"), func(w http.ResponseWriter, r *http.Request) bool {
+		// a proxy that doesn't hold GETs, and then asks for a pause
+		n := gets.Add(1)
+		if n > 4 {
+			return false
+		}
+		if n == 4 {
+			w.Header().Set("Retry-After", "2")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return true
+	}, 0)
+
+	clock := trickletest.NewFakeClock(time.Now())
+	sub := ts.SubscriberWithConfig("early", 0, trickle.TrickleSubscriberConfig{
+		Wait:  time.Minute,
+		Clock: clock,
+	})
+	done := make(chan string)
+	go func() {
+		_, data := trickletest.Read(t, sub)
+		done <- data
+	}()
+
+	// early 204s back off further each time
+	pause := func(n int32, d time.Duration) {
+		t.Helper()
+		trickletest.WaitFor(t, func() bool { return gets.Load() == n && clock.Pending() == 1 })
+		clock.Advance(d - time.Millisecond)
+		if clock.Pending() != 1 {
+			t.Fatalf("asked again before %v", d)
+		}
+		clock.Advance(time.Millisecond)
+	}
+	pause(1, 50*time.Millisecond)
+	pause(2, 100*time.Millisecond)
+	pause(3, 200*time.Millisecond)
+	pause(4, 2*time.Second)
+
+	trickletest.WaitFor(t, func() bool { return gets.Load() == 5 })
+	trickletest.Publish(t, pub, "late")
+	if data := <-done; data != "late" {
+		t.Errorf("unexpected segment %q", data)
+	}
+}
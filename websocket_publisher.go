@@ -0,0 +1,109 @@
+package trickle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// TrickleWebSocketPublisher publishes segments over a single websocket
+// rather than one POST per segment.
+type TrickleWebSocketPublisher struct {
+	conn        *wsConn
+	url         string
+	contentType string
+	writeLock   sync.Mutex
+}
+
+type TrickleWebSocketPublisherConfig struct {
+	// Content type of the channel (default video/MP2T)
+	ContentType string
+}
+
+// NewTrickleWebSocketPublisher connects to the websocket endpoint of a channel,
+// eg http://localhost:2939/mystream (the `/ws` suffix is added here)
+func NewTrickleWebSocketPublisher(url string) (*TrickleWebSocketPublisher, error) {
+	return NewTrickleWebSocketPublisherWithConfig(url, TrickleWebSocketPublisherConfig{})
+}
+
+func NewTrickleWebSocketPublisherWithConfig(url string, config TrickleWebSocketPublisherConfig) (*TrickleWebSocketPublisher, error) {
+	if config.ContentType == "" {
+		config.ContentType = "video/MP2T"
+	}
+	conn, err := wsDial(url + "/ws")
+	if err != nil {
+		return nil, err
+	}
+	return &TrickleWebSocketPublisher{
+		conn:        conn,
+		url:         url,
+		contentType: config.ContentType,
+	}, nil
+}
+
+// Write sends a complete segment and blocks until the server acknowledges it
+func (c *TrickleWebSocketPublisher) Write(data io.Reader) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err := c.conn.writeJSON(&wsMessage{Type: wsMsgStart, ContentType: c.contentType}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1024*32)
+	var total int64
+	for {
+		n, err := data.Read(buf)
+		if n > 0 {
+			if werr := c.conn.WriteMessage(wsBinary, buf[:n]); werr != nil {
+				return fmt.Errorf("error streaming data to websocket: %w", werr)
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// so the server does not take the next start for a second
+			// segment in progress; hang up if even that fails
+			if aerr := c.conn.writeJSON(&wsMessage{Type: wsMsgAbort}); aerr != nil {
+				c.conn.Close()
+			}
+			return err
+		}
+	}
+	if err := c.conn.writeJSON(&wsMessage{Type: wsMsgEnd}); err != nil {
+		return err
+	}
+
+	// wait for the ack
+	msgType, resp, err := c.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if msgType != wsText {
+		return errors.New("unexpected binary message from server")
+	}
+	var msg wsMessage
+	if err := json.Unmarshal(resp, &msg); err != nil {
+		return err
+	}
+	if msg.Type == wsMsgError {
+		if msg.Error == StreamNotFoundErr.Error() {
+			return StreamNotFoundErr
+		}
+		return errors.New(msg.Error)
+	}
+	if msg.Type != wsMsgAck || msg.Seq == nil {
+		return fmt.Errorf("unexpected websocket message %s", msg.Type)
+	}
+	slog.Debug("Uploaded segment via websocket", "url", c.url, "seq", *msg.Seq, "totalBytes", humanBytes(total))
+	return nil
+}
+
+// Close hangs up the websocket. This does not delete the channel.
+func (c *TrickleWebSocketPublisher) Close() error {
+	return c.conn.Close()
+}
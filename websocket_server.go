@@ -0,0 +1,153 @@
+package trickle
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Websocket publish protocol
+//
+// Control messages are JSON in text frames, segment data goes in binary frames:
+//
+//	client: {"type":"start","seq":N,"content_type":"video/MP2T"}
+//	client: <binary>, <binary>, ...
+//	client: {"type":"end"}
+//	server: {"type":"ack","seq":N,"bytes":1234}
+//
+// `seq` is optional; if omitted the server uses the next write position.
+// A client that can not finish a segment sends {"type":"abort"} instead of
+// the end message; the segment is aborted without a reply and the next one
+// may be started. On failure the server sends {"type":"error","error":"..."}
+// and hangs up.
+
+const (
+	wsMsgStart = "start"
+	wsMsgEnd   = "end"
+	wsMsgAbort = "abort"
+	wsMsgAck   = "ack"
+	wsMsgError = "error"
+)
+
+type wsMessage struct {
+	Type        string `json:"type"`
+	Seq         *int   `json:"seq,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (c *wsConn) writeJSON(msg *wsMessage) error {
+	jb, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(wsText, jb)
+}
+
+func (c *wsConn) writeError(errMsg string) {
+	c.writeJSON(&wsMessage{Type: wsMsgError, Error: errMsg})
+}
+
+func (sm *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	streamName := r.PathValue("streamName")
+	if _, exists := sm.getStream(streamName); !exists && !sm.config.Autocreate {
+		http.Error(w, "Stream not found", http.StatusNotFound)
+		return
+	}
+	conn, err := wsAccept(w, r)
+	if err != nil {
+		slog.Info("Could not accept websocket", "stream", streamName, "err", err)
+		return
+	}
+	defer conn.Close()
+	slog.Info("Websocket publisher connected", "stream", streamName)
+
+	var (
+		stream    *Stream
+		segment   *Segment
+		totalRead int
+	)
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			// The segment only completes with an end message, so a hangup
+			// or close frame mid-segment leaves it truncated
+			if segment != nil {
+				slog.Info("Error reading websocket", "stream", streamName, "idx", segment.idx, "bytes written", totalRead, "err", err)
+				if totalRead > 0 {
+					segment.abort()
+				}
+			}
+			return
+		}
+
+		if msgType == wsBinary {
+			if segment == nil {
+				conn.writeError("data sent without starting a segment")
+				return
+			}
+			if len(data) > 0 {
+				if totalRead == 0 {
+					stream.startWrite(segment)
+				}
+				segment.writeData(data)
+				totalRead += len(data)
+			}
+			continue
+		}
+
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			conn.writeError("invalid message: " + err.Error())
+			return
+		}
+		switch msg.Type {
+		case wsMsgStart:
+			if segment != nil {
+				conn.writeError("segment already in progress")
+				return
+			}
+			stream = sm.getOrCreateStream(streamName, msg.ContentType, false)
+			if stream == nil {
+				conn.writeError(StreamNotFoundErr.Error())
+				return
+			}
+			idx := -1 // next write
+			if msg.Seq != nil {
+				idx = *msg.Seq
+			}
+			if idx < -1 {
+				conn.writeError("invalid seq")
+				return
+			}
+			segment, _ = stream.getForWrite(idx)
+			totalRead = 0
+		case wsMsgEnd:
+			if segment == nil {
+				conn.writeError("no segment in progress")
+				return
+			}
+			segment.close()
+			seq := segment.idx
+			segment = nil
+			if err := conn.writeJSON(&wsMessage{Type: wsMsgAck, Seq: &seq, Bytes: totalRead}); err != nil {
+				slog.Info("Error acking websocket segment", "stream", streamName, "idx", seq, "err", err)
+				return
+			}
+		case wsMsgAbort:
+			if segment == nil {
+				conn.writeError("no segment in progress")
+				return
+			}
+			slog.Info("Websocket publisher aborted segment", "stream", streamName, "idx", segment.idx, "bytes written", totalRead)
+			if totalRead > 0 {
+				segment.abort()
+			}
+			segment = nil
+		default:
+			conn.writeError("unknown message type " + msg.Type)
+			return
+		}
+	}
+}
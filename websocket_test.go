@@ -0,0 +1,387 @@
+package trickle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// Connects a client and server end over an in-memory pipe
+func wsPipe(t *testing.T) (*wsConn, *wsConn) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	client := &wsConn{conn: c1, reader: bufio.NewReader(c1), isClient: true}
+	server := &wsConn{conn: c2, reader: bufio.NewReader(c2)}
+	return client, server
+}
+
+func TestWebSocket_Framing(t *testing.T) {
+	// lengths either side of the 7, 16 and 64 bit length encodings
+	for _, size := range []int{0, 1, 125, 126, 0xFFFF, 0x10000} {
+		for _, fromClient := range []bool{true, false} {
+			client, server := wsPipe(t)
+			sender, receiver := server, client
+			if fromClient {
+				sender, receiver = client, server
+			}
+			payload := bytes.Repeat([]byte{'x'}, size)
+			errCh := make(chan error, 1)
+			go func() { errCh <- sender.WriteMessage(wsBinary, payload) }()
+			msgType, msg, err := receiver.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errCh; err != nil {
+				t.Fatal(err)
+			}
+			if msgType != wsBinary || !bytes.Equal(msg, payload) {
+				t.Errorf("size %d client %v: unexpected message type %d len %d", size, fromClient, msgType, len(msg))
+			}
+		}
+	}
+}
+
+func TestWebSocket_Masking(t *testing.T) {
+	for _, isClient := range []bool{true, false} {
+		c1, c2 := net.Pipe()
+		conn := &wsConn{conn: c1, isClient: isClient}
+		go func() {
+			conn.WriteMessage(wsText, []byte("hello"))
+			c1.Close()
+		}()
+		raw, err := io.ReadAll(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2.Close()
+		if raw[0] != 0x80|wsText {
+			t.Errorf("unexpected first byte %x", raw[0])
+		}
+		masked := raw[1]&0x80 != 0
+		if masked != isClient {
+			t.Errorf("client %v: unexpected mask bit %v", isClient, masked)
+		}
+		if isClient {
+			// length, mask key, masked payload
+			if len(raw) != 2+4+5 {
+				t.Fatalf("unexpected masked frame %x", raw)
+			}
+			for i := range raw[6:] {
+				raw[6+i] ^= raw[2+i%4]
+			}
+			if string(raw[6:]) != "hello" {
+				t.Errorf("unexpected unmasked payload %q", raw[6:])
+			}
+		} else if string(raw[2:]) != "hello" {
+			t.Errorf("unexpected payload %q", raw[2:])
+		}
+	}
+}
+
+// Writes a single raw frame, optionally without FIN. Errors show
+// up on the reading side.
+func writeRawFrame(w io.Writer, fin bool, opcode byte, payload []byte) {
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	w.Write(append([]byte{b0, byte(len(payload))}, payload...))
+}
+
+func TestWebSocket_Fragments(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	conn := &wsConn{conn: c2, reader: bufio.NewReader(c2)}
+
+	// a ping between fragments is answered without breaking up the message
+	go func() {
+		writeRawFrame(c1, false, wsText, []byte("hel"))
+		writeRawFrame(c1, true, wsPing, []byte("ping"))
+		pong := make([]byte, 6)
+		io.ReadFull(c1, pong)
+		if pong[0] != 0x80|wsPong || string(pong[2:]) != "ping" {
+			t.Errorf("unexpected pong %x", pong)
+		}
+		writeRawFrame(c1, false, wsContinuation, []byte("lo "))
+		writeRawFrame(c1, true, wsContinuation, []byte("there"))
+	}()
+	msgType, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != wsText || string(msg) != "hello there" {
+		t.Errorf("unexpected message %d %q", msgType, msg)
+	}
+
+	// close frames are echoed and reported as EOF
+	go func() {
+		writeRawFrame(c1, true, wsClose, []byte{0x03, 0xE8})
+		echo := make([]byte, 4)
+		io.ReadFull(c1, echo)
+		if echo[0] != 0x80|wsClose {
+			t.Errorf("unexpected close echo %x", echo)
+		}
+	}()
+	if _, _, err := conn.ReadMessage(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestWebSocket_ProtocolErrors(t *testing.T) {
+	for name, frames := range map[string]func(w io.Writer){
+		"continuation": func(w io.Writer) { writeRawFrame(w, true, wsContinuation, []byte("x")) },
+		"interleaved": func(w io.Writer) {
+			writeRawFrame(w, false, wsText, []byte("x"))
+			writeRawFrame(w, true, wsBinary, []byte("y"))
+		},
+		"opcode": func(w io.Writer) { writeRawFrame(w, true, 0x3, nil) },
+		"too large": func(w io.Writer) {
+			w.Write([]byte{0x80 | wsBinary, 127, 0, 0, 0, 0, 0x10, 0, 0, 0})
+		},
+	} {
+		c1, c2 := net.Pipe()
+		conn := &wsConn{conn: c2, reader: bufio.NewReader(c2)}
+		go frames(c1)
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestWebSocket_Handshake(t *testing.T) {
+	// example from RFC 6455 section 1.3
+	if key := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept key %s", key)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		conn, err := wsAccept(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msgType, msg, err := conn.ReadMessage()
+		if err == nil {
+			conn.WriteMessage(msgType, msg)
+		}
+	}))
+	defer ts.Close()
+
+	conn, err := wsDial(ts.URL + "/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(wsText, []byte("echo")); err != nil {
+		t.Fatal(err)
+	}
+	if msgType, msg, err := conn.ReadMessage(); err != nil || msgType != wsText || string(msg) != "echo" {
+		t.Errorf("unexpected echo %d %q %v", msgType, msg, err)
+	}
+	conn.Close()
+
+	if _, err := wsDial(ts.URL + "/missing"); err != StreamNotFoundErr {
+		t.Errorf("expected stream not found, got %v", err)
+	}
+	if _, err := wsDial("ftp://localhost/x"); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+
+	// plain requests and other versions are turned away
+	for _, tc := range []struct {
+		version string
+		upgrade bool
+		status  int
+	}{
+		{"13", false, http.StatusBadRequest},
+		{"8", true, http.StatusUpgradeRequired},
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+"/echo", nil)
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		req.Header.Set("Sec-WebSocket-Version", tc.version)
+		if tc.upgrade {
+			req.Header.Set("Connection", "keep-alive, Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("version %s upgrade %v: expected %d, got %d", tc.version, tc.upgrade, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestWebSocket_Publish(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, WebSocket: true}, false)
+	pub, err := NewTrickleWebSocketPublisher(ts.URL + "/wspub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	const segments = 3
+	for i := 0; i < segments; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 50000+i)
+		if err := pub.Write(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := NewTrickleSubscriber(ts.URL + "/wspub")
+	sub.SetSeq(0)
+	for i := 0; i < segments; i++ {
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if GetSeq(resp) != i || len(data) != 50000+i || data[0] != byte(i) {
+			t.Errorf("unexpected segment seq %d len %d", GetSeq(resp), len(data))
+		}
+	}
+
+	// other content types can be published too
+	cmaf, err := NewTrickleWebSocketPublisherWithConfig(ts.URL+"/wscmaf", TrickleWebSocketPublisherConfig{ContentType: "video/mp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cmaf.Close()
+	if err := cmaf.Write(bytes.NewReader([]byte("fragment"))); err != nil {
+		t.Fatal(err)
+	}
+	cmafSub := NewTrickleSubscriber(ts.URL + "/wscmaf")
+	cmafSub.SetSeq(0)
+	resp, err := cmafSub.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "video/mp4" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	// the endpoint is off unless enabled
+	plain := newTestServer(t, TrickleServerConfig{Autocreate: true}, false)
+	if _, err := NewTrickleWebSocketPublisher(plain.URL + "/wspub"); err == nil {
+		t.Error("expected error without websockets enabled")
+	}
+}
+
+func TestWebSocket_ReadErrorAborts(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, WebSocket: true}, false)
+	pub, err := NewTrickleWebSocketPublisher(ts.URL + "/wsfail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	boom := errors.New("boom")
+	failing := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(boom))
+	if err := pub.Write(failing); !errors.Is(err, boom) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	// the connection is still usable for the next segment
+	if err := pub.Write(strings.NewReader("whole")); err != nil {
+		t.Fatal(err)
+	}
+
+	sub := NewTrickleSubscriber(ts.URL + "/wsfail")
+	sub.SetSeq(0)
+	for _, want := range []struct {
+		data string
+		err  error
+	}{{"partial", ErrSegmentAborted}, {"whole", nil}} {
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(data) != want.data || !errors.Is(err, want.err) {
+			t.Errorf("seq %d: unexpected segment %q %v", GetSeq(resp), data, err)
+		}
+	}
+}
+
+func TestWebSocket_HangupAborts(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, WebSocket: true}, false)
+	hangups := map[string]func(*wsConn){
+		"close frame": func(c *wsConn) { c.Close() },
+		"disconnect":  func(c *wsConn) { c.conn.Close() },
+	}
+	seq := 0
+	for name, hangup := range hangups {
+		conn, err := wsDial(ts.URL + "/hangup/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.writeJSON(&wsMessage{Type: wsMsgStart, Seq: &seq}); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(wsBinary, []byte("partial")); err != nil {
+			t.Fatal(err)
+		}
+		sub := NewTrickleSubscriber(ts.URL + "/hangup")
+		sub.SetSeq(seq)
+		resp, err := sub.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hangup(conn)
+
+		// the truncated segment is not passed off as complete
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if !errors.Is(err, ErrSegmentAborted) || string(data) != "partial" {
+			t.Errorf("%s: expected aborted segment, got %q %v", name, data, err)
+		}
+		seq++
+	}
+}
+
+func TestWebSocket_ServerErrors(t *testing.T) {
+	ts := newTestServer(t, TrickleServerConfig{Autocreate: true, WebSocket: true}, false)
+	for _, tc := range []struct {
+		send func(*wsConn)
+		want string
+	}{
+		{func(c *wsConn) { c.WriteMessage(wsBinary, []byte("x")) }, "without starting"},
+		{func(c *wsConn) { c.writeJSON(&wsMessage{Type: wsMsgEnd}) }, "no segment"},
+		{func(c *wsConn) { c.WriteMessage(wsText, []byte("{")) }, "invalid message"},
+		{func(c *wsConn) { c.writeJSON(&wsMessage{Type: "bogus"}) }, "unknown message"},
+	} {
+		conn, err := wsDial(ts.URL + "/errors/ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.send(conn)
+		_, msg, err := conn.ReadMessage()
+		if err != nil || !strings.Contains(string(msg), tc.want) {
+			t.Errorf("expected %q error, got %s %v", tc.want, msg, err)
+		}
+		conn.Close()
+	}
+}